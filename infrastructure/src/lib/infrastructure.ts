@@ -5,6 +5,8 @@ import * as lambda from 'aws-cdk-lib/aws-lambda';
 import * as lambdaNodejs from 'aws-cdk-lib/aws-lambda-nodejs';
 import * as apigateway from 'aws-cdk-lib/aws-apigateway';
 import * as lambdaEventSources from 'aws-cdk-lib/aws-lambda-event-sources';
+import * as events from 'aws-cdk-lib/aws-events';
+import * as targets from 'aws-cdk-lib/aws-events-targets';
 import * as sns from 'aws-cdk-lib/aws-sns';
 import * as sqs from 'aws-cdk-lib/aws-sqs';
 import * as subscriptions from 'aws-cdk-lib/aws-sns-subscriptions';
@@ -57,44 +59,127 @@ export class StitchFixClientEngagementStack extends cdk.Stack {
       projectionType: dynamodb.ProjectionType.ALL,
     });
 
+    // Idempotency ledger for events handled by the email processor
+    const processedEventsTable = new dynamodb.Table(this, 'ProcessedEventsTable', {
+      partitionKey: { name: 'dedupKey', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY, // For demo purposes only
+      timeToLiveAttribute: 'expiresAt',
+    });
+
+    // Ledger entries by userId, so they can be erased with the user
+    processedEventsTable.addGlobalSecondaryIndex({
+      indexName: 'userIdIndex',
+      partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING },
+      projectionType: dynamodb.ProjectionType.KEYS_ONLY,
+    });
+
+    // Engagement score history (one row per score change)
+    const scoreHistoryTable = new dynamodb.Table(this, 'ScoreHistoryTable', {
+      partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'timestamp', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY, // For demo purposes only
+    });
+
+    // Processor state (sweep checkpoints and email candidates, RFM boundaries) for the email processor
+    const processorStateTable = new dynamodb.Table(this, 'ProcessorStateTable', {
+      partitionKey: { name: 'stateId', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      timeToLiveAttribute: 'expiresAt', // Unprocessed sweep email candidates
+      removalPolicy: cdk.RemovalPolicy.DESTROY, // For demo purposes only
+    });
+
+    // Events the email processor couldn't decode (unknown schema version or invalid payload)
+    const quarantineTable = new dynamodb.Table(this, 'QuarantineTable', {
+      partitionKey: { name: 'dedupKey', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.DESTROY, // For demo purposes only
+      timeToLiveAttribute: 'expiresAt',
+    });
+
+    // Quarantined events by userId, so they can be erased with the user
+    quarantineTable.addGlobalSecondaryIndex({
+      indexName: 'userIdIndex',
+      partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING },
+      projectionType: dynamodb.ProjectionType.KEYS_ONLY,
+    });
+
+    // Receipts of the data erased for deleted users (kept for compliance)
+    const erasureReceiptsTable = new dynamodb.Table(this, 'ErasureReceiptsTable', {
+      partitionKey: { name: 'userId', type: dynamodb.AttributeType.STRING },
+      sortKey: { name: 'requestedAt', type: dynamodb.AttributeType.STRING },
+      billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+      removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+
+    // Deliver events in order per user through a FIFO topic and queue, with
+    // userId as the message group. Changing this replaces the topic and queues.
+    const fifoEvents = process.env['EVENTS_FIFO'] === 'true';
+
     // SNS Topic for events
     const eventsTopic = new sns.Topic(this, 'EventsTopic', {
       displayName: 'Client Engagement Events',
+      fifo: fifoEvents || undefined,
+      contentBasedDeduplication: fifoEvents || undefined,
+    });
+
+    // SNS Topic for email lifecycle events published by the email processor.
+    // Kept separate from the events topic so the processor doesn't consume its own events.
+    const emailEventsTopic = new sns.Topic(this, 'EmailEventsTopic', {
+      displayName: 'Client Engagement Email Events',
+    });
+
+    // Dead letter queue for messages the email processor repeatedly fails to handle
+    const emailDeadLetterQueue = new sqs.Queue(this, 'EmailDeadLetterQueue', {
+      retentionPeriod: cdk.Duration.days(14),
+      fifo: fifoEvents || undefined,
     });
 
     // SQS Queue for email processing
     const emailQueue = new sqs.Queue(this, 'EmailQueue', {
       visibilityTimeout: cdk.Duration.seconds(300),
       retentionPeriod: cdk.Duration.days(14),
+      fifo: fifoEvents || undefined,
+      deadLetterQueue: {
+        queue: emailDeadLetterQueue,
+        maxReceiveCount: 5,
+      },
     });
 
     // Subscribe the email queue to the events topic
     eventsTopic.addSubscription(new subscriptions.SqsSubscription(emailQueue));
 
-    // Stream Processor Lambda
-    const streamProcessorLambda = new lambda.Function(this, 'StreamProcessorLambda', {
-      code: lambda.Code.fromAsset(path.join(GIT_ROOT, 'dist/packages/stream-processor')),
-      handler: 'main.handler',
-      runtime: lambda.Runtime.NODEJS_20_X,
-      timeout: cdk.Duration.seconds(30),
-      memorySize: 256,
-      environment: {
-        SNS_TOPIC_ARN: eventsTopic.topicArn,
-        USERS_TABLE_NAME: usersTable.tableName,
-        ORDERS_TABLE_NAME: usersTable.tableName, // Reusing users table for demo
-      },
-    });
+    // Feed the users table stream to the email processor directly, without the
+    // stream processor hop. The processor accepts stream records as well as SQS messages.
+    const directStream = process.env['DIRECT_STREAM'] === 'true';
 
-    // Grant the stream processor permissions
-    usersTable.grantStreamRead(streamProcessorLambda);
-    eventsTopic.grantPublish(streamProcessorLambda);
+    if (!directStream) {
+      // Stream Processor Lambda
+      const streamProcessorLambda = new lambda.Function(this, 'StreamProcessorLambda', {
+        code: lambda.Code.fromAsset(path.join(GIT_ROOT, 'dist/packages/stream-processor')),
+        handler: 'main.handler',
+        runtime: lambda.Runtime.NODEJS_20_X,
+        timeout: cdk.Duration.seconds(30),
+        memorySize: 256,
+        environment: {
+          SNS_TOPIC_ARN: eventsTopic.topicArn,
+          USERS_TABLE_NAME: usersTable.tableName,
+          ORDERS_TABLE_NAME: usersTable.tableName, // Reusing users table for demo
+        },
+      });
 
-    // Configure the Lambda to be triggered by the DynamoDB stream
-    streamProcessorLambda.addEventSource(new lambdaEventSources.DynamoEventSource(usersTable, {
-      startingPosition: lambda.StartingPosition.LATEST,
-      batchSize: 10,
-      retryAttempts: 3,
-    }));
+      // Grant the stream processor permissions
+      usersTable.grantStreamRead(streamProcessorLambda);
+      eventsTopic.grantPublish(streamProcessorLambda);
+
+      // Configure the Lambda to be triggered by the DynamoDB stream
+      streamProcessorLambda.addEventSource(new lambdaEventSources.DynamoEventSource(usersTable, {
+        startingPosition: lambda.StartingPosition.LATEST,
+        batchSize: 10,
+        retryAttempts: 3,
+      }));
+    }
 
     // Email Processor Lambda (Go)
     const emailProcessorLambda = new lambda.Function(this, 'EmailProcessorLambda', {
@@ -107,6 +192,14 @@ export class StitchFixClientEngagementStack extends cdk.Stack {
       environment: {
         USERS_TABLE_NAME: usersTable.tableName,
         EMAILS_TABLE_NAME: emailsTable.tableName,
+        PROCESSED_EVENTS_TABLE_NAME: processedEventsTable.tableName,
+        SCORE_HISTORY_TABLE_NAME: scoreHistoryTable.tableName,
+        PROCESSOR_STATE_TABLE_NAME: processorStateTable.tableName, // RFM boundaries, sweep candidates of deleted users
+        ERASURE_RECEIPTS_TABLE_NAME: erasureReceiptsTable.tableName,
+        QUARANTINE_TABLE_NAME: quarantineTable.tableName,
+        EMAIL_EVENTS_TOPIC_ARN: emailEventsTopic.topicArn,
+        BATCH_CONCURRENCY: '4', // Records processed at the same time, one at a time per user
+        SCORER: process.env['SCORER'] || 'step', // 'step', 'decay' or 'churn' (needs CHURN_MODEL_PATH)
         ['OPENROUTER_API_KEY']: process.env['OPENROUTER_API_KEY'] || 'dummy-key', // Should be set in deployment
       },
     });
@@ -114,6 +207,12 @@ export class StitchFixClientEngagementStack extends cdk.Stack {
     // Grant the email processor permissions
     usersTable.grantReadWriteData(emailProcessorLambda);
     emailsTable.grantReadWriteData(emailProcessorLambda);
+    processedEventsTable.grantReadWriteData(emailProcessorLambda);
+    scoreHistoryTable.grantReadWriteData(emailProcessorLambda);
+    processorStateTable.grantReadWriteData(emailProcessorLambda);
+    erasureReceiptsTable.grantWriteData(emailProcessorLambda);
+    quarantineTable.grantReadWriteData(emailProcessorLambda);
+    emailEventsTopic.grantPublish(emailProcessorLambda);
     emailProcessorLambda.addToRolePolicy(new iam.PolicyStatement({
       actions: ['ses:SendEmail', 'ses:SendRawEmail'],
       resources: ['*'],
@@ -122,9 +221,55 @@ export class StitchFixClientEngagementStack extends cdk.Stack {
     // Configure the Lambda to be triggered by the SQS queue
     emailProcessorLambda.addEventSource(new lambdaEventSources.SqsEventSource(emailQueue, {
       batchSize: 10,
-      maxBatchingWindow: cdk.Duration.seconds(30),
+      maxBatchingWindow: fifoEvents ? undefined : cdk.Duration.seconds(30), // Not supported for FIFO queues
+      reportBatchItemFailures: true,
     }));
 
+    if (directStream) {
+      emailProcessorLambda.addEventSource(new lambdaEventSources.DynamoEventSource(usersTable, {
+        startingPosition: lambda.StartingPosition.LATEST,
+        batchSize: 10,
+        retryAttempts: 3,
+        reportBatchItemFailures: true,
+      }));
+    }
+
+    // Email Sweep Lambda (Go) - same binary, re-scores dormant users on a schedule
+    const emailSweepLambda = new lambda.Function(this, 'EmailSweepLambda', {
+      code: lambda.Code.fromAsset(path.join(GIT_ROOT, 'packages/email-processor-go/dist')),
+      handler: 'bootstrap',
+      runtime: lambda.Runtime.PROVIDED_AL2023,
+      architecture: lambda.Architecture.X86_64,
+      timeout: cdk.Duration.minutes(15),
+      memorySize: 256,
+      reservedConcurrentExecutions: 1, // Only one sweep may advance the checkpoints at a time
+      environment: {
+        PROCESSOR_MODE: 'sweep',
+        USERS_TABLE_NAME: usersTable.tableName,
+        EMAILS_TABLE_NAME: emailsTable.tableName,
+        SCORE_HISTORY_TABLE_NAME: scoreHistoryTable.tableName,
+        PROCESSOR_STATE_TABLE_NAME: processorStateTable.tableName,
+        SWEEP_SEGMENTS: '4',
+        SWEEP_EMAIL_BUDGET: process.env['SWEEP_EMAIL_BUDGET'] || '0', // 0 = unlimited
+        EMAIL_EVENTS_TOPIC_ARN: emailEventsTopic.topicArn,
+        SCORER: process.env['SCORER'] || 'step', // 'step', 'decay' or 'churn' (needs CHURN_MODEL_PATH)
+        ['OPENROUTER_API_KEY']: process.env['OPENROUTER_API_KEY'] || 'dummy-key', // Should be set in deployment
+      },
+    });
+
+    // Grant the sweep permissions
+    usersTable.grantReadWriteData(emailSweepLambda);
+    emailsTable.grantReadWriteData(emailSweepLambda);
+    scoreHistoryTable.grantReadWriteData(emailSweepLambda);
+    processorStateTable.grantReadWriteData(emailSweepLambda);
+    emailEventsTopic.grantPublish(emailSweepLambda);
+
+    // Run the sweep hourly - a new sweep starts daily, other runs resume an unfinished one
+    new events.Rule(this, 'EmailSweepSchedule', {
+      schedule: events.Schedule.rate(cdk.Duration.hours(1)),
+      targets: [new targets.LambdaFunction(emailSweepLambda)],
+    });
+
     // Backend API Lambda
     const backendLambda = new lambda.Function(this, 'BackendLambda', {
       code: lambda.Code.fromAsset(path.join(GIT_ROOT, 'dist/packages/backend')),
@@ -225,11 +370,21 @@ export class StitchFixClientEngagementStack extends cdk.Stack {
       description: 'The ARN of the events topic',
     });
 
+    new cdk.CfnOutput(this, 'EmailEventsTopicArn', {
+      value: emailEventsTopic.topicArn,
+      description: 'The ARN of the email lifecycle events topic',
+    });
+
     new cdk.CfnOutput(this, 'EmailQueueUrl', {
       value: emailQueue.queueUrl,
       description: 'The URL of the email queue',
     });
 
+    new cdk.CfnOutput(this, 'EmailDeadLetterQueueUrl', {
+      value: emailDeadLetterQueue.queueUrl,
+      description: 'The URL of the email dead letter queue',
+    });
+
     new cdk.CfnOutput(this, 'FrontendUrl', {
       value: `https://${distribution.distributionDomainName}`,
       description: 'The URL of the frontend',
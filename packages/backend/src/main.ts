@@ -69,7 +69,9 @@ async function publishEvent(eventType: EventType, payload: any) {
           DataType: 'String',
           StringValue: eventType
         }
-      }
+      },
+      // A FIFO topic keeps each user's events in order
+      MessageGroupId: SNS_TOPIC_ARN.endsWith('.fifo') ? payload.userId : undefined
     });
     
     const result = await snsClient.send(command);
@@ -344,47 +346,25 @@ app.post('/api/orders', async (req, res) => {
       return res.status(404).json(createApiResponse(false, null, 'User not found'));
     }
     
-    // Update user order data
-    user.orderCount += 1;
-    user.lastOrderDate = new Date().toISOString();
-    
-    // Update average order value
-    const totalOrders = user.orderCount;
-    const previousTotal = user.averageOrderValue * (totalOrders - 1);
-    user.averageOrderValue = (previousTotal + totalValue) / totalOrders;
-    
-    // Update timestamps
-    user.updatedAt = new Date().toISOString();
-    
-    // Recalculate engagement score
-    user.engagementScore = calculateEngagementScore(user);
-    
-    // Update user in DynamoDB
-    const updateUserCommand = new PutCommand({
-      TableName: USERS_TABLE_NAME,
-      Item: user
-    });
-    
-    await docClient.send(updateUserCommand);
+    // The email processor maintains the user's order aggregates from the
+    // order events, so the user row is not updated here
+    const now = new Date().toISOString();
     
     // Create order
     const orderId = uuidv4();
     const order = {
       orderId,
       userId,
-      orderDate: user.lastOrderDate,
+      orderDate: now,
       totalValue,
       items,
       status: OrderStatus.CREATED,
-      createdAt: user.lastOrderDate
+      createdAt: now
     };
     
     // Publish order created event
     await publishEvent(EventType.ORDER_CREATED, order);
     
-    // Publish user updated event
-    await publishEvent(EventType.USER_UPDATED, user);
-    
     // Return success
     res.status(201).json(createApiResponse(true, order));
   } catch (error) {
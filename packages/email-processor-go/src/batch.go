@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Batch processing settings
+const (
+	// Default number of SQS records processed at the same time
+	DefaultBatchConcurrency = 4
+
+	// Time a record needs for a full generate and send cycle: up to 30s on
+	// OpenRouter plus the DynamoDB writes. No record is started with less left.
+	BatchRecordTimeMargin = 35 * time.Second
+
+	// In-flight work is cancelled this long before the Lambda deadline, leaving
+	// time to release send claims and record outcomes before the function is killed
+	BatchCleanupMargin = 3 * time.Second
+)
+
+// Maximum records processed at the same time (set from BATCH_CONCURRENCY)
+var BatchConcurrency = DefaultBatchConcurrency
+
+// recordLane is the records of one user in batch order. A lane is processed
+// by a single worker, so a user's records never run at the same time.
+type recordLane struct {
+	Key     string
+	Records []int
+}
+
+// Process a batch of SQS records with up to BatchConcurrency workers. Records
+// for the same user are processed one after another in batch order, records
+// for different users in parallel. Records that can't be started before the
+// deadline are handed back. Returns which records to report for redelivery,
+// by index.
+func processBatch(ctx context.Context, records []events.SQSMessage) []bool {
+	ctx, cancel := withCleanupMargin(ctx)
+	defer cancel()
+
+	redeliver := make([]bool, len(records))
+	lanes := batchLanes(records)
+
+	workers := BatchConcurrency
+	if workers > len(lanes) {
+		workers = len(lanes)
+	}
+	debugLog(DEBUG_INFO, "Processing %d records for %d users with %d workers", len(records), len(lanes), workers)
+
+	queue := make(chan recordLane)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lane := range queue {
+				processLane(ctx, records, lane, redeliver)
+			}
+		}()
+	}
+	for _, lane := range lanes {
+		queue <- lane
+	}
+	close(queue)
+	wg.Wait()
+
+	return redeliver
+}
+
+// Derive a context that is cancelled BatchCleanupMargin before the Lambda
+// deadline, so in-flight OpenRouter calls fail their records cleanly instead
+// of the whole batch timing out
+func withCleanupMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-BatchCleanupMargin))
+}
+
+// Group the records of a batch by user, keeping batch order within each
+// group. Records whose user can't be determined get a lane of their own.
+func batchLanes(records []events.SQSMessage) []recordLane {
+	var lanes []recordLane
+	laneIndex := make(map[string]int)
+	for i, message := range records {
+		key := messageUserKey(message)
+		if key == "" {
+			key = "message#" + message.MessageId
+		}
+		if j, ok := laneIndex[key]; ok {
+			lanes[j].Records = append(lanes[j].Records, i)
+			continue
+		}
+		laneIndex[key] = len(lanes)
+		lanes = append(lanes, recordLane{Key: key, Records: []int{i}})
+	}
+	return lanes
+}
+
+// Key of the user a record belongs to: its FIFO message group, or else the
+// userId of its event. Returns "" if neither can be read.
+func messageUserKey(message events.SQSMessage) string {
+	if groupID := messageGroupID(message); groupID != "" {
+		return "group#" + groupID
+	}
+
+	event, _, err := decodeMessageBody(message.Body)
+	if err != nil {
+		return ""
+	}
+	if userID := eventUserID(event); userID != "" {
+		return "user#" + userID
+	}
+	return ""
+}
+
+// Process the records of one lane in order. Each worker writes only the
+// redelivery flags of its own lane's records.
+func processLane(ctx context.Context, records []events.SQSMessage, lane recordLane, redeliver []bool) {
+	// Set once a FIFO message is reported for redelivery. The group's later
+	// messages are redelivered unprocessed, so the group stays in order.
+	blocked := false
+	for _, i := range lane.Records {
+		message := records[i]
+		if blocked {
+			debugLog(DEBUG_WARNING, "Earlier message in group %s failed, reporting message %s for redelivery",
+				messageGroupID(message), message.MessageId)
+			redeliver[i] = true
+			continue
+		}
+		if !hasTimeForMoreWork(ctx, BatchRecordTimeMargin) {
+			debugLog(DEBUG_WARNING, "Too little time left before the deadline, reporting message %s for redelivery",
+				message.MessageId)
+			redeliver[i] = true
+			continue
+		}
+
+		redeliver[i] = processRecord(ctx, i, len(records), message)
+		if redeliver[i] && messageGroupID(message) != "" {
+			blocked = true
+		}
+	}
+}
+
+// Process one record and report whether it should be redelivered
+func processRecord(ctx context.Context, i, total int, message events.SQSMessage) (redeliver bool) {
+	// A panic fails only this record instead of the whole batch
+	defer func() {
+		if r := recover(); r != nil {
+			debugLog(DEBUG_ERROR, "Panic processing message %s, reporting for redelivery: %v", message.MessageId, r)
+			redeliver = true
+		}
+	}()
+
+	debugLog(DEBUG_INFO, "[%d/%d] Processing message: %s", i+1, total, message.MessageId)
+
+	if err := processMessage(ctx, message); err != nil {
+		if isRetryable(err) {
+			debugLog(DEBUG_WARNING, "Retryable error processing message %s, reporting for redelivery: %v",
+				message.MessageId, err)
+			return true
+		}
+		debugLog(DEBUG_ERROR, "Permanent error processing message %s, dropping: %v", message.MessageId, err)
+		return false
+	}
+
+	debugLog(DEBUG_INFO, "Message processed successfully: %s", message.MessageId)
+	return false
+}
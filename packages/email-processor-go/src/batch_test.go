@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// An SQS message carrying a raw event for a user
+func testUserMessage(id, userID string) events.SQSMessage {
+	return events.SQSMessage{
+		MessageId: id,
+		Body:      fmt.Sprintf(`{"type":"USER_UPDATED","payload":{"userId":%q},"timestamp":"2026-03-31T12:00:00Z"}`, userID),
+	}
+}
+
+// An SQS message from a FIFO queue
+func testGroupMessage(id, groupID, body string) events.SQSMessage {
+	return events.SQSMessage{
+		MessageId:  id,
+		Body:       body,
+		Attributes: map[string]string{sqsMessageGroupIDAttribute: groupID},
+	}
+}
+
+func TestBatchLanes(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []events.SQSMessage
+		want    []recordLane
+	}{
+		{
+			name:    "empty batch",
+			records: nil,
+			want:    nil,
+		},
+		{
+			name: "records of a user share a lane in batch order",
+			records: []events.SQSMessage{
+				testUserMessage("m1", "alice"),
+				testUserMessage("m2", "bob"),
+				testUserMessage("m3", "alice"),
+				testUserMessage("m4", "carol"),
+				testUserMessage("m5", "bob"),
+			},
+			want: []recordLane{
+				{Key: "user#alice", Records: []int{0, 2}},
+				{Key: "user#bob", Records: []int{1, 4}},
+				{Key: "user#carol", Records: []int{3}},
+			},
+		},
+		{
+			name: "FIFO message group takes precedence over the userId",
+			records: []events.SQSMessage{
+				testGroupMessage("m1", "alice", `{}`),
+				testUserMessage("m2", "alice"),
+				testGroupMessage("m3", "alice", testUserMessage("", "bob").Body),
+			},
+			want: []recordLane{
+				{Key: "group#alice", Records: []int{0, 2}},
+				{Key: "user#alice", Records: []int{1}},
+			},
+		},
+		{
+			name: "unreadable records get a lane each",
+			records: []events.SQSMessage{
+				{MessageId: "m1", Body: "not json"},
+				{MessageId: "m2", Body: `{"type":"USER_UPDATED","payload":{},"timestamp":"2026-03-31T12:00:00Z"}`},
+				testUserMessage("m3", "alice"),
+			},
+			want: []recordLane{
+				{Key: "message#m1", Records: []int{0}},
+				{Key: "message#m2", Records: []int{1}},
+				{Key: "user#alice", Records: []int{2}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := batchLanes(tt.records)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batchLanes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessLaneNearTheDeadline(t *testing.T) {
+	records := []events.SQSMessage{
+		testUserMessage("m1", "alice"),
+		testUserMessage("m2", "alice"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), BatchRecordTimeMargin/2)
+	defer cancel()
+
+	// Nothing is started, so every record is handed back
+	redeliver := make([]bool, len(records))
+	processLane(ctx, records, recordLane{Key: "user#alice", Records: []int{0, 1}}, redeliver)
+	if !reflect.DeepEqual(redeliver, []bool{true, true}) {
+		t.Errorf("redeliver = %v, want both records", redeliver)
+	}
+}
+
+func TestProcessLaneDropsMalformedRecords(t *testing.T) {
+	records := []events.SQSMessage{
+		testGroupMessage("m1", "alice", "not json"),
+		testGroupMessage("m2", "alice", `{"unexpected":true}`),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Malformed records fail permanently, so they don't block the group
+	redeliver := make([]bool, len(records))
+	processLane(ctx, records, recordLane{Key: "group#alice", Records: []int{0, 1}}, redeliver)
+	if !reflect.DeepEqual(redeliver, []bool{false, false}) {
+		t.Errorf("redeliver = %v, want neither record", redeliver)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ScoreBreakdown explains how a scorer arrived at an engagement score
+type ScoreBreakdown struct {
+	Scorer         string        `json:"scorer"`
+	ScorerVersion  string        `json:"scorerVersion"`
+	BaseScore      float64       `json:"baseScore"`
+	Factors        []ScoreFactor `json:"factors"`
+	UnclampedScore float64       `json:"unclampedScore"`
+	Score          float64       `json:"score"`
+	Clamped        bool          `json:"clamped"`
+	CalculatedAt   string        `json:"calculatedAt"`
+
+	// Personal order cadence in days and days since last order divided by
+	// it, when the user has enough order history for a cadence
+	CadenceDays     float64 `json:"cadenceDays,omitempty"`
+	RelativeRecency float64 `json:"relativeRecency,omitempty"`
+
+	// Probability that the user will not order again, from the churn scorer
+	ChurnProbability float64 `json:"churnProbability,omitempty"`
+}
+
+// ScoreFactor is a single input's effect on the score
+type ScoreFactor struct {
+	Name         string  `json:"name"`
+	RawInput     float64 `json:"rawInput"`
+	Contribution float64 `json:"contribution"`
+	// Capped is set when the input was limited before being weighted (e.g. order count above the cap)
+	Capped bool   `json:"capped,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Add a factor's contribution to the breakdown
+func (b *ScoreBreakdown) addFactor(factor ScoreFactor) {
+	b.Factors = append(b.Factors, factor)
+	b.UnclampedScore += factor.Contribution
+}
+
+// Clamp the accumulated score to a range and record whether clamping applied
+func (b *ScoreBreakdown) clamp(minScore, maxScore float64) {
+	b.Score = b.UnclampedScore
+	if b.Score < minScore {
+		b.Score = minScore
+	} else if b.Score > maxScore {
+		b.Score = maxScore
+	}
+	b.Clamped = b.Score != b.UnclampedScore
+}
+
+// Convert a score breakdown to a DynamoDB map attribute
+func breakdownToAttributeValue(b ScoreBreakdown) types.AttributeValue {
+	factors := make([]types.AttributeValue, 0, len(b.Factors))
+	for _, factor := range b.Factors {
+		item := map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{
+				Value: factor.Name,
+			},
+			"rawInput": &types.AttributeValueMemberN{
+				Value: formatScoreNumber(factor.RawInput),
+			},
+			"contribution": &types.AttributeValueMemberN{
+				Value: formatScoreNumber(factor.Contribution),
+			},
+			"capped": &types.AttributeValueMemberBOOL{
+				Value: factor.Capped,
+			},
+		}
+		if factor.Detail != "" {
+			item["detail"] = &types.AttributeValueMemberS{
+				Value: factor.Detail,
+			}
+		}
+		factors = append(factors, &types.AttributeValueMemberM{Value: item})
+	}
+
+	item := map[string]types.AttributeValue{
+		"scorer": &types.AttributeValueMemberS{
+			Value: b.Scorer,
+		},
+		"scorerVersion": &types.AttributeValueMemberS{
+			Value: b.ScorerVersion,
+		},
+		"baseScore": &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.BaseScore),
+		},
+		"factors": &types.AttributeValueMemberL{
+			Value: factors,
+		},
+		"unclampedScore": &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.UnclampedScore),
+		},
+		"score": &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.Score),
+		},
+		"clamped": &types.AttributeValueMemberBOOL{
+			Value: b.Clamped,
+		},
+		"calculatedAt": &types.AttributeValueMemberS{
+			Value: b.CalculatedAt,
+		},
+	}
+	if b.CadenceDays > 0 {
+		item["cadenceDays"] = &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.CadenceDays),
+		}
+		item["relativeRecency"] = &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.RelativeRecency),
+		}
+	}
+	if b.ChurnProbability > 0 {
+		item["churnProbability"] = &types.AttributeValueMemberN{
+			Value: formatScoreNumber(b.ChurnProbability),
+		}
+	}
+
+	return &types.AttributeValueMemberM{Value: item}
+}
+
+// Convert a DynamoDB map attribute back to a score breakdown
+func breakdownFromAttributeValue(av types.AttributeValue) (ScoreBreakdown, bool) {
+	var b ScoreBreakdown
+
+	m, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return b, false
+	}
+
+	b.Scorer = stringAttribute(m.Value, "scorer")
+	b.ScorerVersion = stringAttribute(m.Value, "scorerVersion")
+	b.BaseScore = numberAttribute(m.Value, "baseScore")
+	b.UnclampedScore = numberAttribute(m.Value, "unclampedScore")
+	b.Score = numberAttribute(m.Value, "score")
+	b.Clamped = boolAttribute(m.Value, "clamped")
+	b.CalculatedAt = stringAttribute(m.Value, "calculatedAt")
+	b.CadenceDays = numberAttribute(m.Value, "cadenceDays")
+	b.RelativeRecency = numberAttribute(m.Value, "relativeRecency")
+	b.ChurnProbability = numberAttribute(m.Value, "churnProbability")
+
+	if factors, ok := m.Value["factors"].(*types.AttributeValueMemberL); ok {
+		for _, factorAV := range factors.Value {
+			factor, ok := factorAV.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+			b.Factors = append(b.Factors, ScoreFactor{
+				Name:         stringAttribute(factor.Value, "name"),
+				RawInput:     numberAttribute(factor.Value, "rawInput"),
+				Contribution: numberAttribute(factor.Value, "contribution"),
+				Capped:       boolAttribute(factor.Value, "capped"),
+				Detail:       stringAttribute(factor.Value, "detail"),
+			})
+		}
+	}
+
+	return b, true
+}
+
+// Format a number for a breakdown attribute
+func formatScoreNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Read a string attribute from a DynamoDB map, or "" if missing
+func stringAttribute(m map[string]types.AttributeValue, key string) string {
+	if value, ok := m[key].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+// Read a number attribute from a DynamoDB map, or 0 if missing
+func numberAttribute(m map[string]types.AttributeValue, key string) float64 {
+	if value, ok := m[key].(*types.AttributeValueMemberN); ok {
+		number, _ := strconv.ParseFloat(value.Value, 64)
+		return number
+	}
+	return 0
+}
+
+// Read a boolean attribute from a DynamoDB map, or false if missing
+func boolAttribute(m map[string]types.AttributeValue, key string) bool {
+	if value, ok := m[key].(*types.AttributeValueMemberBOOL); ok {
+		return value.Value
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Number of most recent orders used to derive a user's cadence
+const CadenceOrderWindow = 12
+
+// CadenceConfig controls cadence-relative recency scoring
+type CadenceConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// The cadence the recency breakpoints were designed for. Days since last
+	// order are rescaled by ReferenceDays / personal cadence.
+	ReferenceDays float64 `json:"referenceDays" yaml:"referenceDays"`
+	// Orders needed before a personal cadence is trusted
+	MinOrders int `json:"minOrders" yaml:"minOrders"`
+	// Limits on the derived cadence, so a burst of orders or one long gap
+	// doesn't make recency meaningless
+	MinDays float64 `json:"minDays" yaml:"minDays"`
+	MaxDays float64 `json:"maxDays" yaml:"maxDays"`
+}
+
+// Derive the user's typical number of days between orders as the median of
+// the intervals between their most recent orders
+func personalCadenceDays(user User, cfg CadenceConfig) (float64, bool) {
+	var dates []time.Time
+	for _, entry := range user.OrderHistory {
+		if !entry.counted() {
+			continue
+		}
+		if date, err := time.Parse(time.RFC3339, entry.OrderDate); err == nil {
+			dates = append(dates, date)
+		}
+	}
+
+	minOrders := cfg.MinOrders
+	if minOrders < 2 {
+		minOrders = 2
+	}
+	if len(dates) < minOrders {
+		return 0, false
+	}
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	if len(dates) > CadenceOrderWindow {
+		dates = dates[len(dates)-CadenceOrderWindow:]
+	}
+
+	intervals := make([]float64, 0, len(dates)-1)
+	for i := 1; i < len(dates); i++ {
+		intervals = append(intervals, dates[i].Sub(dates[i-1]).Hours()/24)
+	}
+	sort.Float64s(intervals)
+
+	median := intervals[len(intervals)/2]
+	if len(intervals)%2 == 0 {
+		median = (intervals[len(intervals)/2-1] + intervals[len(intervals)/2]) / 2
+	}
+
+	if cfg.MinDays > 0 {
+		median = math.Max(median, cfg.MinDays)
+	}
+	if cfg.MaxDays > 0 {
+		median = math.Min(median, cfg.MaxDays)
+	}
+	return median, median > 0
+}
+
+// Rescale days since last order relative to the user's personal cadence, so
+// a quarterly client 90 days out scores like a monthly client 30 days out.
+// Records the cadence on the breakdown when one is used.
+func cadenceAdjustedRecencyDays(user User, days float64, cfg CadenceConfig, breakdown *ScoreBreakdown) float64 {
+	if !cfg.Enabled || cfg.ReferenceDays <= 0 {
+		return days
+	}
+
+	cadence, ok := personalCadenceDays(user, cfg)
+	if !ok {
+		return days
+	}
+
+	breakdown.CadenceDays = cadence
+	breakdown.RelativeRecency = days / cadence
+	return breakdown.RelativeRecency * cfg.ReferenceDays
+}
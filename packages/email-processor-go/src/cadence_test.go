@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Build an order history with orders on the given days, counted from an
+// arbitrary start
+func testOrderHistory(days ...int) map[string]OrderHistoryEntry {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := make(map[string]OrderHistoryEntry, len(days))
+	for i, day := range days {
+		history[fmt.Sprintf("order-%02d", i)] = OrderHistoryEntry{
+			OrderDate: start.AddDate(0, 0, day).Format(time.RFC3339),
+			Status:    OrderStatusCreated,
+			Revision:  1,
+		}
+	}
+	return history
+}
+
+func TestPersonalCadenceDays(t *testing.T) {
+	cfg := CadenceConfig{Enabled: true, ReferenceDays: 30, MinOrders: 3, MinDays: 14, MaxDays: 180}
+
+	cancelled := testOrderHistory(0, 30, 60, 75)
+	entry := cancelled["order-03"]
+	entry.Status = OrderStatusCancelled
+	cancelled["order-03"] = entry
+
+	// 16 orders 100 days apart, then 11 more 10 days apart. Over all orders
+	// the median interval is 100 days, over the last 12 it is 10.
+	var windowed []int
+	for i := 0; i < 16; i++ {
+		windowed = append(windowed, i*100)
+	}
+	for i := 1; i <= 11; i++ {
+		windowed = append(windowed, 1500+i*10)
+	}
+
+	tests := []struct {
+		name    string
+		history map[string]OrderHistoryEntry
+		want    float64
+		wantOK  bool
+	}{
+		{
+			name:    "too few orders",
+			history: testOrderHistory(0, 30),
+		},
+		{
+			name:    "monthly",
+			history: testOrderHistory(0, 30, 60, 90),
+			want:    30, wantOK: true,
+		},
+		{
+			name:    "median ignores one long gap",
+			history: testOrderHistory(0, 30, 60, 300),
+			want:    30, wantOK: true,
+		},
+		{
+			name:    "even number of intervals averages the middle two",
+			history: testOrderHistory(0, 20, 60, 100, 200),
+			want:    40, wantOK: true,
+		},
+		{
+			name:    "cancelled orders are ignored",
+			history: cancelled,
+			want:    30, wantOK: true,
+		},
+		{
+			name:    "limited to minDays",
+			history: testOrderHistory(0, 2, 4, 6),
+			want:    14, wantOK: true,
+		},
+		{
+			name:    "limited to maxDays",
+			history: testOrderHistory(0, 365, 730),
+			want:    180, wantOK: true,
+		},
+		{
+			name:    "only the most recent orders count",
+			history: testOrderHistory(windowed...),
+			want:    14, wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := personalCadenceDays(User{OrderHistory: tt.history}, cfg)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok {
+				assertScore(t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCadenceAdjustedRecencyDays(t *testing.T) {
+	cfg := CadenceConfig{Enabled: true, ReferenceDays: 30, MinOrders: 3, MinDays: 14, MaxDays: 180}
+	quarterly := User{OrderHistory: testOrderHistory(0, 90, 180, 270)}
+
+	var breakdown ScoreBreakdown
+	assertScore(t, cadenceAdjustedRecencyDays(quarterly, 90, cfg, &breakdown), 30)
+	assertScore(t, breakdown.CadenceDays, 90)
+	assertScore(t, breakdown.RelativeRecency, 1)
+
+	// Without a cadence the raw days are used and nothing is recorded
+	breakdown = ScoreBreakdown{}
+	assertScore(t, cadenceAdjustedRecencyDays(User{}, 90, cfg, &breakdown), 90)
+	if breakdown.CadenceDays != 0 {
+		t.Errorf("cadenceDays = %.2f, want 0", breakdown.CadenceDays)
+	}
+
+	cfg.Enabled = false
+	assertScore(t, cadenceAdjustedRecencyDays(quarterly, 90, cfg, &breakdown), 90)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CategoryConfig controls how category affinity is derived from order items
+type CategoryConfig struct {
+	// Spend in an order counts half as much after this many days
+	HalfLifeDays float64 `json:"halfLifeDays" yaml:"halfLifeDays"`
+	// Number of categories kept as preferred (and as lapsed)
+	TopCategories int `json:"topCategories" yaml:"topCategories"`
+	// A category is lapsed if it was last bought more than this many days ago...
+	LapsedDays float64 `json:"lapsedDays" yaml:"lapsedDays"`
+	// ...and made up at least this share of the user's all-time spend
+	MinLapsedShare float64 `json:"minLapsedShare" yaml:"minLapsedShare"`
+}
+
+// Check the category settings can produce a profile
+func validateCategoryConfig(cfg CategoryConfig) error {
+	if cfg.HalfLifeDays <= 0 || cfg.TopCategories <= 0 {
+		return fmt.Errorf("categories config needs positive halfLifeDays and topCategories")
+	}
+	return nil
+}
+
+// Affinities within this distance of the stored ones are not rewritten
+const CategoryAffinityTolerance = 0.01
+
+// CategoryProfile is a user's category preferences derived from their orders
+type CategoryProfile struct {
+	// Recency-weighted share of spend per category, summing to 1
+	Affinity map[string]float64
+	// Categories with the highest affinity, strongest first
+	Preferred []string
+	// Categories the user used to buy but has not bought recently, biggest spend first
+	Lapsed []string
+}
+
+// Order item categories with spend, from an order payload
+func orderCategorySpend(order Order) map[string]float64 {
+	spend := make(map[string]float64)
+	for _, item := range order.Items {
+		if item.Category == "" {
+			continue
+		}
+		quantity := item.Quantity
+		if quantity <= 0 {
+			quantity = 1
+		}
+		spend[item.Category] += math.Max(item.Price, 0) * float64(quantity)
+	}
+	if len(spend) == 0 {
+		return nil
+	}
+	return spend
+}
+
+// Derive a user's category profile from the categories in their order history.
+// The profile is empty if no order carried item categories.
+func categoryProfile(user User, cfg CategoryConfig, now time.Time) CategoryProfile {
+	profile := CategoryProfile{Affinity: map[string]float64{}}
+
+	weighted := make(map[string]float64)
+	allTime := make(map[string]float64)
+	lastBought := make(map[string]time.Time)
+	totalWeighted, totalAllTime := 0.0, 0.0
+
+	for _, entry := range user.OrderHistory {
+		orderDate, err := time.Parse(time.RFC3339, entry.OrderDate)
+		if err != nil || !entry.counted() {
+			continue
+		}
+		ageDays := math.Max(now.Sub(orderDate).Hours()/24, 0)
+		weight := math.Pow(2, -ageDays/cfg.HalfLifeDays)
+
+		for category, spend := range entry.Categories {
+			weighted[category] += spend * weight
+			allTime[category] += spend
+			totalWeighted += spend * weight
+			totalAllTime += spend
+			if orderDate.After(lastBought[category]) {
+				lastBought[category] = orderDate
+			}
+		}
+	}
+	if totalAllTime <= 0 {
+		return profile
+	}
+
+	for category, value := range weighted {
+		if totalWeighted > 0 {
+			profile.Affinity[category] = value / totalWeighted
+		}
+	}
+	profile.Preferred = topCategories(profile.Affinity, cfg.TopCategories)
+
+	lapsed := make(map[string]float64)
+	for category, spend := range allTime {
+		share := spend / totalAllTime
+		if now.Sub(lastBought[category]).Hours()/24 > cfg.LapsedDays && share >= cfg.MinLapsedShare {
+			lapsed[category] = share
+		}
+	}
+	profile.Lapsed = topCategories(lapsed, cfg.TopCategories)
+
+	return profile
+}
+
+// The n categories with the highest values, ties broken by name
+func topCategories(values map[string]float64, n int) []string {
+	categories := make([]string, 0, len(values))
+	for category := range values {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if values[categories[i]] != values[categories[j]] {
+			return values[categories[i]] > values[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+	if len(categories) > n {
+		categories = categories[:n]
+	}
+	return categories
+}
+
+// Check whether the category profile stored on the user matches a freshly
+// derived one. An empty profile leaves the stored (e.g. hand-maintained)
+// preferred categories alone.
+func storedCategoriesCurrent(user User, profile CategoryProfile) bool {
+	if len(profile.Affinity) == 0 {
+		return true
+	}
+	if !equalStrings(user.PreferredCategories, profile.Preferred) || !equalStrings(user.LapsedCategories, profile.Lapsed) {
+		return false
+	}
+	if len(user.CategoryAffinity) != len(profile.Affinity) {
+		return false
+	}
+	for category, affinity := range profile.Affinity {
+		stored, ok := user.CategoryAffinity[category]
+		if !ok || math.Abs(stored-affinity) > CategoryAffinityTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Format a category list for the email prompt
+func promptList(categories []string) string {
+	if len(categories) == 0 {
+		return "none"
+	}
+	return strings.Join(categories, ", ")
+}
+
+// Compare two string slices element by element
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Convert a map of numbers to a DynamoDB map attribute
+func numberMapAttributeValue(values map[string]float64) types.AttributeValue {
+	m := make(map[string]types.AttributeValue, len(values))
+	for key, value := range values {
+		m[key] = &types.AttributeValueMemberN{
+			Value: formatScoreNumber(value),
+		}
+	}
+	return &types.AttributeValueMemberM{Value: m}
+}
+
+// Read a map of numbers from a DynamoDB map attribute, or nil if it isn't one
+func numberMapFromAttributeValue(av types.AttributeValue) map[string]float64 {
+	m, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return nil
+	}
+	values := make(map[string]float64, len(m.Value))
+	for key := range m.Value {
+		values[key] = numberAttribute(m.Value, key)
+	}
+	return values
+}
+
+// Convert a list of strings to a DynamoDB list attribute
+func stringListAttributeValue(values []string) types.AttributeValue {
+	list := make([]types.AttributeValue, 0, len(values))
+	for _, value := range values {
+		list = append(list, &types.AttributeValueMemberS{
+			Value: value,
+		})
+	}
+	return &types.AttributeValueMemberL{Value: list}
+}
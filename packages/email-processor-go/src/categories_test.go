@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCategoryProfile(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	cfg := CategoryConfig{HalfLifeDays: 90, TopCategories: 3, LapsedDays: 120, MinLapsedShare: 0.1}
+	order := func(daysAgo int, status string, categories map[string]float64) OrderHistoryEntry {
+		return OrderHistoryEntry{
+			OrderDate:  now.AddDate(0, 0, -daysAgo).Format(time.RFC3339),
+			Categories: categories,
+			Status:     status,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		history       map[string]OrderHistoryEntry
+		wantAffinity  map[string]float64
+		wantPreferred []string
+		wantLapsed    []string
+	}{
+		{
+			name:         "no orders",
+			wantAffinity: map[string]float64{},
+		},
+		{
+			name: "orders with no category spend",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(10, OrderStatusDelivered, nil),
+				"order-2": order(20, OrderStatusDelivered, map[string]float64{"dresses": 0}),
+			},
+			wantAffinity: map[string]float64{},
+		},
+		{
+			name: "spend halves every half-life",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(0, OrderStatusDelivered, map[string]float64{"dresses": 100}),
+				"order-2": order(90, OrderStatusDelivered, map[string]float64{"jeans": 200}),
+			},
+			wantAffinity:  map[string]float64{"dresses": 0.5, "jeans": 0.5},
+			wantPreferred: []string{"dresses", "jeans"},
+		},
+		{
+			name: "lapsed only at the minimum share of all-time spend",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(0, OrderStatusDelivered, map[string]float64{"dresses": 850}),
+				"order-2": order(200, OrderStatusDelivered, map[string]float64{"jeans": 100, "socks": 50}),
+			},
+			wantAffinity:  map[string]float64{"dresses": 0.9635, "jeans": 0.0243, "socks": 0.0122},
+			wantPreferred: []string{"dresses", "jeans", "socks"},
+			wantLapsed:    []string{"jeans"},
+		},
+		{
+			name: "not lapsed within lapsedDays",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(0, OrderStatusDelivered, map[string]float64{"dresses": 100}),
+				"order-2": order(120, OrderStatusDelivered, map[string]float64{"jeans": 100}),
+			},
+			wantAffinity:  map[string]float64{"dresses": 0.7160, "jeans": 0.2840},
+			wantPreferred: []string{"dresses", "jeans"},
+		},
+		{
+			name: "cancelled and returned orders don't count",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(0, OrderStatusDelivered, map[string]float64{"dresses": 100}),
+				"order-2": order(5, OrderStatusCancelled, map[string]float64{"coats": 500}),
+				"order-3": order(300, OrderStatusReturned, map[string]float64{"jeans": 500}),
+			},
+			wantAffinity:  map[string]float64{"dresses": 1},
+			wantPreferred: []string{"dresses"},
+		},
+		{
+			name: "preferred limited to topCategories, ties by name",
+			history: map[string]OrderHistoryEntry{
+				"order-1": order(0, OrderStatusDelivered, map[string]float64{"tops": 40, "jeans": 20, "dresses": 20, "socks": 20}),
+			},
+			wantAffinity:  map[string]float64{"tops": 0.4, "jeans": 0.2, "dresses": 0.2, "socks": 0.2},
+			wantPreferred: []string{"tops", "dresses", "jeans"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := categoryProfile(User{OrderHistory: tt.history}, cfg, now)
+			if len(got.Affinity) != len(tt.wantAffinity) {
+				t.Fatalf("affinity = %v, want %v", got.Affinity, tt.wantAffinity)
+			}
+			for category, want := range tt.wantAffinity {
+				assertScore(t, got.Affinity[category], want)
+			}
+			if !equalStrings(got.Preferred, tt.wantPreferred) {
+				t.Errorf("preferred = %v, want %v", got.Preferred, tt.wantPreferred)
+			}
+			if !equalStrings(got.Lapsed, tt.wantLapsed) {
+				t.Errorf("lapsed = %v, want %v", got.Lapsed, tt.wantLapsed)
+			}
+		})
+	}
+}
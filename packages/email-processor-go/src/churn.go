@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Features used by the churn model, in coefficient order. Models trained on a
+// different feature list are rejected at load time.
+var churnFeatureNames = []string{
+	"daysSinceLastOrder",
+	"logOrderCount",
+	"logAverageOrderValue",
+	"daysSinceLastEmail",
+}
+
+// Cap on days since last email, matching the default used when no email was sent
+const churnMaxEmailDays = 365
+
+// ChurnModel is a logistic regression over standardized features, as written
+// by the churn-train command
+type ChurnModel struct {
+	Version   string `json:"version"`
+	TrainedAt string `json:"trainedAt"`
+	// A user is churned if they did not order again within WindowDays of the snapshot
+	WindowDays int `json:"windowDays"`
+
+	Features     []string  `json:"features"`
+	Means        []float64 `json:"means"`
+	StdDevs      []float64 `json:"stdDevs"`
+	Intercept    float64   `json:"intercept"`
+	Coefficients []float64 `json:"coefficients"`
+
+	Metrics ChurnModelMetrics `json:"metrics"`
+}
+
+// ChurnModelMetrics describes how well a model did on the data it was trained and evaluated on
+type ChurnModelMetrics struct {
+	TrainSize   int     `json:"trainSize"`
+	HoldoutSize int     `json:"holdoutSize"`
+	ChurnRate   float64 `json:"churnRate"`
+	TrainAUC    float64 `json:"trainAuc"`
+	HoldoutAUC  float64 `json:"holdoutAuc"`
+	LogLoss     float64 `json:"logLoss"`
+	BrierScore  float64 `json:"brierScore"`
+	// Predicted vs observed churn rate per decile of predicted probability (holdout set)
+	Calibration []CalibrationBin `json:"calibration"`
+}
+
+// CalibrationBin is one decile of the calibration table
+type CalibrationBin struct {
+	MinPredicted  float64 `json:"minPredicted"`
+	MaxPredicted  float64 `json:"maxPredicted"`
+	MeanPredicted float64 `json:"meanPredicted"`
+	ObservedRate  float64 `json:"observedRate"`
+	Count         int     `json:"count"`
+}
+
+// Load a churn model written by churn-train and check it matches this build's features
+func loadChurnModel(path string) (*ChurnModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading churn model %s: %w", path, err)
+	}
+
+	var model ChurnModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("error parsing churn model %s: %w", path, err)
+	}
+
+	if model.Version == "" {
+		return nil, fmt.Errorf("churn model %s has no version", path)
+	}
+	if len(model.Features) != len(churnFeatureNames) {
+		return nil, fmt.Errorf("churn model %s has features %v, expected %v", path, model.Features, churnFeatureNames)
+	}
+	for i, name := range churnFeatureNames {
+		if model.Features[i] != name {
+			return nil, fmt.Errorf("churn model %s has features %v, expected %v", path, model.Features, churnFeatureNames)
+		}
+	}
+	if len(model.Means) != len(churnFeatureNames) || len(model.StdDevs) != len(churnFeatureNames) ||
+		len(model.Coefficients) != len(churnFeatureNames) {
+		return nil, fmt.Errorf("churn model %s has the wrong number of coefficients", path)
+	}
+
+	return &model, nil
+}
+
+// Compute the raw model features of a user as of a point in time
+func churnFeatures(user User, asOf time.Time) []float64 {
+	orderDays := 0.0
+	if lastOrderDate, err := time.Parse(time.RFC3339, user.LastOrderDate); err == nil {
+		orderDays = math.Max(asOf.Sub(lastOrderDate).Hours()/24, 0)
+	}
+
+	emailDays := float64(churnMaxEmailDays)
+	if user.LastEmailDate != nil {
+		if lastEmailDate, err := time.Parse(time.RFC3339, *user.LastEmailDate); err == nil {
+			emailDays = math.Min(math.Max(asOf.Sub(lastEmailDate).Hours()/24, 0), churnMaxEmailDays)
+		}
+	}
+
+	return []float64{
+		orderDays,
+		math.Log1p(math.Max(float64(user.OrderCount), 0)),
+		math.Log1p(math.Max(user.AverageOrderValue, 0)),
+		emailDays,
+	}
+}
+
+// Standardize a feature vector with the model's means and standard deviations
+func (m *ChurnModel) standardize(features []float64) []float64 {
+	standardized := make([]float64, len(features))
+	for i, value := range features {
+		if m.StdDevs[i] > 0 {
+			standardized[i] = (value - m.Means[i]) / m.StdDevs[i]
+		}
+	}
+	return standardized
+}
+
+// Churn probability for a raw feature vector
+func (m *ChurnModel) predict(features []float64) float64 {
+	logit := m.Intercept
+	for i, value := range m.standardize(features) {
+		logit += m.Coefficients[i] * value
+	}
+	return sigmoid(logit)
+}
+
+// Logistic function
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// churnScorer turns the churn probability of a trained model into an
+// engagement score of 100 * (1 - probability)
+type churnScorer struct {
+	model *ChurnModel
+}
+
+// Build the churn scorer from the model at CHURN_MODEL_PATH, or churn.modelPath in the scoring config
+func newChurnScorer(config ScoringConfig) (Scorer, error) {
+	path := config.Churn.ModelPath
+	if envPath := os.Getenv("CHURN_MODEL_PATH"); envPath != "" {
+		path = envPath
+	}
+	if path == "" {
+		return nil, fmt.Errorf("churn scorer requires CHURN_MODEL_PATH or churn.modelPath")
+	}
+
+	model, err := loadChurnModel(path)
+	if err != nil {
+		return nil, err
+	}
+	debugLog(DEBUG_INFO, "Loaded churn model %s trained at %s (holdout AUC %.3f, %d day window)",
+		model.Version, model.TrainedAt, model.Metrics.HoldoutAUC, model.WindowDays)
+
+	return &churnScorer{model: model}, nil
+}
+
+func (s *churnScorer) Name() string {
+	return "churn"
+}
+
+// The model version, since the scoring config has no churn weights of its own
+func (s *churnScorer) Version() string {
+	return s.model.Version
+}
+
+// Score a user with the churn model. The base score is that of an average
+// user; each factor is the change in score from adding that feature's term
+// to the logit, so the factors add up to the final score.
+func (s *churnScorer) Score(user User) ScoreBreakdown {
+	features := churnFeatures(user, time.Now())
+	standardized := s.model.standardize(features)
+
+	logit := s.model.Intercept
+	score := 100 * (1 - sigmoid(logit))
+	breakdown := newScoreBreakdown(s, score)
+
+	for i, name := range churnFeatureNames {
+		term := s.model.Coefficients[i] * standardized[i]
+		logit += term
+		next := 100 * (1 - sigmoid(logit))
+		breakdown.addFactor(ScoreFactor{
+			Name:         name,
+			RawInput:     features[i],
+			Contribution: next - score,
+			Detail:       fmt.Sprintf("logit %+.3f", term),
+		})
+		score = next
+	}
+
+	breakdown.ChurnProbability = sigmoid(logit)
+	breakdown.clamp(0, 100)
+	logScoreBreakdown(user, breakdown)
+	return breakdown
+}
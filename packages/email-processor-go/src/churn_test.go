@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestChurnScorer(t *testing.T) {
+	scorer := &churnScorer{model: &ChurnModel{
+		Version:      "churn-test",
+		Features:     churnFeatureNames,
+		Means:        []float64{60, 1, 4, 180},
+		StdDevs:      []float64{30, 1, 1, 90},
+		Coefficients: []float64{2, -0.5, -0.25, 0},
+	}}
+
+	recent := scorer.Score(User{LastOrderDate: daysAgo(0.5), OrderCount: 5, AverageOrderValue: 100})
+	lapsed := scorer.Score(User{LastOrderDate: daysAgo(180.5), OrderCount: 5, AverageOrderValue: 100})
+
+	if recent.Score <= lapsed.Score {
+		t.Errorf("recent score %.2f should be above lapsed score %.2f", recent.Score, lapsed.Score)
+	}
+	for _, breakdown := range []ScoreBreakdown{recent, lapsed} {
+		assertScore(t, breakdown.Score, 100*(1-breakdown.ChurnProbability))
+
+		sum := breakdown.BaseScore
+		for _, factor := range breakdown.Factors {
+			sum += factor.Contribution
+		}
+		assertScore(t, sum, breakdown.Score)
+
+		if breakdown.Scorer != "churn" || breakdown.ScorerVersion != "churn-test" {
+			t.Errorf("breakdown scorer = %q/%q", breakdown.Scorer, breakdown.ScorerVersion)
+		}
+	}
+	// An average user has even odds
+	assertScore(t, recent.BaseScore, 50)
+}
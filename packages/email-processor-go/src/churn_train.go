@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subcommand that trains the churn model offline
+const churnTrainCommand = "churn-train"
+
+// Number of calibration bins in the model metrics
+const churnCalibrationBins = 10
+
+// churnSnapshot is one training example: a user as they were at SnapshotAt,
+// and whether they ordered again afterwards
+type churnSnapshot struct {
+	SnapshotAt        string  `json:"snapshotAt"`
+	LastOrderDate     string  `json:"lastOrderDate"`
+	OrderCount        int     `json:"orderCount"`
+	AverageOrderValue float64 `json:"averageOrderValue"`
+	LastEmailDate     string  `json:"lastEmailDate"`
+	// First order after the snapshot, empty if the user never ordered again
+	NextOrderDate string `json:"nextOrderDate"`
+}
+
+// churnExample is a snapshot turned into model inputs
+type churnExample struct {
+	Features []float64
+	Churned  bool
+}
+
+// Train a churn model from a JSONL or CSV export of user snapshots and write
+// the coefficients and evaluation metrics to a JSON file
+func runChurnTrain(args []string) error {
+	flags := flag.NewFlagSet(churnTrainCommand, flag.ContinueOnError)
+	input := flags.String("input", "", "JSONL or CSV file of user snapshots (required)")
+	output := flags.String("output", "churn-model.json", "file to write the trained model to")
+	version := flags.String("version", "", "model version (default: churn-<date>)")
+	windowDays := flags.Int("window-days", 90, "a user churned if they did not order again within this many days")
+	asOfFlag := flags.String("as-of", "", "date the snapshots were exported, RFC3339 or YYYY-MM-DD (default: now)")
+	epochs := flags.Int("epochs", 2000, "gradient descent iterations")
+	learningRate := flags.Float64("learning-rate", 0.1, "gradient descent step size")
+	l2 := flags.Float64("l2", 0.001, "L2 regularization strength")
+	holdoutEvery := flags.Int("holdout-every", 5, "hold out every Nth snapshot for evaluation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *input == "" {
+		return fmt.Errorf("-input is required")
+	}
+	if *windowDays <= 0 || *epochs <= 0 || *holdoutEvery < 2 {
+		return fmt.Errorf("-window-days and -epochs must be positive and -holdout-every at least 2")
+	}
+	if *version == "" {
+		*version = "churn-" + time.Now().UTC().Format("20060102")
+	}
+	asOf := time.Now().UTC()
+	if *asOfFlag != "" {
+		var err error
+		if asOf, err = parseChurnAsOf(*asOfFlag); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := readChurnSnapshots(*input)
+	if err != nil {
+		return err
+	}
+
+	var train, holdout []churnExample
+	skipped, censored := 0, 0
+	for i, snapshot := range snapshots {
+		example, err := churnExampleFromSnapshot(snapshot, *windowDays, asOf)
+		if errors.Is(err, errSnapshotCensored) {
+			censored++
+			continue
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		if i%*holdoutEvery == 0 {
+			holdout = append(holdout, example)
+		} else {
+			train = append(train, example)
+		}
+	}
+	debugLog(DEBUG_INFO, "Read %d snapshots as of %s: %d training, %d holdout, %d not yet matured, %d skipped",
+		len(snapshots), asOf.Format(time.RFC3339), len(train), len(holdout), censored, skipped)
+	if len(train) == 0 || len(holdout) == 0 {
+		return fmt.Errorf("not enough valid snapshots to train and evaluate a model")
+	}
+
+	model := fitChurnModel(train, *epochs, *learningRate, *l2)
+	model.Version = *version
+	model.TrainedAt = time.Now().UTC().Format(time.RFC3339)
+	model.WindowDays = *windowDays
+	model.Metrics = evaluateChurnModel(model, train, holdout)
+
+	data, err := json.MarshalIndent(model, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding churn model: %w", err)
+	}
+	if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing churn model %s: %w", *output, err)
+	}
+
+	debugLog(DEBUG_INFO, "Wrote churn model %s to %s: holdout AUC %.3f, log loss %.4f, Brier score %.4f",
+		model.Version, *output, model.Metrics.HoldoutAUC, model.Metrics.LogLoss, model.Metrics.BrierScore)
+	return nil
+}
+
+// Read snapshots from a CSV file (by extension) or JSON Lines
+func readChurnSnapshots(path string) ([]churnSnapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening snapshots %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return readChurnSnapshotsCSV(file)
+	}
+	return readChurnSnapshotsJSONL(file)
+}
+
+// Read one JSON snapshot per line, ignoring blank lines
+func readChurnSnapshotsJSONL(r io.Reader) ([]churnSnapshot, error) {
+	var snapshots []churnSnapshot
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var snapshot churnSnapshot
+		if err := json.Unmarshal([]byte(text), &snapshot); err != nil {
+			return nil, fmt.Errorf("error parsing snapshot on line %d: %w", line, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading snapshots: %w", err)
+	}
+
+	return snapshots, nil
+}
+
+// Read snapshots from a CSV file whose header uses the JSON field names
+func readChurnSnapshotsCSV(r io.Reader) ([]churnSnapshot, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"snapshotAt", "lastOrderDate", "orderCount", "averageOrderValue"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV is missing the %s column", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var snapshots []churnSnapshot
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV row %d: %w", row, err)
+		}
+
+		snapshot := churnSnapshot{
+			SnapshotAt:    field(record, "snapshotAt"),
+			LastOrderDate: field(record, "lastOrderDate"),
+			LastEmailDate: field(record, "lastEmailDate"),
+			NextOrderDate: field(record, "nextOrderDate"),
+		}
+		if snapshot.OrderCount, err = strconv.Atoi(field(record, "orderCount")); err != nil {
+			return nil, fmt.Errorf("invalid orderCount on CSV row %d: %w", row, err)
+		}
+		if snapshot.AverageOrderValue, err = strconv.ParseFloat(field(record, "averageOrderValue"), 64); err != nil {
+			return nil, fmt.Errorf("invalid averageOrderValue on CSV row %d: %w", row, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// Parse -as-of as a timestamp or a date
+func parseChurnAsOf(value string) (time.Time, error) {
+	if asOf, err := time.Parse(time.RFC3339, value); err == nil {
+		return asOf, nil
+	}
+	asOf, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -as-of %q, expected RFC3339 or YYYY-MM-DD", value)
+	}
+	return asOf, nil
+}
+
+// Snapshots whose churn window hasn't ended by the as-of date. Without a
+// next order we can't tell a churned user from one who hasn't reordered yet.
+var errSnapshotCensored = errors.New("snapshot has not matured")
+
+// Turn a snapshot into features and a churn label. Snapshots without a valid
+// snapshot date are skipped, and so are snapshots that haven't matured by
+// asOf. Orders after asOf are ignored.
+func churnExampleFromSnapshot(snapshot churnSnapshot, windowDays int, asOf time.Time) (churnExample, error) {
+	snapshotAt, err := time.Parse(time.RFC3339, snapshot.SnapshotAt)
+	if err != nil {
+		return churnExample{}, fmt.Errorf("invalid snapshotAt %q: %w", snapshot.SnapshotAt, err)
+	}
+	window := time.Duration(windowDays) * 24 * time.Hour
+
+	user := User{
+		LastOrderDate:     snapshot.LastOrderDate,
+		OrderCount:        snapshot.OrderCount,
+		AverageOrderValue: snapshot.AverageOrderValue,
+	}
+	if snapshot.LastEmailDate != "" {
+		user.LastEmailDate = &snapshot.LastEmailDate
+	}
+
+	churned := true
+	if nextOrderDate, err := time.Parse(time.RFC3339, snapshot.NextOrderDate); err == nil && !nextOrderDate.After(asOf) {
+		churned = nextOrderDate.Sub(snapshotAt) > window
+	}
+	if churned && snapshotAt.Add(window).After(asOf) {
+		return churnExample{}, errSnapshotCensored
+	}
+
+	return churnExample{
+		Features: churnFeatures(user, snapshotAt),
+		Churned:  churned,
+	}, nil
+}
+
+// Fit a logistic regression with batch gradient descent on standardized features
+func fitChurnModel(examples []churnExample, epochs int, learningRate, l2 float64) *ChurnModel {
+	featureCount := len(churnFeatureNames)
+	model := &ChurnModel{
+		Features:     churnFeatureNames,
+		Means:        make([]float64, featureCount),
+		StdDevs:      make([]float64, featureCount),
+		Coefficients: make([]float64, featureCount),
+	}
+
+	// Standardization parameters
+	for _, example := range examples {
+		for i, value := range example.Features {
+			model.Means[i] += value
+		}
+	}
+	for i := range model.Means {
+		model.Means[i] /= float64(len(examples))
+	}
+	for _, example := range examples {
+		for i, value := range example.Features {
+			model.StdDevs[i] += (value - model.Means[i]) * (value - model.Means[i])
+		}
+	}
+	for i := range model.StdDevs {
+		model.StdDevs[i] = math.Sqrt(model.StdDevs[i] / float64(len(examples)))
+	}
+
+	standardized := make([][]float64, len(examples))
+	for i, example := range examples {
+		standardized[i] = model.standardize(example.Features)
+	}
+
+	n := float64(len(examples))
+	gradient := make([]float64, featureCount)
+	for epoch := 0; epoch < epochs; epoch++ {
+		interceptGradient := 0.0
+		for i := range gradient {
+			gradient[i] = 0
+		}
+
+		for i, example := range examples {
+			logit := model.Intercept
+			for j, value := range standardized[i] {
+				logit += model.Coefficients[j] * value
+			}
+			diff := sigmoid(logit) - churnLabel(example.Churned)
+			interceptGradient += diff
+			for j, value := range standardized[i] {
+				gradient[j] += diff * value
+			}
+		}
+
+		model.Intercept -= learningRate * interceptGradient / n
+		for j := range model.Coefficients {
+			model.Coefficients[j] -= learningRate * (gradient[j]/n + l2*model.Coefficients[j])
+		}
+	}
+
+	return model
+}
+
+// Evaluate a model on its training and holdout sets
+func evaluateChurnModel(model *ChurnModel, train, holdout []churnExample) ChurnModelMetrics {
+	metrics := ChurnModelMetrics{
+		TrainSize:   len(train),
+		HoldoutSize: len(holdout),
+	}
+
+	trainPredictions := make([]float64, len(train))
+	for i, example := range train {
+		trainPredictions[i] = model.predict(example.Features)
+	}
+	metrics.TrainAUC = churnAUC(trainPredictions, train)
+
+	predictions := make([]float64, len(holdout))
+	churned := 0
+	for i, example := range holdout {
+		predictions[i] = model.predict(example.Features)
+		label := churnLabel(example.Churned)
+		if example.Churned {
+			churned++
+		}
+
+		// Clip so a confident wrong prediction doesn't make the log loss infinite
+		p := math.Min(math.Max(predictions[i], 1e-15), 1-1e-15)
+		metrics.LogLoss -= label*math.Log(p) + (1-label)*math.Log(1-p)
+		metrics.BrierScore += (predictions[i] - label) * (predictions[i] - label)
+	}
+	metrics.ChurnRate = float64(churned) / float64(len(holdout))
+	metrics.LogLoss /= float64(len(holdout))
+	metrics.BrierScore /= float64(len(holdout))
+	metrics.HoldoutAUC = churnAUC(predictions, holdout)
+	metrics.Calibration = churnCalibration(predictions, holdout)
+
+	return metrics
+}
+
+// Area under the ROC curve, via the rank-sum statistic with ties averaged
+func churnAUC(predictions []float64, examples []churnExample) float64 {
+	order := make([]int, len(predictions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return predictions[order[a]] < predictions[order[b]] })
+
+	positives, negatives := 0.0, 0.0
+	rankSum := 0.0
+	for start := 0; start < len(order); {
+		end := start
+		for end < len(order) && predictions[order[end]] == predictions[order[start]] {
+			end++
+		}
+		// Ranks start..end-1 (1-based start+1..end) share their average
+		rank := float64(start+end+1) / 2
+		for _, i := range order[start:end] {
+			if examples[i].Churned {
+				positives++
+				rankSum += rank
+			} else {
+				negatives++
+			}
+		}
+		start = end
+	}
+
+	if positives == 0 || negatives == 0 {
+		return 0.5
+	}
+	return (rankSum - positives*(positives+1)/2) / (positives * negatives)
+}
+
+// Mean predicted vs observed churn rate per equal-sized bin of predicted probability
+func churnCalibration(predictions []float64, examples []churnExample) []CalibrationBin {
+	order := make([]int, len(predictions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return predictions[order[a]] < predictions[order[b]] })
+
+	var bins []CalibrationBin
+	for b := 0; b < churnCalibrationBins; b++ {
+		start := b * len(order) / churnCalibrationBins
+		end := (b + 1) * len(order) / churnCalibrationBins
+		if start == end {
+			continue
+		}
+
+		bin := CalibrationBin{
+			MinPredicted: predictions[order[start]],
+			MaxPredicted: predictions[order[end-1]],
+			Count:        end - start,
+		}
+		for _, i := range order[start:end] {
+			bin.MeanPredicted += predictions[i]
+			bin.ObservedRate += churnLabel(examples[i].Churned)
+		}
+		bin.MeanPredicted /= float64(bin.Count)
+		bin.ObservedRate /= float64(bin.Count)
+		bins = append(bins, bin)
+	}
+
+	return bins
+}
+
+// Numeric label of an example
+func churnLabel(churned bool) float64 {
+	if churned {
+		return 1
+	}
+	return 0
+}
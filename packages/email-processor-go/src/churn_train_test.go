@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChurnExampleFromSnapshot(t *testing.T) {
+	asOf := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		snapshot    churnSnapshot
+		wantErr     error
+		wantChurned bool
+	}{
+		{
+			name:     "reordered within the window",
+			snapshot: churnSnapshot{SnapshotAt: "2025-10-01T00:00:00Z", NextOrderDate: "2025-11-01T00:00:00Z"},
+		},
+		{
+			name:        "reordered after the window",
+			snapshot:    churnSnapshot{SnapshotAt: "2025-10-01T00:00:00Z", NextOrderDate: "2026-02-01T00:00:00Z"},
+			wantChurned: true,
+		},
+		{
+			name:        "never reordered",
+			snapshot:    churnSnapshot{SnapshotAt: "2025-10-01T00:00:00Z"},
+			wantChurned: true,
+		},
+		{
+			name:     "recent snapshot that already reordered",
+			snapshot: churnSnapshot{SnapshotAt: "2026-03-01T00:00:00Z", NextOrderDate: "2026-03-15T00:00:00Z"},
+		},
+		{
+			name:     "recent snapshot without a next order has not matured",
+			snapshot: churnSnapshot{SnapshotAt: "2026-03-01T00:00:00Z"},
+			wantErr:  errSnapshotCensored,
+		},
+		{
+			name:     "orders after the as-of date are ignored",
+			snapshot: churnSnapshot{SnapshotAt: "2026-03-01T00:00:00Z", NextOrderDate: "2026-04-15T00:00:00Z"},
+			wantErr:  errSnapshotCensored,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			example, err := churnExampleFromSnapshot(tt.snapshot, 90, asOf)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && example.Churned != tt.wantChurned {
+				t.Errorf("churned = %v, want %v", example.Churned, tt.wantChurned)
+			}
+		})
+	}
+
+	if _, err := churnExampleFromSnapshot(churnSnapshot{SnapshotAt: "yesterday"}, 90, asOf); err == nil {
+		t.Error("expected an error for an invalid snapshotAt")
+	}
+}
+
+func TestChurnAUC(t *testing.T) {
+	examples := func(churned ...bool) []churnExample {
+		result := make([]churnExample, len(churned))
+		for i, c := range churned {
+			result[i] = churnExample{Churned: c}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name        string
+		predictions []float64
+		examples    []churnExample
+		want        float64
+	}{
+		{
+			name:        "perfect ranking",
+			predictions: []float64{0.1, 0.2, 0.8, 0.9},
+			examples:    examples(false, false, true, true),
+			want:        1,
+		},
+		{
+			name:        "inverted ranking",
+			predictions: []float64{0.1, 0.2, 0.8, 0.9},
+			examples:    examples(true, true, false, false),
+			want:        0,
+		},
+		{
+			name:        "ties count as half",
+			predictions: []float64{0.5, 0.5},
+			examples:    examples(false, true),
+			want:        0.5,
+		},
+		{
+			name:        "one pair out of order",
+			predictions: []float64{0.1, 0.3, 0.2, 0.9},
+			examples:    examples(false, false, true, true),
+			want:        0.75,
+		},
+		{
+			name:        "single class",
+			predictions: []float64{0.1, 0.9},
+			examples:    examples(true, true),
+			want:        0.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertScore(t, churnAUC(tt.predictions, tt.examples), tt.want)
+		})
+	}
+}
+
+func TestFitChurnModel(t *testing.T) {
+	// Users who haven't ordered for longer are the ones who churn
+	var examples []churnExample
+	for days := 0; days < 200; days += 5 {
+		examples = append(examples, churnExample{
+			Features: []float64{float64(days), 1, 4, churnMaxEmailDays},
+			Churned:  days >= 100,
+		})
+	}
+
+	model := fitChurnModel(examples, 2000, 0.1, 0.001)
+
+	if model.Coefficients[0] <= 0 {
+		t.Errorf("daysSinceLastOrder coefficient = %.4f, want positive", model.Coefficients[0])
+	}
+	// Constant features have no spread and get no weight
+	for i := 1; i < len(churnFeatureNames); i++ {
+		if model.StdDevs[i] != 0 || model.Coefficients[i] != 0 {
+			t.Errorf("%s stdDev/coefficient = %.4f/%.4f, want 0", churnFeatureNames[i], model.StdDevs[i], model.Coefficients[i])
+		}
+	}
+
+	predictions := make([]float64, len(examples))
+	for i, example := range examples {
+		predictions[i] = model.predict(example.Features)
+	}
+	if auc := churnAUC(predictions, examples); auc != 1 {
+		t.Errorf("training AUC = %.4f, want 1", auc)
+	}
+	if low, high := predictions[0], predictions[len(predictions)-1]; low > 0.2 || high < 0.8 {
+		t.Errorf("predictions range %.4f-%.4f, want below 0.2 and above 0.8", low, high)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// errEmailNotFound is returned when an email referenced by an event does not exist
+var errEmailNotFound = errors.New("email not found")
+
+// Email statuses in lifecycle order
+var emailStatuses = []string{EmailStatusGenerated, EmailStatusSent, EmailStatusOpened, EmailStatusClicked, EmailStatusFailed}
+
+// Statuses an email can move to from each status. An email moves forward
+// through GENERATED -> SENT -> OPENED -> CLICKED and may skip steps, since
+// tracking events can arrive out of order. FAILED is terminal and only
+// reachable before the email was opened.
+var emailStatusTransitions = map[string][]string{
+	EmailStatusGenerated: {EmailStatusSent, EmailStatusOpened, EmailStatusClicked, EmailStatusFailed},
+	EmailStatusSent:      {EmailStatusOpened, EmailStatusClicked, EmailStatusFailed},
+	EmailStatusOpened:    {EmailStatusClicked},
+	EmailStatusClicked:   {},
+	EmailStatusFailed:    {},
+}
+
+// Attribute holding the time an email reached each status
+var emailStatusTimestampAttributes = map[string]string{
+	EmailStatusSent:    "sentAt",
+	EmailStatusOpened:  "openedAt",
+	EmailStatusClicked: "clickedAt",
+	EmailStatusFailed:  "failedAt",
+}
+
+// emailStatusUpdate is a requested change of an email's status
+type emailStatusUpdate struct {
+	EmailID string
+	// Checked against the email's userId when set
+	UserID string
+	Status string
+	// When the transition happened, defaults to now
+	At string
+	// Why sending failed, for FAILED
+	FailureReason string
+}
+
+// emailEventPayload is the payload of the EMAIL_* tracking events
+type emailEventPayload struct {
+	EmailID string `json:"emailId"`
+	UserID  string `json:"userId"`
+	LinkURL string `json:"linkUrl"`
+	Error   string `json:"error"`
+}
+
+// Email status each tracking event moves an email to
+var emailEventStatuses = map[string]string{
+	EventTypeEmailSent:    EmailStatusSent,
+	EventTypeEmailOpened:  EmailStatusOpened,
+	EventTypeEmailClicked: EmailStatusClicked,
+	EventTypeEmailFailed:  EmailStatusFailed,
+}
+
+// Apply an email tracking event to the email's status
+func processEmailEvent(ctx context.Context, event Event, payload emailEventPayload) error {
+	update := emailStatusUpdate{
+		EmailID:       payload.EmailID,
+		UserID:        payload.UserID,
+		Status:        emailEventStatuses[event.Type],
+		At:            event.Timestamp,
+		FailureReason: payload.Error,
+	}
+	if event.Type == EventTypeEmailClicked {
+		debugLog(DEBUG_INFO, "Email %s clicked: %s", payload.EmailID, payload.LinkURL)
+	}
+
+	if _, err := updateEmailStatus(ctx, update); err != nil {
+		if errors.Is(err, errEmailNotFound) {
+			return permanentError(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Check whether an email may move from one status to another
+func emailStatusTransitionAllowed(from, to string) bool {
+	for _, next := range emailStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Move an email to a new status with a conditional update, so the status only
+// ever moves along emailStatusTransitions. Returns false without an error if
+// the email is already at or past the status (a duplicate or late event).
+func updateEmailStatus(ctx context.Context, update emailStatusUpdate) (bool, error) {
+	timestampAttribute, ok := emailStatusTimestampAttributes[update.Status]
+	if !ok {
+		return false, permanentError(fmt.Errorf("email status %q can't be set", update.Status))
+	}
+	if update.At == "" {
+		update.At = time.Now().Format(time.RFC3339)
+	}
+
+	values := map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{
+			Value: update.Status,
+		},
+		":at": &types.AttributeValueMemberS{
+			Value: update.At,
+		},
+	}
+	// Only from the statuses the new status may be reached from
+	condition := "attribute_exists(emailId) AND #status IN ("
+	i := 0
+	for _, from := range emailStatuses {
+		if !emailStatusTransitionAllowed(from, update.Status) {
+			continue
+		}
+		name := fmt.Sprintf(":from%d", i)
+		if i > 0 {
+			condition += ", "
+		}
+		condition += name
+		values[name] = &types.AttributeValueMemberS{
+			Value: from,
+		}
+		i++
+	}
+	condition += ")"
+
+	if update.UserID != "" {
+		condition += " AND userId = :userId"
+		values[":userId"] = &types.AttributeValueMemberS{
+			Value: update.UserID,
+		}
+	}
+
+	updateExpression := "SET #status = :status, " + timestampAttribute + " = :at"
+	if update.Status == EmailStatusFailed {
+		updateExpression += ", failureReason = :failureReason"
+		values[":failureReason"] = &types.AttributeValueMemberS{
+			Value: update.FailureReason,
+		}
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(EmailsTableName),
+		Key: map[string]types.AttributeValue{
+			"emailId": &types.AttributeValueMemberS{
+				Value: update.EmailID,
+			},
+		},
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err == nil {
+		debugLog(DEBUG_INFO, "Email %s moved to %s", update.EmailID, update.Status)
+		return true, nil
+	}
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return false, fmt.Errorf("error updating email status: %w", err)
+	}
+
+	if len(conditionErr.Item) == 0 {
+		return false, fmt.Errorf("%w: %s", errEmailNotFound, update.EmailID)
+	}
+	if userID := stringAttribute(conditionErr.Item, "userId"); update.UserID != "" && userID != update.UserID {
+		return false, permanentError(fmt.Errorf("email %s belongs to user %s, not %s", update.EmailID, userID, update.UserID))
+	}
+
+	current := stringAttribute(conditionErr.Item, "status")
+	debugLog(DEBUG_INFO, "Email %s is %s, ignoring transition to %s", update.EmailID, current, update.Status)
+	return false, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestEmailStatusTransitionAllowed(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{EmailStatusGenerated, EmailStatusSent, true},
+		{EmailStatusSent, EmailStatusOpened, true},
+		{EmailStatusOpened, EmailStatusClicked, true},
+		{EmailStatusGenerated, EmailStatusClicked, true},
+		{EmailStatusSent, EmailStatusClicked, true},
+		{EmailStatusGenerated, EmailStatusFailed, true},
+		{EmailStatusSent, EmailStatusFailed, true},
+		{EmailStatusOpened, EmailStatusFailed, false},
+		{EmailStatusClicked, EmailStatusFailed, false},
+		{EmailStatusOpened, EmailStatusSent, false},
+		{EmailStatusClicked, EmailStatusOpened, false},
+		{EmailStatusFailed, EmailStatusSent, false},
+		{EmailStatusFailed, EmailStatusGenerated, false},
+		{EmailStatusSent, EmailStatusSent, false},
+		{EmailStatusSent, EmailStatusGenerated, false},
+		{"UNKNOWN", EmailStatusSent, false},
+		{EmailStatusGenerated, "UNKNOWN", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			if got := emailStatusTransitionAllowed(tt.from, tt.to); got != tt.want {
+				t.Errorf("emailStatusTransitionAllowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailStatusTransitionsCoverEveryStatus(t *testing.T) {
+	for _, status := range emailStatuses {
+		if _, ok := emailStatusTransitions[status]; !ok {
+			t.Errorf("no transitions defined for %s", status)
+		}
+		if status == EmailStatusGenerated {
+			continue
+		}
+		if _, ok := emailStatusTimestampAttributes[status]; !ok {
+			t.Errorf("no timestamp attribute for %s", status)
+		}
+	}
+
+	// Every tracking event moves an email to a status it can be set to
+	for eventType, status := range emailEventStatuses {
+		if _, ok := emailStatusTimestampAttributes[status]; !ok {
+			t.Errorf("%s moves emails to %s, which can't be set", eventType, status)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Erasure settings
+const (
+	// Index on userId of the emails, processed events and quarantine tables
+	UserIDIndexName = "userIdIndex"
+
+	// BatchWriteItem accepts at most 25 requests
+	batchWriteLimit = 25
+
+	// Attempts at writing unprocessed batch items before giving up
+	batchWriteAttempts = 5
+
+	// State table key prefix of the per-user erasure tombstones
+	erasureTombstoneStatePrefix = "user#erased#"
+)
+
+// Erasure receipts table name (set from ERASURE_RECEIPTS_TABLE_NAME, receipts are not written when empty)
+var ErasureReceiptsTableName = ""
+
+// erasureReceipt records what was removed for a deleted user. It holds no
+// personal data beyond the user ID.
+type erasureReceipt struct {
+	UserID string
+	// Timestamp of the USER_DELETED event
+	RequestedAt string
+	CompletedAt string
+
+	UserRowDeleted           bool
+	SweepCandidateCancelled  bool
+	EmailsDeleted            int
+	ScoreHistoryDeleted      int
+	LedgerEntriesDeleted     int
+	QuarantinedEventsDeleted int
+}
+
+// Remove everything the processor keeps about a deleted user: their emails,
+// score history, idempotency ledger entries, quarantined events and pending
+// sweep email, then write an erasure receipt. A tombstone is written first so
+// late deliveries of the user's older events can't write any of it back. Each
+// step is idempotent, so a failed erasure is safe to redeliver.
+func eraseUser(ctx context.Context, userID string, event Event) error {
+	debugLog(DEBUG_INFO, "Erasing data for deleted user: %s", userID)
+	receipt := erasureReceipt{
+		UserID:      userID,
+		RequestedAt: event.Timestamp,
+	}
+
+	// A user row can still exist if a processor write raced the deletion, or
+	// if the user was re-created since. Only the former is erased.
+	user, err := getUserFromDynamoDB(ctx, userID)
+	userExists := true
+	switch {
+	case errors.Is(err, errUserNotFound):
+		userExists = false
+	case err != nil:
+		return err
+	case user.CreatedAt != "" && event.Timestamp != "" && user.CreatedAt > event.Timestamp:
+		debugLog(DEBUG_WARNING, "User %s was re-created after the deletion at %s, not erasing", userID, event.Timestamp)
+		return nil
+	}
+
+	if ProcessorStateTableName != "" {
+		if err := saveErasureTombstone(ctx, userID, event); err != nil {
+			return err
+		}
+	}
+
+	if userExists {
+		if receipt.UserRowDeleted, err = deleteUserRow(ctx, userID, event.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	// Cancel the send the current sweep may have queued for the user, and
+	// drop their event high-water mark
+	if ProcessorStateTableName != "" {
+		if err := deleteSweepCandidate(ctx, userID); err != nil {
+			return err
+		}
+		receipt.SweepCandidateCancelled = true
+		if err := deleteUserEventMark(ctx, userID); err != nil {
+			return err
+		}
+	}
+
+	if receipt.EmailsDeleted, err = deleteUserEmails(ctx, userID); err != nil {
+		return err
+	}
+	if receipt.ScoreHistoryDeleted, err = deleteUserScoreHistory(ctx, userID); err != nil {
+		return err
+	}
+	if receipt.LedgerEntriesDeleted, err = deleteUserLedgerEntries(ctx, userID, eventDedupKey(event)); err != nil {
+		return err
+	}
+	if receipt.QuarantinedEventsDeleted, err = deleteUserQuarantinedEvents(ctx, userID); err != nil {
+		return err
+	}
+
+	receipt.CompletedAt = time.Now().Format(time.RFC3339)
+	debugLog(DEBUG_INFO, "Erased user %s: %d emails, %d score history rows, %d ledger entries, %d quarantined events, user row deleted: %v",
+		userID, receipt.EmailsDeleted, receipt.ScoreHistoryDeleted, receipt.LedgerEntriesDeleted,
+		receipt.QuarantinedEventsDeleted, receipt.UserRowDeleted)
+
+	return saveErasureReceipt(ctx, receipt)
+}
+
+// Extract the user ID of an event's payload, or "" if it has none
+func eventUserID(event Event) string {
+	var payload struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return ""
+	}
+	return payload.UserID
+}
+
+// Record that a user was erased as of the deletion event. The tombstone is
+// kept as long as the queue retains messages, since no older delivery can
+// arrive after that. A redelivered deletion never moves it back.
+func saveErasureTombstone(ctx context.Context, userID string, event Event) error {
+	erasedAt, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil {
+		erasedAt = time.Now()
+	}
+
+	_, err = dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: erasureTombstoneStatePrefix + userID,
+			},
+		},
+		UpdateExpression:    aws.String("SET userId = :userId, erasedAt = :erasedAt, expiresAt = :expiresAt"),
+		ConditionExpression: aws.String("attribute_not_exists(stateId) OR erasedAt <= :erasedAt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+			":erasedAt": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(erasedAt.UnixMilli(), 10),
+			},
+			":expiresAt": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(UserEventMarkRetention).Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return nil
+		}
+		return fmt.Errorf("error saving erasure tombstone for user %s: %w", userID, err)
+	}
+
+	return nil
+}
+
+// Check whether an event belongs to a user who was erased after the event was
+// published. Events without a timestamp can't be shown to be newer than the
+// erasure, so they count as erased too. Always false for the deletion event
+// itself and when the processor state table isn't configured.
+func erasedUserEvent(ctx context.Context, event Event) (bool, error) {
+	if ProcessorStateTableName == "" || event.Type == EventTypeUserDeleted {
+		return false, nil
+	}
+	userID := eventUserID(event)
+	if userID == "" {
+		return false, nil
+	}
+
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: erasureTombstoneStatePrefix + userID,
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading erasure tombstone for user %s: %w", userID, err)
+	}
+	if result.Item == nil {
+		return false, nil
+	}
+
+	eventAt, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil {
+		return true, nil
+	}
+	return eventAt.UnixMilli() <= int64(numberAttribute(result.Item, "erasedAt")), nil
+}
+
+// Delete a user row left behind by a write that raced the deletion, unless
+// it was created after the deletion was requested
+func deleteUserRow(ctx context.Context, userID, requestedAt string) (bool, error) {
+	_, err := dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(createdAt) OR createdAt <= :requestedAt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":requestedAt": &types.AttributeValueMemberS{
+				Value: requestedAt,
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error deleting user row: %w", err)
+	}
+
+	return true, nil
+}
+
+// Delete every email generated for a user, found through the emails table's userId index
+func deleteUserEmails(ctx context.Context, userID string) (int, error) {
+	keys, err := queryKeys(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(EmailsTableName),
+		IndexName:              aws.String(UserIDIndexName),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ProjectionExpression:   aws.String("emailId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+	}, "emailId")
+	if err != nil {
+		return 0, fmt.Errorf("error querying emails: %w", err)
+	}
+
+	return batchDeleteItems(ctx, EmailsTableName, keys)
+}
+
+// Delete a user's score history
+func deleteUserScoreHistory(ctx context.Context, userID string) (int, error) {
+	if ScoreHistoryTableName == "" {
+		return 0, nil
+	}
+
+	keys, err := queryKeys(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(ScoreHistoryTableName),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ProjectionExpression:   aws.String("userId, #ts"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+	}, "userId", "timestamp")
+	if err != nil {
+		return 0, fmt.Errorf("error querying score history: %w", err)
+	}
+
+	return batchDeleteItems(ctx, ScoreHistoryTableName, keys)
+}
+
+// Delete the idempotency ledger entries of a user's events, except the entry
+// of the deletion event itself, which still needs its outcome recorded
+func deleteUserLedgerEntries(ctx context.Context, userID, currentDedupKey string) (int, error) {
+	if ProcessedEventsTableName == "" {
+		return 0, nil
+	}
+
+	keys, err := queryKeys(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(ProcessedEventsTableName),
+		IndexName:              aws.String(UserIDIndexName),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+	}, "dedupKey")
+	if err != nil {
+		return 0, fmt.Errorf("error querying ledger entries: %w", err)
+	}
+
+	remaining := keys[:0]
+	for _, key := range keys {
+		if stringAttribute(key, "dedupKey") != currentDedupKey {
+			remaining = append(remaining, key)
+		}
+	}
+
+	return batchDeleteItems(ctx, ProcessedEventsTableName, remaining)
+}
+
+// Delete the events of a user that were quarantined, found through the quarantine table's userId index
+func deleteUserQuarantinedEvents(ctx context.Context, userID string) (int, error) {
+	if QuarantineTableName == "" {
+		return 0, nil
+	}
+
+	keys, err := queryKeys(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(QuarantineTableName),
+		IndexName:              aws.String(UserIDIndexName),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+	}, "dedupKey")
+	if err != nil {
+		return 0, fmt.Errorf("error querying quarantined events: %w", err)
+	}
+
+	return batchDeleteItems(ctx, QuarantineTableName, keys)
+}
+
+// Run a query and collect the named key attributes of every item
+func queryKeys(ctx context.Context, input *dynamodb.QueryInput, keyAttributes ...string) ([]map[string]types.AttributeValue, error) {
+	var keys []map[string]types.AttributeValue
+
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			key := make(map[string]types.AttributeValue, len(keyAttributes))
+			for _, name := range keyAttributes {
+				key[name] = item[name]
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Delete items by key in batches, retrying items DynamoDB left unprocessed.
+// Returns the number of items deleted.
+func batchDeleteItems(ctx context.Context, tableName string, keys []map[string]types.AttributeValue) (int, error) {
+	for start := 0; start < len(keys); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		requests := make([]types.WriteRequest, 0, end-start)
+		for _, key := range keys[start:end] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: key},
+			})
+		}
+
+		for attempt := 1; len(requests) > 0; attempt++ {
+			if attempt > batchWriteAttempts {
+				return start, retryableError(fmt.Errorf("%d deletes from %s left unprocessed", len(requests), tableName))
+			}
+			if attempt > 1 {
+				time.Sleep(time.Duration(attempt*attempt) * 50 * time.Millisecond)
+			}
+
+			result, err := dynamoClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{
+					tableName: requests,
+				},
+			})
+			if err != nil {
+				return start, fmt.Errorf("error deleting from %s: %w", tableName, err)
+			}
+			requests = result.UnprocessedItems[tableName]
+		}
+	}
+
+	return len(keys), nil
+}
+
+// Write the receipt of a completed erasure. A redelivered deletion event
+// keeps the receipt of the first completed erasure.
+func saveErasureReceipt(ctx context.Context, receipt erasureReceipt) error {
+	if ErasureReceiptsTableName == "" {
+		debugLog(DEBUG_WARNING, "ERASURE_RECEIPTS_TABLE_NAME not set, no receipt written for user %s", receipt.UserID)
+		return nil
+	}
+
+	requestedAt := receipt.RequestedAt
+	if requestedAt == "" {
+		requestedAt = receipt.CompletedAt
+	}
+
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ErasureReceiptsTableName),
+		Item: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: receipt.UserID,
+			},
+			"requestedAt": &types.AttributeValueMemberS{
+				Value: requestedAt,
+			},
+			"completedAt": &types.AttributeValueMemberS{
+				Value: receipt.CompletedAt,
+			},
+			"userRowDeleted": &types.AttributeValueMemberBOOL{
+				Value: receipt.UserRowDeleted,
+			},
+			"sweepCandidateCancelled": &types.AttributeValueMemberBOOL{
+				Value: receipt.SweepCandidateCancelled,
+			},
+			"emailsDeleted": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(receipt.EmailsDeleted),
+			},
+			"scoreHistoryDeleted": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(receipt.ScoreHistoryDeleted),
+			},
+			"ledgerEntriesDeleted": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(receipt.LedgerEntriesDeleted),
+			},
+			"quarantinedEventsDeleted": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(receipt.QuarantinedEventsDeleted),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(userId)"),
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			debugLog(DEBUG_INFO, "Erasure receipt for user %s at %s already exists", receipt.UserID, requestedAt)
+			return nil
+		}
+		return fmt.Errorf("error saving erasure receipt: %w", err)
+	}
+
+	return nil
+}
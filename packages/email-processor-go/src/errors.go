@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+)
+
+// errUserNotFound is returned when a user referenced by an event does not exist
+var errUserNotFound = errors.New("user not found")
+
+// DynamoDB error codes that indicate the request can succeed if retried later
+var retryableDynamoDBErrorCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"ThrottlingException":                    true,
+	"InternalServerError":                    true,
+	"ServiceUnavailable":                     true,
+}
+
+// processingError classifies an error as retryable or permanent so the SQS
+// handler knows whether the message should be redelivered
+type processingError struct {
+	err       error
+	retryable bool
+}
+
+func (e *processingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *processingError) Unwrap() error {
+	return e.err
+}
+
+// Mark an error as retryable - the message will be redelivered by SQS
+func retryableError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &processingError{err: err, retryable: true}
+}
+
+// Mark an error as permanent - redelivering the message will not help
+func permanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &processingError{err: err, retryable: false}
+}
+
+// openRouterStatusError is returned when OpenRouter responds with a non-200 status
+type openRouterStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *openRouterStatusError) Error() string {
+	return fmt.Sprintf("error from OpenRouter API (status %d): %s", e.StatusCode, e.Body)
+}
+
+// Check whether an error should cause the message to be redelivered.
+// Explicitly classified errors win; otherwise throttling, server-side and
+// network errors are retryable and everything else is permanent.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var procErr *processingError
+	if errors.As(err, &procErr) {
+		return procErr.retryable
+	}
+
+	var statusErr *openRouterStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return retryableDynamoDBErrorCodes[apiErr.ErrorCode()]
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsRetryable(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: false,
+		},
+		{
+			name: "plain error",
+			err:  errors.New("boom"),
+			want: false,
+		},
+		{
+			name: "user not found",
+			err:  fmt.Errorf("%w: user-1", errUserNotFound),
+			want: false,
+		},
+		{
+			name: "wrapped retryable",
+			err:  fmt.Errorf("processing user: %w", retryableError(errors.New("busy"))),
+			want: true,
+		},
+		{
+			name: "wrapped DynamoDB throttling",
+			err:  fmt.Errorf("error updating user: %w", throttled),
+			want: true,
+		},
+		{
+			name: "DynamoDB validation error",
+			err:  fmt.Errorf("error updating user: %w", &smithy.GenericAPIError{Code: "ValidationException"}),
+			want: false,
+		},
+		{
+			name: "permanent classification wins over throttling",
+			err:  permanentError(fmt.Errorf("giving up: %w", throttled)),
+			want: false,
+		},
+		{
+			name: "wrapped OpenRouter 5xx",
+			err:  fmt.Errorf("generating email: %w", &openRouterStatusError{StatusCode: 503}),
+			want: true,
+		},
+		{
+			name: "OpenRouter rate limit",
+			err:  &openRouterStatusError{StatusCode: 429},
+			want: true,
+		},
+		{
+			name: "OpenRouter bad request",
+			err:  fmt.Errorf("generating email: %w", &openRouterStatusError{StatusCode: 400}),
+			want: false,
+		},
+		{
+			name: "wrapped deadline exceeded",
+			err:  fmt.Errorf("calling OpenRouter: %w", context.DeadlineExceeded),
+			want: true,
+		},
+		{
+			name: "network error",
+			err:  fmt.Errorf("sending request: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}),
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Event schema settings
+const (
+	// Schema version of events whose envelope has no schemaVersion
+	DefaultEventSchemaVersion = 1
+
+	// How long quarantined events are kept for producers to inspect
+	QuarantineRetention = 30 * 24 * time.Hour
+)
+
+// Quarantine table name (set from QUARANTINE_TABLE_NAME, events that can't be decoded are dropped when empty)
+var QuarantineTableName = ""
+
+// errInvalidPayload is returned when an event payload can't be decoded or lacks required fields
+var errInvalidPayload = errors.New("invalid event payload")
+
+// eventSchema identifies the payload layout of an event
+type eventSchema struct {
+	Type    string
+	Version int
+}
+
+// eventHandler decodes and validates an event's payload, then handles it.
+// Returns true if an email was sent as a result.
+type eventHandler func(ctx context.Context, event Event) (bool, error)
+
+// userDeletedPayload is the payload of USER_DELETED
+type userDeletedPayload struct {
+	UserID string `json:"userId"`
+}
+
+// Event handlers by type and schema version. A new payload layout gets a new
+// version here, so producers can switch over while older events drain.
+var eventHandlers = map[eventSchema]eventHandler{
+	{EventTypeUserCreated, 1}:    typedEventHandler(validateUserPayload, handleUserEvent),
+	{EventTypeUserUpdated, 1}:    typedEventHandler(validateUserPayload, handleUserEvent),
+	{EventTypeUserDeleted, 1}:    typedEventHandler(validateUserDeletedPayload, handleUserDeletedEvent),
+	{EventTypeOrderCreated, 1}:   typedEventHandler(validateOrderPayload, handleOrderEvent),
+	{EventTypeOrderUpdated, 1}:   typedEventHandler(validateOrderPayload, handleOrderEvent),
+	{EventTypeOrderCancelled, 1}: typedEventHandler(validateOrderPayload, handleOrderEvent),
+	{EventTypeEmailSent, 1}:      typedEventHandler(validateEmailEventPayload, handleEmailEvent),
+	{EventTypeEmailOpened, 1}:    typedEventHandler(validateEmailEventPayload, handleEmailEvent),
+	{EventTypeEmailClicked, 1}:   typedEventHandler(validateEmailEventPayload, handleEmailEvent),
+	{EventTypeEmailFailed, 1}:    typedEventHandler(validateEmailEventPayload, handleEmailEvent),
+}
+
+// Event types on the topic this processor doesn't act on, such as the ones
+// it publishes itself. Events of any other unregistered type are quarantined.
+var ignoredEventTypes = map[string]bool{
+	EventTypeEmailGenerated: true,
+}
+
+// Build an eventHandler that decodes the payload into P and validates it
+// before calling handle
+func typedEventHandler[P any](validate func(P) error, handle func(context.Context, Event, P) (bool, error)) eventHandler {
+	return func(ctx context.Context, event Event) (bool, error) {
+		var payload P
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			debugLog(DEBUG_ERROR, "Raw payload: %s", string(event.Payload))
+			return false, fmt.Errorf("%w: %v", errInvalidPayload, err)
+		}
+		if err := validate(payload); err != nil {
+			return false, fmt.Errorf("%w: %v", errInvalidPayload, err)
+		}
+		return handle(ctx, event, payload)
+	}
+}
+
+// Schema version of an event
+func eventSchemaVersion(event Event) int {
+	if event.SchemaVersion == 0 {
+		return DefaultEventSchemaVersion
+	}
+	return event.SchemaVersion
+}
+
+// Check whether any schema version of an event type is handled
+func knownEventType(eventType string) bool {
+	for schema := range eventHandlers {
+		if schema.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Process a parsed event with the handler registered for its type and schema
+// version. Events of an unknown type or an unhandled version, or whose
+// payload can't be decoded, are quarantined. Returns true if an email was
+// sent as a result.
+func processEvent(ctx context.Context, event Event) (bool, error) {
+	version := eventSchemaVersion(event)
+	handle, ok := eventHandlers[eventSchema{Type: event.Type, Version: version}]
+	if !ok {
+		if ignoredEventTypes[event.Type] {
+			debugLog(DEBUG_INFO, "Ignoring event of type: %s", event.Type)
+			return false, nil
+		}
+		if !knownEventType(event.Type) {
+			return false, quarantineEvent(ctx, event, fmt.Sprintf("unknown event type %q", event.Type))
+		}
+		return false, quarantineEvent(ctx, event, fmt.Sprintf("unsupported schema version %d", version))
+	}
+
+	debugLog(DEBUG_INFO, "Processing %s event (schema version %d)", event.Type, version)
+	emailed, err := handle(ctx, event)
+	if errors.Is(err, errInvalidPayload) {
+		return false, quarantineEvent(ctx, event, err.Error())
+	}
+	return emailed, err
+}
+
+// Check that required payload fields are set, given as name and value pairs
+func requireFields(namesAndValues ...string) error {
+	var missing []string
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		if namesAndValues[i+1] == "" {
+			missing = append(missing, namesAndValues[i])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func validateUserPayload(user User) error {
+	return requireFields("userId", user.UserID, "email", user.Email)
+}
+
+func validateUserDeletedPayload(payload userDeletedPayload) error {
+	return requireFields("userId", payload.UserID)
+}
+
+func validateOrderPayload(order Order) error {
+	if err := requireFields("orderId", order.OrderID, "userId", order.UserID); err != nil {
+		return err
+	}
+	if order.TotalValue < 0 {
+		return fmt.Errorf("order %s has a negative totalValue", order.OrderID)
+	}
+	return nil
+}
+
+func validateEmailEventPayload(payload emailEventPayload) error {
+	return requireFields("emailId", payload.EmailID)
+}
+
+// Store an event the processor can't handle in the quarantine table, so it
+// isn't lost while its producer is fixed. Without a quarantine table the
+// event is dropped with a permanent error.
+func quarantineEvent(ctx context.Context, event Event, reason string) error {
+	if QuarantineTableName == "" {
+		return permanentError(fmt.Errorf("can't handle %s event: %s", event.Type, reason))
+	}
+
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return permanentError(fmt.Errorf("error encoding %s event for quarantine: %w", event.Type, err))
+	}
+
+	now := time.Now()
+	item := map[string]types.AttributeValue{
+		"dedupKey": &types.AttributeValueMemberS{
+			Value: eventDedupKey(event),
+		},
+		"eventType": &types.AttributeValueMemberS{
+			Value: event.Type,
+		},
+		"schemaVersion": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(eventSchemaVersion(event)),
+		},
+		"reason": &types.AttributeValueMemberS{
+			Value: reason,
+		},
+		"event": &types.AttributeValueMemberS{
+			Value: string(raw),
+		},
+		"quarantinedAt": &types.AttributeValueMemberS{
+			Value: now.Format(time.RFC3339),
+		},
+		"expiresAt": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Add(QuarantineRetention).Unix(), 10),
+		},
+	}
+	// Lets the event be erased with the user
+	if userID := eventUserID(event); userID != "" {
+		item["userId"] = &types.AttributeValueMemberS{
+			Value: userID,
+		}
+	}
+
+	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(QuarantineTableName),
+		Item:      item,
+	})
+	if err != nil {
+		return retryableError(fmt.Errorf("error quarantining %s event: %w", event.Type, err))
+	}
+
+	debugLog(DEBUG_WARNING, "Quarantined %s event: %s", event.Type, reason)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProcessEventQuarantine(t *testing.T) {
+	// Without a quarantine table, quarantined events fail with a permanent error
+	QuarantineTableName = ""
+
+	tests := []struct {
+		name    string
+		event   Event
+		wantErr string
+	}{
+		{
+			name: "unregistered schema version",
+			event: Event{
+				Type:          EventTypeOrderCreated,
+				SchemaVersion: 2,
+				Payload:       json.RawMessage(`{"orderId":"order-1","userId":"user-1"}`),
+			},
+			wantErr: "unsupported schema version 2",
+		},
+		{
+			name: "payload that isn't JSON",
+			event: Event{
+				Type:    EventTypeOrderCreated,
+				Payload: json.RawMessage(`"order-1"`),
+			},
+			wantErr: "invalid event payload",
+		},
+		{
+			name: "payload missing a required field",
+			event: Event{
+				Type:    EventTypeOrderUpdated,
+				Payload: json.RawMessage(`{"orderId":"order-1"}`),
+			},
+			wantErr: "missing required fields: userId",
+		},
+		{
+			name: "negative order value",
+			event: Event{
+				Type:    EventTypeOrderCreated,
+				Payload: json.RawMessage(`{"orderId":"order-1","userId":"user-1","totalValue":-5}`),
+			},
+			wantErr: "negative totalValue",
+		},
+		{
+			name: "unknown event type",
+			event: Event{
+				Type:    "USER_RENAMED",
+				Payload: json.RawMessage(`{"userId":"user-1"}`),
+			},
+			wantErr: `unknown event type "USER_RENAMED"`,
+		},
+		{
+			name: "ignored event type",
+			event: Event{
+				Type:    EventTypeEmailGenerated,
+				Payload: json.RawMessage(`{"emailId":"email-1"}`),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emailed, err := processEvent(context.Background(), tt.event)
+			if emailed {
+				t.Errorf("processEvent emailed, want no email")
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("processEvent error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("processEvent error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if isRetryable(err) {
+				t.Errorf("processEvent error %v is retryable, want permanent", err)
+			}
+		})
+	}
+}
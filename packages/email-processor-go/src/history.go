@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Score history and trend trigger settings
+const (
+	// Window used for the delta and velocity metrics
+	ScoreTrendWindowDays = 30
+
+	// A drop of at least ScoreDropTriggerPoints from the highest score in the
+	// last ScoreDropTriggerDays triggers an email even above the threshold
+	ScoreDropTriggerPoints = 25.0
+	ScoreDropTriggerDays   = 14
+)
+
+// Score history table name (set from SCORE_HISTORY_TABLE_NAME, history is disabled when empty)
+var ScoreHistoryTableName = ""
+
+// ScoreTrend holds metrics derived from a user's score history
+type ScoreTrend struct {
+	// Current score minus the score at the start of the trend window
+	Delta30d float64 `json:"delta30d"`
+	// Average change in points per day over the trend window
+	Velocity float64 `json:"velocity"`
+	// Highest score held during the drop window minus the current score
+	RecentDrop float64 `json:"recentDrop"`
+	// Number of history entries the metrics are based on
+	Samples int `json:"samples"`
+}
+
+// scoreHistoryEntry is one row of the score history table
+type scoreHistoryEntry struct {
+	Timestamp time.Time
+	Score     float64
+}
+
+// Check whether the trend shows a drop sharp enough to trigger an email
+func (t ScoreTrend) SharpDrop() bool {
+	return t.RecentDrop >= ScoreDropTriggerPoints
+}
+
+// Append a score change to the user's score history
+func appendScoreHistory(ctx context.Context, userID string, breakdown ScoreBreakdown) error {
+	if ScoreHistoryTableName == "" {
+		return nil
+	}
+
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ScoreHistoryTableName),
+		Item: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+			"timestamp": &types.AttributeValueMemberS{
+				Value: time.Now().UTC().Format(time.RFC3339Nano),
+			},
+			"score": &types.AttributeValueMemberN{
+				Value: strconv.FormatFloat(breakdown.Score, 'f', 2, 64),
+			},
+			"scorer": &types.AttributeValueMemberS{
+				Value: breakdown.Scorer,
+			},
+			"scorerVersion": &types.AttributeValueMemberS{
+				Value: breakdown.ScorerVersion,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error appending score history: %w", err)
+	}
+
+	return nil
+}
+
+// Load the user's score history for the trend window and derive trend
+// metrics. History is only written when the score changes, so the newest
+// entry before the window is loaded too: it is the score the window started with.
+func loadScoreTrend(ctx context.Context, userID string, currentScore float64) (ScoreTrend, error) {
+	if ScoreHistoryTableName == "" {
+		return ScoreTrend{}, nil
+	}
+
+	now := time.Now()
+	since := now.UTC().AddDate(0, 0, -ScoreTrendWindowDays)
+	baseline, err := loadScoreBefore(ctx, userID, since)
+	if err != nil {
+		return ScoreTrend{}, err
+	}
+
+	var entries []scoreHistoryEntry
+
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, &dynamodb.QueryInput{
+		TableName:              aws.String(ScoreHistoryTableName),
+		KeyConditionExpression: aws.String("userId = :userId AND #ts >= :since"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+			":since": &types.AttributeValueMemberS{
+				Value: since.Format(time.RFC3339Nano),
+			},
+		},
+		ScanIndexForward: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return ScoreTrend{}, fmt.Errorf("error querying score history: %w", err)
+		}
+		for _, item := range page.Items {
+			timestamp, err := time.Parse(time.RFC3339Nano, stringAttribute(item, "timestamp"))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, scoreHistoryEntry{
+				Timestamp: timestamp,
+				Score:     numberAttribute(item, "score"),
+			})
+		}
+	}
+
+	return computeScoreTrend(baseline, entries, currentScore, now), nil
+}
+
+// Load the newest score history entry before a time, or nil if there is none
+func loadScoreBefore(ctx context.Context, userID string, before time.Time) (*scoreHistoryEntry, error) {
+	result, err := dynamoClient.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(ScoreHistoryTableName),
+		KeyConditionExpression: aws.String("userId = :userId AND #ts < :before"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+			":before": &types.AttributeValueMemberS{
+				Value: before.Format(time.RFC3339Nano),
+			},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying score history before the trend window: %w", err)
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, stringAttribute(result.Items[0], "timestamp"))
+	if err != nil {
+		return nil, nil
+	}
+	return &scoreHistoryEntry{
+		Timestamp: timestamp,
+		Score:     numberAttribute(result.Items[0], "score"),
+	}, nil
+}
+
+// Derive trend metrics from history entries in the trend window, sorted
+// oldest first. baseline is the newest entry before the window, if any. Each
+// entry holds until the next one, so an entry from before the drop window
+// still counts towards the peak if it was the score during it.
+func computeScoreTrend(baseline *scoreHistoryEntry, entries []scoreHistoryEntry, currentScore float64, now time.Time) ScoreTrend {
+	if baseline != nil {
+		// The baseline score is the one the window started with
+		windowStart := now.AddDate(0, 0, -ScoreTrendWindowDays)
+		if baseline.Timestamp.After(windowStart) {
+			windowStart = baseline.Timestamp
+		}
+		entries = append([]scoreHistoryEntry{{Timestamp: windowStart, Score: baseline.Score}}, entries...)
+	}
+
+	trend := ScoreTrend{Samples: len(entries)}
+	if len(entries) == 0 {
+		return trend
+	}
+
+	oldest := entries[0]
+	trend.Delta30d = currentScore - oldest.Score
+	if days := now.Sub(oldest.Timestamp).Hours() / 24; days >= 1 {
+		trend.Velocity = trend.Delta30d / days
+	} else {
+		trend.Velocity = trend.Delta30d
+	}
+
+	dropSince := now.AddDate(0, 0, -ScoreDropTriggerDays)
+	peak := currentScore
+	for i, entry := range entries {
+		heldUntil := now
+		if i+1 < len(entries) {
+			heldUntil = entries[i+1].Timestamp
+		}
+		if heldUntil.After(dropSince) && entry.Score > peak {
+			peak = entry.Score
+		}
+	}
+	trend.RecentDrop = peak - currentScore
+
+	return trend
+}
+
+// Convert a score trend to a DynamoDB map attribute
+func trendToAttributeValue(trend ScoreTrend) types.AttributeValue {
+	return &types.AttributeValueMemberM{
+		Value: map[string]types.AttributeValue{
+			"delta30d": &types.AttributeValueMemberN{
+				Value: strconv.FormatFloat(trend.Delta30d, 'f', 2, 64),
+			},
+			"velocity": &types.AttributeValueMemberN{
+				Value: strconv.FormatFloat(trend.Velocity, 'f', 4, 64),
+			},
+			"recentDrop": &types.AttributeValueMemberN{
+				Value: strconv.FormatFloat(trend.RecentDrop, 'f', 2, 64),
+			},
+			"samples": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(trend.Samples),
+			},
+		},
+	}
+}
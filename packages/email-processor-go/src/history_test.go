@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeScoreTrend(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	at := func(daysAgo int) time.Time {
+		return now.AddDate(0, 0, -daysAgo)
+	}
+
+	tests := []struct {
+		name      string
+		baseline  *scoreHistoryEntry
+		entries   []scoreHistoryEntry
+		current   float64
+		want      ScoreTrend
+		wantSharp bool
+	}{
+		{
+			name:    "no history",
+			current: 70,
+			want:    ScoreTrend{},
+		},
+		{
+			name:    "steady decline over the window",
+			entries: []scoreHistoryEntry{{at(20), 90}, {at(10), 80}},
+			current: 70,
+			want:    ScoreTrend{Delta30d: -20, Velocity: -1, RecentDrop: 20, Samples: 2},
+		},
+		{
+			name:      "sharp drop from a recent peak",
+			entries:   []scoreHistoryEntry{{at(25), 60}, {at(5), 95}},
+			current:   65,
+			want:      ScoreTrend{Delta30d: 5, Velocity: 0.2, RecentDrop: 30, Samples: 2},
+			wantSharp: true,
+		},
+		{
+			name:    "peak that ended before the drop window is ignored",
+			entries: []scoreHistoryEntry{{at(25), 95}, {at(20), 70}},
+			current: 65,
+			want:    ScoreTrend{Delta30d: -30, Velocity: -1.2, RecentDrop: 5, Samples: 2},
+		},
+		{
+			name:      "score held since before the drop window",
+			entries:   []scoreHistoryEntry{{at(20), 95}},
+			current:   65,
+			want:      ScoreTrend{Delta30d: -30, Velocity: -1.5, RecentDrop: 30, Samples: 1},
+			wantSharp: true,
+		},
+		{
+			name:      "stable score from before the window followed by one drop",
+			baseline:  &scoreHistoryEntry{at(60), 80},
+			current:   40,
+			want:      ScoreTrend{Delta30d: -40, Velocity: -40.0 / 30, RecentDrop: 40, Samples: 1},
+			wantSharp: true,
+		},
+		{
+			name:     "baseline is superseded within the window",
+			baseline: &scoreHistoryEntry{at(45), 90},
+			entries:  []scoreHistoryEntry{{at(20), 60}},
+			current:  55,
+			want:     ScoreTrend{Delta30d: -35, Velocity: -35.0 / 30, RecentDrop: 5, Samples: 2},
+		},
+		{
+			name:    "rising score has no drop",
+			entries: []scoreHistoryEntry{{at(10), 50}},
+			current: 60,
+			want:    ScoreTrend{Delta30d: 10, Velocity: 1, RecentDrop: 0, Samples: 1},
+		},
+		{
+			name:    "history younger than a day counts as one day",
+			entries: []scoreHistoryEntry{{now.Add(-time.Hour), 80}},
+			current: 70,
+			want:    ScoreTrend{Delta30d: -10, Velocity: -10, RecentDrop: 10, Samples: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeScoreTrend(tt.baseline, tt.entries, tt.current, now)
+			if got.Samples != tt.want.Samples {
+				t.Errorf("samples = %d, want %d", got.Samples, tt.want.Samples)
+			}
+			assertScore(t, got.Delta30d, tt.want.Delta30d)
+			assertScore(t, got.Velocity, tt.want.Velocity)
+			assertScore(t, got.RecentDrop, tt.want.RecentDrop)
+			if got.SharpDrop() != tt.wantSharp {
+				t.Errorf("SharpDrop() = %v, want %v", got.SharpDrop(), tt.wantSharp)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Idempotency ledger settings
+const (
+	// Ledger status values - IN_PROGRESS while an invocation owns the event,
+	// then one of the recorded outcomes
+	LedgerStatusInProgress = "IN_PROGRESS"
+	LedgerOutcomeSkipped   = "SKIPPED"
+	LedgerOutcomeEmailed   = "EMAILED"
+	LedgerOutcomeFailed    = "FAILED"
+
+	// How long ledger entries are kept before DynamoDB TTL removes them
+	LedgerRetention = 7 * 24 * time.Hour
+
+	// How long an IN_PROGRESS claim blocks other deliveries before it is
+	// treated as abandoned (e.g. the Lambda that owned it timed out)
+	LedgerLeaseDuration = 5 * time.Minute
+)
+
+// Idempotency ledger table name (set from PROCESSED_EVENTS_TABLE_NAME, dedup is disabled when empty)
+var ProcessedEventsTableName = ""
+
+// Build the dedup key for an event. SNS can deliver the same event more than
+// once with different SQS message IDs, so the key is derived from the event
+// itself rather than from the delivery.
+func eventDedupKey(event Event) string {
+	hash := sha256.New()
+	hash.Write([]byte(event.Type))
+	hash.Write([]byte{0})
+	hash.Write(event.Payload)
+	hash.Write([]byte{0})
+	hash.Write([]byte(event.Timestamp))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Claim an event in the idempotency ledger. Returns the claim ID the outcome
+// is recorded with, false if the event has already been processed, or a
+// retryable error if another invocation is processing it right now.
+func claimEvent(ctx context.Context, dedupKey string, event Event, messageID string) (string, bool, error) {
+	if ProcessedEventsTableName == "" {
+		return "", true, nil
+	}
+
+	now := time.Now()
+	// Unique per claim: a redelivery of the same message has the same messageId
+	claimID := generateUUID()
+	item := map[string]types.AttributeValue{
+		"dedupKey": &types.AttributeValueMemberS{
+			Value: dedupKey,
+		},
+		"status": &types.AttributeValueMemberS{
+			Value: LedgerStatusInProgress,
+		},
+		"eventType": &types.AttributeValueMemberS{
+			Value: event.Type,
+		},
+		"eventTimestamp": &types.AttributeValueMemberS{
+			Value: event.Timestamp,
+		},
+		"messageId": &types.AttributeValueMemberS{
+			Value: messageID,
+		},
+		"claimId": &types.AttributeValueMemberS{
+			Value: claimID,
+		},
+		"claimedAt": &types.AttributeValueMemberS{
+			Value: now.Format(time.RFC3339),
+		},
+		"leaseExpiresAt": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Add(LedgerLeaseDuration).Unix(), 10),
+		},
+		"expiresAt": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Add(LedgerRetention).Unix(), 10),
+		},
+	}
+
+	// Indexed so the entries can be erased with the user
+	if userID := eventUserID(event); userID != "" {
+		item["userId"] = &types.AttributeValueMemberS{
+			Value: userID,
+		}
+	}
+
+	// A new claim succeeds if the event was never seen, if a previous attempt
+	// failed, or if the previous owner's lease has run out
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(ProcessedEventsTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(dedupKey) OR #status = :failed OR (#status = :inProgress AND leaseExpiresAt < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":failed": &types.AttributeValueMemberS{
+				Value: LedgerOutcomeFailed,
+			},
+			":inProgress": &types.AttributeValueMemberS{
+				Value: LedgerStatusInProgress,
+			},
+			":now": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(now.Unix(), 10),
+			},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err == nil {
+		return claimID, true, nil
+	}
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return "", false, fmt.Errorf("error claiming event in ledger: %w", err)
+	}
+
+	status := ""
+	if existing, ok := conditionErr.Item["status"].(*types.AttributeValueMemberS); ok {
+		status = existing.Value
+	}
+
+	if status == LedgerStatusInProgress {
+		// Let SQS redeliver this copy later; by then the owner has recorded an outcome
+		return "", false, retryableError(fmt.Errorf("event %s is being processed by another invocation", dedupKey))
+	}
+
+	debugLog(DEBUG_INFO, "Event %s already processed with outcome %s", dedupKey, status)
+	return "", false, nil
+}
+
+// Record the outcome of a claimed event in the idempotency ledger. Nothing is
+// recorded if the claim was lost, i.e. its lease ran out and another
+// invocation claimed the event; that invocation records its own outcome.
+func recordEventOutcome(ctx context.Context, dedupKey, claimID, outcome string, processErr error) error {
+	if ProcessedEventsTableName == "" {
+		return nil
+	}
+
+	updateExpression := "SET #status = :status, completedAt = :completedAt REMOVE leaseExpiresAt"
+	values := map[string]types.AttributeValue{
+		":claimId": &types.AttributeValueMemberS{
+			Value: claimID,
+		},
+		":status": &types.AttributeValueMemberS{
+			Value: outcome,
+		},
+		":completedAt": &types.AttributeValueMemberS{
+			Value: time.Now().Format(time.RFC3339),
+		},
+	}
+
+	if processErr != nil {
+		updateExpression = "SET #status = :status, completedAt = :completedAt, errorMessage = :errorMessage REMOVE leaseExpiresAt"
+		values[":errorMessage"] = &types.AttributeValueMemberS{
+			Value: processErr.Error(),
+		}
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ProcessedEventsTableName),
+		Key: map[string]types.AttributeValue{
+			"dedupKey": &types.AttributeValueMemberS{
+				Value: dedupKey,
+			},
+		},
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String("claimId = :claimId"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			debugLog(DEBUG_WARNING, "Lost the claim on event %s to another invocation, not recording outcome %s", dedupKey, outcome)
+			return nil
+		}
+		return fmt.Errorf("error recording event outcome in ledger: %w", err)
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 )
 
 // Debug logging levels
@@ -48,6 +50,43 @@ type User struct {
 	LastEmailDate       *string  `json:"lastEmailDate,omitempty"`
 	CreatedAt           string   `json:"createdAt"`
 	UpdatedAt           string   `json:"updatedAt"`
+
+	// Scorer that produced engagementScore
+	EngagementScorer         string          `json:"engagementScorer,omitempty"`
+	EngagementScorerVersion  string          `json:"engagementScorerVersion,omitempty"`
+	EngagementScoreBreakdown *ScoreBreakdown `json:"engagementScoreBreakdown,omitempty"`
+	EngagementScoreTrend     *ScoreTrend     `json:"engagementScoreTrend,omitempty"`
+
+	// Set to the same value as updatedAt whenever this processor writes the
+	// user row, so the stream events caused by our own writes can be dropped
+	LastProcessorWriteAt *string `json:"lastProcessorWriteAt,omitempty"`
+
+	// Orders seen by this processor, keyed by orderId
+	OrderHistory map[string]OrderHistoryEntry `json:"orderHistory,omitempty"`
+	// Sum of the values of counted orders, maintained alongside orderCount
+	OrderValueTotal float64 `json:"orderValueTotal,omitempty"`
+	// Date of the newest order compacted out of the order history
+	OrderHistoryCompactedThrough string `json:"orderHistoryCompactedThrough,omitempty"`
+	// Last order date of the aggregates the backend maintained before the
+	// order history, i.e. orders through this date are counted without an entry
+	OrderHistoryLegacyThrough string `json:"orderHistoryLegacyThrough,omitempty"`
+
+	// RFM quintiles (e.g. "543") and the segment they map to
+	RFMCode    string `json:"rfmCode,omitempty"`
+	RFMSegment string `json:"rfmSegment,omitempty"`
+
+	// Recency-weighted share of spend per category, and categories the user
+	// has stopped buying. Both are derived from order items along with
+	// PreferredCategories.
+	CategoryAffinity map[string]float64 `json:"categoryAffinity,omitempty"`
+	LapsedCategories []string           `json:"lapsedCategories,omitempty"`
+
+	// Expected spend over the value horizon, and the part of it at risk of churn
+	ExpectedValue *float64 `json:"expectedValue,omitempty"`
+	ValueAtRisk   *float64 `json:"valueAtRisk,omitempty"`
+
+	// Last returned order the user was sent a return follow-up for
+	ReturnFollowUpOrderID string `json:"returnFollowUpOrderId,omitempty"`
 }
 
 // Email represents a generated email
@@ -58,15 +97,62 @@ type Email struct {
 	Content               string  `json:"content"`
 	GeneratedAt           string  `json:"generatedAt"`
 	EngagementScoreAtTime float64 `json:"engagementScoreAtTime"`
-	Status                string  `json:"status"`
-	CreatedAt             string  `json:"createdAt"`
+	ScorerName            string  `json:"scorerName"`
+	ScorerVersion         string  `json:"scorerVersion"`
+	// Why the client was flagged, copied from the score at generation time
+	ScoreBreakdown *ScoreBreakdown `json:"engagementScoreBreakdown,omitempty"`
+	// The client's RFM segment at generation time
+	RFMCode    string `json:"rfmCode,omitempty"`
+	RFMSegment string `json:"rfmSegment,omitempty"`
+	// Value at risk at generation time and the offer tier it allowed
+	ValueAtRisk float64 `json:"valueAtRisk"`
+	OfferTier   string  `json:"offerTier"`
+	// ENGAGEMENT or RETURN_FOLLOW_UP
+	EmailType string `json:"emailType"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"createdAt"`
+	// When the email reached each status, set by updateEmailStatus
+	SentAt        string `json:"sentAt,omitempty"`
+	OpenedAt      string `json:"openedAt,omitempty"`
+	ClickedAt     string `json:"clickedAt,omitempty"`
+	FailedAt      string `json:"failedAt,omitempty"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+// Order represents a customer order
+type Order struct {
+	OrderID    string      `json:"orderId"`
+	UserID     string      `json:"userId"`
+	OrderDate  string      `json:"orderDate"`
+	TotalValue float64     `json:"totalValue"`
+	Items      []OrderItem `json:"items"`
+	Status     string      `json:"status"`
+	CreatedAt  string      `json:"createdAt"`
+}
+
+// OrderItem represents an item in an order
+type OrderItem struct {
+	ItemID    string  `json:"itemId"`
+	ProductID string  `json:"productId"`
+	Name      string  `json:"name"`
+	Category  string  `json:"category"`
+	Price     float64 `json:"price"`
+	Quantity  int     `json:"quantity"`
+}
+
+// snsEnvelope is the SNS notification wrapping an event in an SQS message body
+type snsEnvelope struct {
+	MessageID string `json:"MessageId"`
+	Message   string `json:"Message"`
 }
 
 // Event represents an event from the SNS topic
 type Event struct {
-	Type      string          `json:"type"`
-	Payload   json.RawMessage `json:"payload"`
-	Timestamp string          `json:"timestamp"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	// Layout of the payload, DefaultEventSchemaVersion when not set
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Timestamp     string `json:"timestamp"`
 }
 
 // Configuration constants
@@ -80,13 +166,30 @@ const (
 	// Email status values
 	EmailStatusGenerated = "GENERATED"
 	EmailStatusSent      = "SENT"
+	EmailStatusOpened    = "OPENED"
+	EmailStatusClicked   = "CLICKED"
 	EmailStatusFailed    = "FAILED"
 
+	// Email types
+	EmailTypeEngagement     = "ENGAGEMENT"
+	EmailTypeReturnFollowUp = "RETURN_FOLLOW_UP"
+
+	// Lambda entry points, selected with PROCESSOR_MODE
+	ProcessorModeQueue = "queue"
+	ProcessorModeSweep = "sweep"
+
 	// Event types
-	EventTypeUserCreated  = "USER_CREATED"
-	EventTypeUserUpdated  = "USER_UPDATED"
-	EventTypeOrderCreated = "ORDER_CREATED"
-	EventTypeOrderUpdated = "ORDER_UPDATED"
+	EventTypeUserCreated    = "USER_CREATED"
+	EventTypeUserUpdated    = "USER_UPDATED"
+	EventTypeUserDeleted    = "USER_DELETED"
+	EventTypeOrderCreated   = "ORDER_CREATED"
+	EventTypeOrderUpdated   = "ORDER_UPDATED"
+	EventTypeOrderCancelled = "ORDER_CANCELLED"
+	EventTypeEmailGenerated = "EMAIL_GENERATED"
+	EventTypeEmailSent      = "EMAIL_SENT"
+	EventTypeEmailOpened    = "EMAIL_OPENED"
+	EventTypeEmailClicked   = "EMAIL_CLICKED"
+	EventTypeEmailFailed    = "EMAIL_FAILED"
 )
 
 // DynamoDB table names (will be overridden by environment variables)
@@ -143,7 +246,9 @@ var (
 	openRouterApiKey string
 )
 
-func init() {
+// Set up the clients, tables and scorer the Lambda handlers use. Offline
+// commands don't call it, so they run without AWS config or a scoring model.
+func initLambda() {
 	debugLog(DEBUG_INFO, "Initializing email processor Lambda")
 	// Initialize AWS SDK clients
 	debugLog(DEBUG_INFO, "Loading AWS SDK configuration")
@@ -154,6 +259,8 @@ func init() {
 	}
 	debugLog(DEBUG_INFO, "Creating DynamoDB client")
 	dynamoClient = dynamodb.NewFromConfig(cfg)
+	debugLog(DEBUG_INFO, "Creating SNS client")
+	snsClient = sns.NewFromConfig(cfg)
 
 	// Initialize HTTP client for OpenRouter
 	debugLog(DEBUG_INFO, "Initializing HTTP client for OpenRouter API")
@@ -194,141 +301,355 @@ func init() {
 		debugLog(DEBUG_WARNING, "EMAILS_TABLE_NAME environment variable not set, using default: %s", EmailsTableName)
 	}
 
+	if tableName := os.Getenv("PROCESSED_EVENTS_TABLE_NAME"); tableName != "" {
+		ProcessedEventsTableName = tableName
+		debugLog(DEBUG_INFO, "Using processed events table from environment: %s", ProcessedEventsTableName)
+	} else {
+		debugLog(DEBUG_WARNING, "PROCESSED_EVENTS_TABLE_NAME environment variable not set, duplicate deliveries will not be detected")
+	}
+
+	if tableName := os.Getenv("SCORE_HISTORY_TABLE_NAME"); tableName != "" {
+		ScoreHistoryTableName = tableName
+		debugLog(DEBUG_INFO, "Using score history table from environment: %s", ScoreHistoryTableName)
+	} else {
+		debugLog(DEBUG_WARNING, "SCORE_HISTORY_TABLE_NAME environment variable not set, score history and trends are disabled")
+	}
+
+	if tableName := os.Getenv("PROCESSOR_STATE_TABLE_NAME"); tableName != "" {
+		ProcessorStateTableName = tableName
+		debugLog(DEBUG_INFO, "Using processor state table from environment: %s", ProcessorStateTableName)
+	}
+
+	if topicArn := os.Getenv("EMAIL_EVENTS_TOPIC_ARN"); topicArn != "" {
+		EmailEventsTopicArn = topicArn
+		debugLog(DEBUG_INFO, "Publishing email events to topic: %s", EmailEventsTopicArn)
+	} else {
+		debugLog(DEBUG_WARNING, "EMAIL_EVENTS_TOPIC_ARN environment variable not set, email events will not be published")
+	}
+
+	if tableName := os.Getenv("QUARANTINE_TABLE_NAME"); tableName != "" {
+		QuarantineTableName = tableName
+		debugLog(DEBUG_INFO, "Using quarantine table from environment: %s", QuarantineTableName)
+	} else {
+		debugLog(DEBUG_WARNING, "QUARANTINE_TABLE_NAME environment variable not set, events that can't be decoded will be dropped")
+	}
+
+	if tableName := os.Getenv("ERASURE_RECEIPTS_TABLE_NAME"); tableName != "" {
+		ErasureReceiptsTableName = tableName
+		debugLog(DEBUG_INFO, "Using erasure receipts table from environment: %s", ErasureReceiptsTableName)
+	}
+
+	if concurrency := os.Getenv("BATCH_CONCURRENCY"); concurrency != "" {
+		if value, err := strconv.Atoi(concurrency); err == nil && value > 0 {
+			BatchConcurrency = value
+		} else {
+			debugLog(DEBUG_WARNING, "Invalid BATCH_CONCURRENCY value %q, using default: %d", concurrency, BatchConcurrency)
+		}
+	}
+
+	if segments := os.Getenv("SWEEP_SEGMENTS"); segments != "" {
+		if value, err := strconv.Atoi(segments); err == nil && value > 0 {
+			SweepSegments = value
+		} else {
+			debugLog(DEBUG_WARNING, "Invalid SWEEP_SEGMENTS value %q, using default: %d", segments, SweepSegments)
+		}
+	}
+
+	if budget := os.Getenv("SWEEP_EMAIL_BUDGET"); budget != "" {
+		if value, err := strconv.Atoi(budget); err == nil && value >= 0 {
+			SweepEmailBudget = value
+		} else {
+			debugLog(DEBUG_WARNING, "Invalid SWEEP_EMAIL_BUDGET value %q, sweep emails are not limited", budget)
+		}
+	}
+
+	// Load the scoring model
+	scoringConfig, err := loadScoringConfig()
+	if err != nil {
+		debugLog(DEBUG_FATAL, "Failed to load scoring config: %v", err)
+		log.Fatalf("Failed to load scoring config: %v", err)
+	}
+	activeScorer, err = newScorer(scoringConfig)
+	if err != nil {
+		debugLog(DEBUG_FATAL, "Failed to create scorer: %v", err)
+		log.Fatalf("Failed to create scorer: %v", err)
+	}
+	if err := prepareValueConfig(&scoringConfig.Value); err != nil {
+		debugLog(DEBUG_FATAL, "Invalid value config: %v", err)
+		log.Fatalf("Invalid value config: %v", err)
+	}
+	if err := validateCategoryConfig(scoringConfig.Categories); err != nil {
+		debugLog(DEBUG_FATAL, "Invalid categories config: %v", err)
+		log.Fatalf("Invalid categories config: %v", err)
+	}
+	activeScoringConfig = scoringConfig
+	debugLog(DEBUG_INFO, "Using scorer %s version %s", activeScorer.Name(), activeScorer.Version())
+
 	debugLog(DEBUG_INFO, "Email processor Lambda initialization complete")
 }
 
 // Lambda handler function
-func handler(ctx context.Context, sqsEvent events.SQSEvent) error {
+func handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
 	// Add panic recovery to catch and log any crashes
 	defer recoverPanic()
 
-	debugLog(DEBUG_INFO, "Lambda handler invoked with %d SQS messages", len(sqsEvent.Records))
 	debugLog(DEBUG_INFO, "Lambda handler invoked with %d SQS messages", len(sqsEvent.Records))
 
+	var response events.SQSEventResponse
+	redeliver := processBatch(ctx, sqsEvent.Records)
 	for i, message := range sqsEvent.Records {
-		debugLog(DEBUG_INFO, "[%d/%d] Processing message: %s", i+1, len(sqsEvent.Records), message.MessageId)
-		debugLog(DEBUG_INFO, "Message body: %s", message.Body)
-
-		// Parse the SNS message from the SQS event
-		var snsMessage map[string]interface{}
-		if err := json.Unmarshal([]byte(message.Body), &snsMessage); err != nil {
-			debugLog(DEBUG_ERROR, "Error parsing SNS message: %v", err)
-			continue
+		if redeliver[i] {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
 		}
+	}
 
-		// Log SNS message details
-		debugLog(DEBUG_INFO, "SNS message parsed successfully: %+v", snsMessage)
+	debugLog(DEBUG_INFO, "Lambda handler completed - %d of %d messages reported for redelivery",
+		len(response.BatchItemFailures), len(sqsEvent.Records))
+	return response, nil
+}
 
-		// Extract the actual message from the SNS envelope
-		messageStr, ok := snsMessage["Message"].(string)
-		if !ok {
-			debugLog(DEBUG_ERROR, "Error: SNS message does not contain a Message field. Keys found: %v", getMapKeys(snsMessage))
-			continue
-		}
+// Process a single SQS message. Errors are classified with retryableError /
+// permanentError so the handler can decide whether to redeliver the message.
+func processMessage(ctx context.Context, message events.SQSMessage) error {
+	debugLog(DEBUG_INFO, "Message body: %s", message.Body)
 
-		debugLog(DEBUG_INFO, "Extracted Message from SNS: %s", messageStr)
+	event, err := parseMessageEvent(message)
+	if err != nil {
+		return err
+	}
 
-		// Parse the event
-		var event Event
-		if err := json.Unmarshal([]byte(messageStr), &event); err != nil {
-			debugLog(DEBUG_ERROR, "Error parsing event: %v", err)
-			debugLog(DEBUG_ERROR, "Raw message content: %s", messageStr)
-			continue
-		}
+	return processDelivery(ctx, event, message.MessageId)
+}
 
-		debugLog(DEBUG_INFO, "Event parsed successfully - Type: %s, Timestamp: %s", event.Type, event.Timestamp)
+// Extract the event from an SQS message, whatever format its body is in
+func parseMessageEvent(message events.SQSMessage) (Event, error) {
+	event, format, err := decodeMessageBody(message.Body)
+	if err != nil {
+		return Event{}, permanentError(err)
+	}
 
-		// Process the event based on its type
-		switch event.Type {
-		case EventTypeUserCreated, EventTypeUserUpdated:
-			debugLog(DEBUG_INFO, "Processing %s event", event.Type)
+	debugLog(DEBUG_INFO, "Event parsed successfully from %s message - Type: %s, Timestamp: %s",
+		format, event.Type, event.Timestamp)
+	return event, nil
+}
 
-			var user User
-			if err := json.Unmarshal(event.Payload, &user); err != nil {
-				debugLog(DEBUG_ERROR, "Error parsing user payload: %v", err)
-				debugLog(DEBUG_ERROR, "Raw payload: %s", string(event.Payload))
-				continue
-			}
+// Process an event from any source. Events of users erased since are dropped,
+// and the event is claimed in the idempotency ledger first, so redeliveries
+// are skipped. deliveryID identifies the
+// delivery in the ledger (SQS message ID, stream record ID or EventBridge event ID).
+func processDelivery(ctx context.Context, event Event, deliveryID string) error {
+	// Checked before the claim, which would write a ledger entry for the user
+	erased, err := erasedUserEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+	if erased {
+		debugLog(DEBUG_INFO, "Dropping %s for user %s, who was erased after it was published (delivery %s)",
+			event.Type, eventUserID(event), deliveryID)
+		return nil
+	}
 
-			debugLog(DEBUG_INFO, "User data parsed successfully - UserID: %s, Name: %s, Email: %s",
-				user.UserID, user.Name, user.Email)
+	dedupKey := eventDedupKey(event)
+	claimID, claimed, err := claimEvent(ctx, dedupKey, event, deliveryID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		debugLog(DEBUG_INFO, "Skipping duplicate delivery of event %s (delivery %s)", dedupKey, deliveryID)
+		return nil
+	}
 
-			if err := processUser(ctx, user); err != nil {
-				debugLog(DEBUG_ERROR, "Error processing user: %v", err)
-			} else {
-				debugLog(DEBUG_INFO, "User processed successfully: %s", user.UserID)
-			}
+	emailed, processErr := processEvent(ctx, event)
 
-		case EventTypeOrderCreated, EventTypeOrderUpdated:
-			debugLog(DEBUG_INFO, "Processing %s event", event.Type)
+	outcome := LedgerOutcomeSkipped
+	if emailed {
+		outcome = LedgerOutcomeEmailed
+	} else if processErr != nil {
+		outcome = LedgerOutcomeFailed
+	}
+	// Recorded even if processing was cancelled near the deadline
+	if err := recordEventOutcome(context.WithoutCancel(ctx), dedupKey, claimID, outcome, processErr); err != nil {
+		debugLog(DEBUG_WARNING, "Error recording outcome %s for event %s: %v", outcome, dedupKey, err)
+	}
 
-			// Get the user ID from the order
-			var orderData map[string]interface{}
-			if err := json.Unmarshal(event.Payload, &orderData); err != nil {
-				debugLog(DEBUG_ERROR, "Error parsing order payload: %v", err)
-				debugLog(DEBUG_ERROR, "Raw payload: %s", string(event.Payload))
-				continue
-			}
+	if emailed && processErr != nil {
+		// The email already went out - redelivering would send it a second time
+		debugLog(DEBUG_ERROR, "Error after email was sent for event %s, not redelivering: %v", dedupKey, processErr)
+		return nil
+	}
 
-			debugLog(DEBUG_INFO, "Order data parsed successfully: %+v", orderData)
+	return processErr
+}
 
-			userID, ok := orderData["userId"].(string)
-			if !ok {
-				debugLog(DEBUG_ERROR, "Error: Order does not contain a userId field. Keys found: %v", getMapKeys(orderData))
-				continue
-			}
+// Handle a USER_CREATED or USER_UPDATED event
+func handleUserEvent(ctx context.Context, event Event, user User) (bool, error) {
+	debugLog(DEBUG_INFO, "User data parsed successfully - UserID: %s, Name: %s, Email: %s",
+		user.UserID, user.Name, user.Email)
+
+	// The processor's own snapshots are dropped before they touch the mark,
+	// so they can't make a snapshot from another writer look stale
+	if event.Type == EventTypeUserUpdated && isSelfInducedUpdate(user) {
+		debugLog(DEBUG_INFO, "Dropping USER_UPDATED for %s - caused by this processor's own write at %s",
+			user.UserID, user.UpdatedAt)
+		return false, nil
+	}
 
-			debugLog(DEBUG_INFO, "Extracted userID from order: %s", userID)
+	// Deliveries can arrive out of order, so an older snapshot must not
+	// override decisions made from a newer one
+	current, err := advanceUserEventMark(ctx, user, event)
+	if err != nil {
+		return false, err
+	}
+	if !current {
+		debugLog(DEBUG_INFO, "Dropping stale %s for %s", event.Type, user.UserID)
+		return false, nil
+	}
 
-			// Get the user from DynamoDB
-			debugLog(DEBUG_INFO, "Fetching user from DynamoDB: %s", userID)
-			user, err := getUserFromDynamoDB(ctx, userID)
-			if err != nil {
-				debugLog(DEBUG_ERROR, "Error getting user from DynamoDB: %v", err)
-				continue
-			}
+	emailed, err := processUser(ctx, user)
+	if err != nil {
+		return false, fmt.Errorf("error processing user %s: %w", user.UserID, err)
+	}
+	debugLog(DEBUG_INFO, "User processed successfully: %s", user.UserID)
+	return emailed, nil
+}
 
-			debugLog(DEBUG_INFO, "User fetched successfully from DynamoDB - UserID: %s, Name: %s",
-				user.UserID, user.Name)
+// Handle an ORDER_CREATED, ORDER_UPDATED or ORDER_CANCELLED event
+func handleOrderEvent(ctx context.Context, event Event, order Order) (bool, error) {
+	if event.Type == EventTypeOrderCancelled {
+		order.Status = OrderStatusCancelled
+	}
 
-			// Process the user
-			if err := processUser(ctx, user); err != nil {
-				debugLog(DEBUG_ERROR, "Error processing user: %v", err)
-			} else {
-				debugLog(DEBUG_INFO, "User processed successfully: %s", user.UserID)
-			}
+	debugLog(DEBUG_INFO, "Order data parsed successfully: %+v", order)
 
-		default:
-			debugLog(DEBUG_WARNING, "Ignoring event of type: %s", event.Type)
+	userID := order.UserID
+	debugLog(DEBUG_INFO, "Extracted userID from order: %s", userID)
+
+	// Get the user from DynamoDB
+	debugLog(DEBUG_INFO, "Fetching user from DynamoDB: %s", userID)
+	user, err := getUserFromDynamoDB(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			return false, permanentError(err)
 		}
+		return false, fmt.Errorf("error getting user from DynamoDB: %w", err)
 	}
 
-	debugLog(DEBUG_INFO, "Lambda handler completed successfully")
-	return nil
+	debugLog(DEBUG_INFO, "User fetched successfully from DynamoDB - UserID: %s, Name: %s",
+		user.UserID, user.Name)
+
+	// Apply the order to the user's order history and aggregates
+	if err := applyOrder(ctx, &user, order); err != nil {
+		if errors.Is(err, errUserNotFound) {
+			return false, permanentError(err)
+		}
+		return false, err
+	}
+
+	// A fully returned last order gets the return follow-up instead of the engagement email
+	if returned, due := returnFollowUpDue(user); due {
+		emailed, err := followUpReturn(ctx, user, returned)
+		if err != nil {
+			return emailed, fmt.Errorf("error following up return for user %s: %w", user.UserID, err)
+		}
+		return emailed, nil
+	}
+
+	// Process the user
+	emailed, err := processUser(ctx, user)
+	if err != nil {
+		return false, fmt.Errorf("error processing user %s: %w", user.UserID, err)
+	}
+	debugLog(DEBUG_INFO, "User processed successfully: %s", user.UserID)
+	return emailed, nil
 }
 
-// Helper function to get map keys for debugging
-func getMapKeys(m map[string]interface{}) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+// Handle a USER_DELETED event
+func handleUserDeletedEvent(ctx context.Context, event Event, payload userDeletedPayload) (bool, error) {
+	if err := eraseUser(ctx, payload.UserID, event); err != nil {
+		return false, fmt.Errorf("error erasing user %s: %w", payload.UserID, err)
 	}
-	return keys
+	debugLog(DEBUG_INFO, "User erased successfully: %s", payload.UserID)
+	return false, nil
+}
 
-	return nil
+// Handle an EMAIL_SENT, EMAIL_OPENED, EMAIL_CLICKED or EMAIL_FAILED tracking event
+func handleEmailEvent(ctx context.Context, event Event, payload emailEventPayload) (bool, error) {
+	if err := processEmailEvent(ctx, event, payload); err != nil {
+		return false, fmt.Errorf("error processing %s event: %w", event.Type, err)
+	}
+	return false, nil
 }
 
-// Process a user and generate an email if needed
-func processUser(ctx context.Context, user User) error {
-	// Add panic recovery to catch and log any crashes
-	defer recoverPanic()
+// Check whether a user snapshot was produced by this processor's own write
+// (engagement score, last email date). Any other writer changes updatedAt
+// without touching lastProcessorWriteAt, so the two no longer match.
+func isSelfInducedUpdate(user User) bool {
+	return user.LastProcessorWriteAt != nil && user.UpdatedAt != "" && *user.LastProcessorWriteAt == user.UpdatedAt
+}
+
+// userScores are the values computed from a user's current data
+type userScores struct {
+	Breakdown  ScoreBreakdown
+	RFM        RFMScore
+	Value      CustomerValue
+	Categories CategoryProfile
+	// The engagement score differs from the stored one
+	ScoreChanged bool
+	// Any of the values differ from the stored ones
+	Changed bool
+}
+
+// userAssessment is the outcome of re-scoring a user
+type userAssessment struct {
+	userScores
+	User        User
+	Trend       ScoreTrend
+	ShouldEmail bool
+	// Email to send, the engagement email unless set otherwise
+	EmailType string
+	// Order the return follow-up email is about
+	ReturnedOrder *orderRef
+}
+
+// Process a user and generate an email if needed. Returns true if an email was sent.
+func processUser(ctx context.Context, user User) (emailed bool, err error) {
+	// A panic fails the user with a retryable error rather than passing as success
+	defer recoverPanicAsError(&err)
 
+	assessment, err := assessUser(ctx, user)
+	if err != nil {
+		return false, err
+	}
+
+	if !assessment.ShouldEmail {
+		debugLog(DEBUG_INFO, "Not generating email for user: %s (score: %.2f is above threshold: %.2f or email too recent)",
+			user.UserID, assessment.Breakdown.Score, EngagementScoreThreshold)
+		debugLog(DEBUG_INFO, "User processing completed successfully: %s", user.UserID)
+		return false, nil
+	}
+
+	if emailed, err := emailUser(ctx, assessment); err != nil {
+		if errors.Is(err, errEmailNotClaimed) {
+			// Another invocation is emailing the user, or just did
+			return false, nil
+		}
+		return emailed, err
+	}
+
+	debugLog(DEBUG_INFO, "User processing completed successfully: %s", user.UserID)
+	return true, nil
+}
+
+// Re-score a user, write back anything that changed, and decide whether they should be emailed
+func assessUser(ctx context.Context, user User) (userAssessment, error) {
 	debugLog(DEBUG_INFO, "Processing user: %s", user.UserID)
 	debugLog(DEBUG_INFO, "User details: Name=%s, Email=%s, LastOrderDate=%s, OrderCount=%d, AverageOrderValue=%.2f",
 		user.Name, user.Email, user.LastOrderDate, user.OrderCount, user.AverageOrderValue)
 
 	if user.EngagementScore != nil {
-		debugLog(DEBUG_INFO, "User already has engagement score: %.2f", *user.EngagementScore)
+		debugLog(DEBUG_INFO, "Stored engagement score: %.2f", *user.EngagementScore)
 	}
 
 	if user.LastEmailDate != nil {
@@ -336,194 +657,271 @@ func processUser(ctx context.Context, user User) error {
 	} else {
 		debugLog(DEBUG_INFO, "User has no previous emails")
 	}
-	// Use the existing engagement score from the database instead of recalculating
-	var engagementScore float64
-	if user.EngagementScore != nil {
-		engagementScore = *user.EngagementScore
-		debugLog(DEBUG_INFO, "Using existing engagement score from database: %.2f", engagementScore)
-	} else {
-		// If no engagement score exists, use a default low score to trigger email generation
-		engagementScore = 10.0
-		debugLog(DEBUG_INFO, "No existing score, using default low score: %.2f", engagementScore)
-
-		// Update the user's engagement score in DynamoDB
-		debugLog(DEBUG_INFO, "Updating user engagement score in DynamoDB: %s -> %.2f", user.UserID, engagementScore)
-		if err := updateUserEngagementScore(ctx, user.UserID, engagementScore); err != nil {
-			debugLog(DEBUG_ERROR, "Error updating user engagement score: %v", err)
-			return fmt.Errorf("error updating user engagement score: %w", err)
+
+	assessment, err := assessScores(ctx, user, scoreUser(ctx, user))
+	if err != nil {
+		return userAssessment{}, err
+	}
+	if err := saveAssessment(ctx, assessment); err != nil {
+		return userAssessment{}, err
+	}
+	return assessment, nil
+}
+
+// Recompute a user's engagement score, RFM segment, value and categories
+// from current data, and compare them with the stored ones
+func scoreUser(ctx context.Context, user User) userScores {
+	breakdown := calculateEngagementScore(user)
+	debugLog(DEBUG_INFO, "Calculated engagement score: %.2f", breakdown.Score)
+
+	rfm := classifyRFM(user, currentRFMBoundaries(ctx))
+	debugLog(DEBUG_INFO, "RFM: %s (%s)", rfm.Code(), rfm.Segment)
+
+	value := estimateCustomerValue(user, breakdown)
+	debugLog(DEBUG_INFO, "Expected value: %.2f, churn risk: %.2f, value at risk: %.2f (offer tier %s)",
+		value.ExpectedValue, value.ChurnRisk, value.ValueAtRisk, value.OfferTier)
+
+	categories := categoryProfile(user, activeScoringConfig.Categories, time.Now())
+	if len(categories.Affinity) > 0 {
+		debugLog(DEBUG_INFO, "Categories: preferred %v, lapsed %v", categories.Preferred, categories.Lapsed)
+	}
+
+	scoreChanged := !storedScoreCurrent(user, breakdown)
+	return userScores{
+		Breakdown:    breakdown,
+		RFM:          rfm,
+		Value:        value,
+		Categories:   categories,
+		ScoreChanged: scoreChanged,
+		Changed: scoreChanged || !storedRFMCurrent(user, rfm) ||
+			!storedValueCurrent(user, value) || !storedCategoriesCurrent(user, categories),
+	}
+}
+
+// Load the score trend for already computed scores and decide whether the
+// user should be emailed. Nothing is written; see saveAssessment.
+func assessScores(ctx context.Context, user User, scores userScores) (userAssessment, error) {
+	engagementScore := scores.Breakdown.Score
+	trend, err := loadScoreTrend(ctx, user.UserID, engagementScore)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Error loading score trend: %v", err)
+		return userAssessment{}, err
+	}
+	debugLog(DEBUG_INFO, "Score trend: delta30d=%.2f, velocity=%.4f/day, recentDrop=%.2f (%d samples)",
+		trend.Delta30d, trend.Velocity, trend.RecentDrop, trend.Samples)
+
+	assessment := userAssessment{
+		userScores: scores,
+		User:       user,
+		Trend:      trend,
+	}
+
+	// The user as they will be once the assessment is saved
+	if scores.Changed {
+		breakdown := scores.Breakdown
+		user.EngagementScore = &engagementScore
+		user.EngagementScoreBreakdown = &breakdown
+		user.EngagementScoreTrend = &trend
+		user.RFMCode = scores.RFM.Code()
+		user.RFMSegment = scores.RFM.Segment
+		user.ExpectedValue = &scores.Value.ExpectedValue
+		user.ValueAtRisk = &scores.Value.ValueAtRisk
+		if len(scores.Categories.Affinity) > 0 {
+			user.CategoryAffinity = scores.Categories.Affinity
+			user.PreferredCategories = scores.Categories.Preferred
+			user.LapsedCategories = scores.Categories.Lapsed
 		}
-		debugLog(DEBUG_INFO, "Successfully updated engagement score in DynamoDB")
 	}
-	debugLog(DEBUG_INFO, "Successfully updated engagement score in DynamoDB")
 
 	// Check if we should generate an email
 	debugLog(DEBUG_INFO, "Checking if we should generate an email for user: %s (score: %.2f, threshold: %.2f)",
 		user.UserID, engagementScore, EngagementScoreThreshold)
-	shouldGenerate := shouldGenerateEmail(user, engagementScore)
+	shouldGenerate := shouldGenerateEmail(user, engagementScore, trend)
 	debugLog(DEBUG_INFO, "Should generate email decision: %v", shouldGenerate)
 
-	if shouldGenerate {
-		debugLog(DEBUG_INFO, "Generating email for user: %s", user.UserID)
-
-		// Generate the email
-		debugLog(DEBUG_INFO, "Calling generateEmail for user: %s", user.UserID)
-		email, err := generateEmail(ctx, user, engagementScore)
-		if err != nil {
-			debugLog(DEBUG_ERROR, "Error generating email: %v", err)
-			return fmt.Errorf("error generating email: %w", err)
-		}
-		debugLog(DEBUG_INFO, "Email generated successfully - EmailID: %s, Subject: %s", email.EmailID, email.Subject)
-
-		// Save the email to DynamoDB
-		debugLog(DEBUG_INFO, "Saving email to DynamoDB - EmailID: %s", email.EmailID)
-		if err := saveEmailToDynamoDB(ctx, email); err != nil {
-			debugLog(DEBUG_ERROR, "Error saving email to DynamoDB: %v", err)
-			return fmt.Errorf("error saving email to DynamoDB: %w", err)
-		}
-		debugLog(DEBUG_INFO, "Email saved to DynamoDB successfully")
+	assessment.User = user
+	assessment.ShouldEmail = shouldGenerate
+	return assessment, nil
+}
 
-		// Send the email
-		debugLog(DEBUG_INFO, "Sending email via SES - EmailID: %s, To: %s", email.EmailID, user.Email)
-		if err := sendEmail(ctx, email, user); err != nil {
-			debugLog(DEBUG_ERROR, "Error sending email: %v", err)
-			return fmt.Errorf("error sending email: %w", err)
-		}
-		debugLog(DEBUG_INFO, "Email sent successfully")
+// Write an assessment's score, segment, value and categories back to the
+// user, if any of them changed
+func saveAssessment(ctx context.Context, assessment userAssessment) error {
+	engagementScore := assessment.Breakdown.Score
+	if !assessment.Changed {
+		debugLog(DEBUG_INFO, "Engagement score (%.2f), RFM segment, value and categories unchanged, skipping update", engagementScore)
+		return nil
+	}
 
-		// Update the user's last email date in DynamoDB
-		debugLog(DEBUG_INFO, "Updating user's last email date in DynamoDB: %s", user.UserID)
-		if err := updateUserLastEmailDate(ctx, user.UserID); err != nil {
-			debugLog(DEBUG_ERROR, "Error updating user last email date: %v", err)
-			return fmt.Errorf("error updating user last email date: %w", err)
+	debugLog(DEBUG_INFO, "Updating user engagement score in DynamoDB: %s -> %.2f, %s",
+		assessment.User.UserID, engagementScore, assessment.RFM.Segment)
+	if err := updateUserEngagementScore(ctx, assessment); err != nil {
+		debugLog(DEBUG_ERROR, "Error updating user engagement score: %v", err)
+		return fmt.Errorf("error updating user engagement score: %w", err)
+	}
+	// Only after the update, which fails if the user row is gone, so an
+	// erased user gets no new history. The score is current from here on,
+	// so a retry wouldn't append it either.
+	if assessment.ScoreChanged {
+		if err := appendScoreHistory(ctx, assessment.User.UserID, assessment.Breakdown); err != nil {
+			debugLog(DEBUG_ERROR, "Error appending score history: %v", err)
 		}
-		debugLog(DEBUG_INFO, "User's last email date updated successfully")
-	} else {
-		debugLog(DEBUG_INFO, "Not generating email for user: %s (score: %.2f is above threshold: %.2f or email too recent)",
-			user.UserID, engagementScore, EngagementScoreThreshold)
 	}
-
-	debugLog(DEBUG_INFO, "User processing completed successfully: %s", user.UserID)
+	debugLog(DEBUG_INFO, "Successfully updated engagement score in DynamoDB")
 	return nil
 }
 
-// Calculate the engagement score for a user
-func calculateEngagementScore(user User) float64 {
-	// Add panic recovery to catch and log any crashes
-	defer recoverPanic()
-
-	debugLog(DEBUG_INFO, "Calculating engagement score for user: %s", user.UserID)
-
-	// Calculate days since last order
-	lastOrderDate, err := time.Parse(time.RFC3339, user.LastOrderDate)
+// Generate, save and send an email to an assessed user. Returns true once the
+// email was sent, even if recording the send on the user failed afterwards.
+// The send is claimed on the user row first, so concurrent invocations can't
+// both email the user; errEmailNotClaimed is returned if the claim fails.
+func emailUser(ctx context.Context, assessment userAssessment) (bool, error) {
+	user := assessment.User
+
+	// The stored last email date may be stale, so reserve the send atomically
+	// before spending an OpenRouter call on it. The return follow-up is not
+	// held to the minimum interval, only to one send at a time.
+	window := time.Duration(MinDaysBetweenEmails) * 24 * time.Hour
+	if assessment.EmailType == EmailTypeReturnFollowUp {
+		window = 0
+	}
+	claimID, err := claimEmailSend(ctx, user.UserID, window)
 	if err != nil {
-		debugLog(DEBUG_ERROR, "Error parsing last order date: %v, using current time", err)
-		lastOrderDate = time.Now()
+		debugLog(DEBUG_INFO, "Not emailing user %s: %v", user.UserID, err)
+		return false, err
 	}
-	daysSinceLastOrder := int(time.Since(lastOrderDate).Hours() / 24)
-	debugLog(DEBUG_INFO, "Days since last order: %d", daysSinceLastOrder)
 
-	// Calculate order count factor (max 1.0)
-	orderCountFactor := float64(user.OrderCount) / 10
-	if orderCountFactor > 1.0 {
-		orderCountFactor = 1.0
-	}
-	debugLog(DEBUG_INFO, "Order count: %d, factor: %.2f", user.OrderCount, orderCountFactor)
+	emailed, err := generateAndSendEmail(ctx, assessment)
 
-	// Calculate average order value factor (max 1.0)
-	aovFactor := user.AverageOrderValue / 200
-	if aovFactor > 1.0 {
-		aovFactor = 1.0
+	// ctx may have been cancelled near the deadline, but the claim must still
+	// be released, or the send recorded
+	cleanupCtx := context.WithoutCancel(ctx)
+	if !emailed {
+		releaseEmailSend(cleanupCtx, user.UserID, claimID)
+		return false, err
 	}
-	debugLog(DEBUG_INFO, "Average order value: $%.2f, factor: %.2f", user.AverageOrderValue, aovFactor)
 
-	// Calculate days since last email
-	daysSinceLastEmail := 365 // Default to a year if no email has been sent
-	if user.LastEmailDate != nil {
-		lastEmailDate, err := time.Parse(time.RFC3339, *user.LastEmailDate)
-		if err != nil {
-			debugLog(DEBUG_ERROR, "Error parsing last email date: %v, using default (365 days)", err)
-		} else {
-			daysSinceLastEmail = int(time.Since(lastEmailDate).Hours() / 24)
-			debugLog(DEBUG_INFO, "Days since last email: %d", daysSinceLastEmail)
-		}
-	} else {
-		debugLog(DEBUG_INFO, "No previous emails sent, using default days since last email: %d", daysSinceLastEmail)
-	}
-
-	// Lower score = higher risk of disengagement
-	score := 100.0
-	debugLog(DEBUG_INFO, "Starting score: %.2f", score)
-
-	// Reduce score based on days since last order (higher impact)
-	if daysSinceLastOrder > 90 {
-		debugLog(DEBUG_INFO, "Reducing score by 40 (days since last order > 90)")
-		score -= 40
-	} else if daysSinceLastOrder > 60 {
-		debugLog(DEBUG_INFO, "Reducing score by 30 (days since last order > 60)")
-		score -= 30
-	} else if daysSinceLastOrder > 30 {
-		debugLog(DEBUG_INFO, "Reducing score by 15 (days since last order > 30)")
-		score -= 15
-	} else {
-		debugLog(DEBUG_INFO, "No reduction for recent order (days since last order: %d)", daysSinceLastOrder)
+	// Update the user's last email date in DynamoDB
+	debugLog(DEBUG_INFO, "Updating user's last email date in DynamoDB: %s", user.UserID)
+	if err := finalizeEmailSend(cleanupCtx, user.UserID, claimID); err != nil {
+		debugLog(DEBUG_ERROR, "Error updating user last email date: %v", err)
+		return true, fmt.Errorf("error updating user last email date: %w", err)
 	}
-	debugLog(DEBUG_INFO, "Score after order recency adjustment: %.2f", score)
+	debugLog(DEBUG_INFO, "User's last email date updated successfully")
 
-	// Increase score based on order history
-	orderHistoryBonus := orderCountFactor * 15
-	debugLog(DEBUG_INFO, "Adding %.2f to score based on order count", orderHistoryBonus)
-	score += orderHistoryBonus
-
-	aovBonus := aovFactor * 10
-	debugLog(DEBUG_INFO, "Adding %.2f to score based on average order value", aovBonus)
-	score += aovBonus
+	return true, nil
+}
 
-	debugLog(DEBUG_INFO, "Score after order history adjustments: %.2f", score)
+// Generate, save and send an email under a send claim. Returns true once the
+// email was sent. Failures are reported even if ctx was cancelled.
+func generateAndSendEmail(ctx context.Context, assessment userAssessment) (bool, error) {
+	user := assessment.User
+	cleanupCtx := context.WithoutCancel(ctx)
+	debugLog(DEBUG_INFO, "Generating email for user: %s", user.UserID)
 
-	// Adjust based on email recency
-	if daysSinceLastEmail < MinDaysBetweenEmails {
-		debugLog(DEBUG_INFO, "Reducing score by 10 (recent email: %d days, minimum: %d days)",
-			daysSinceLastEmail, MinDaysBetweenEmails)
-		score -= 10 // Don't email too frequently
-	} else {
-		debugLog(DEBUG_INFO, "No reduction for email recency (days since last email: %d)", daysSinceLastEmail)
+	// Generate the email
+	debugLog(DEBUG_INFO, "Calling generateEmail for user: %s", user.UserID)
+	email, err := generateEmail(ctx, assessment)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Error generating email: %v", err)
+		publishEmailEvent(cleanupCtx, EventTypeEmailFailed, emailFailedPayload{
+			UserID: user.UserID,
+			Error:  err.Error(),
+			Stage:  EmailStageGenerate,
+		})
+		return false, fmt.Errorf("error generating email: %w", err)
 	}
-	debugLog(DEBUG_INFO, "Score after email recency adjustment: %.2f", score)
-
-	// Ensure score is between 0 and 100
-	originalScore := score
-	if score < 0 {
-		debugLog(DEBUG_INFO, "Clamping score from %.2f to 0.0 (minimum)", score)
-		score = 0
-	} else if score > 100 {
-		debugLog(DEBUG_INFO, "Clamping score from %.2f to 100.0 (maximum)", score)
-		score = 100
+	debugLog(DEBUG_INFO, "Email generated successfully - EmailID: %s, Subject: %s", email.EmailID, email.Subject)
+
+	// Save the email to DynamoDB
+	debugLog(DEBUG_INFO, "Saving email to DynamoDB - EmailID: %s", email.EmailID)
+	if err := saveEmailToDynamoDB(ctx, email); err != nil {
+		debugLog(DEBUG_ERROR, "Error saving email to DynamoDB: %v", err)
+		publishEmailEvent(cleanupCtx, EventTypeEmailFailed, emailFailedPayload{
+			EmailID: email.EmailID,
+			UserID:  user.UserID,
+			Error:   err.Error(),
+			Stage:   EmailStageSave,
+		})
+		return false, fmt.Errorf("error saving email to DynamoDB: %w", err)
 	}
+	debugLog(DEBUG_INFO, "Email saved to DynamoDB successfully")
+	publishEmailEvent(cleanupCtx, EventTypeEmailGenerated, emailGeneratedPayload{
+		EmailID:     email.EmailID,
+		UserID:      email.UserID,
+		EmailType:   email.EmailType,
+		Status:      email.Status,
+		GeneratedAt: email.GeneratedAt,
+	})
 
-	if originalScore != score {
-		debugLog(DEBUG_INFO, "Final score (after clamping): %.2f", score)
-	} else {
-		debugLog(DEBUG_INFO, "Final score: %.2f", score)
+	// Send the email
+	debugLog(DEBUG_INFO, "Sending email via SES - EmailID: %s, To: %s", email.EmailID, user.Email)
+	if err := sendEmail(ctx, email, user); err != nil {
+		debugLog(DEBUG_ERROR, "Error sending email: %v", err)
+		if _, statusErr := updateEmailStatus(cleanupCtx, emailStatusUpdate{
+			EmailID:       email.EmailID,
+			Status:        EmailStatusFailed,
+			FailureReason: err.Error(),
+		}); statusErr != nil {
+			debugLog(DEBUG_ERROR, "Error marking email %s as failed: %v", email.EmailID, statusErr)
+		}
+		publishEmailEvent(cleanupCtx, EventTypeEmailFailed, emailFailedPayload{
+			EmailID: email.EmailID,
+			UserID:  user.UserID,
+			Error:   err.Error(),
+			Stage:   EmailStageSend,
+		})
+		return false, fmt.Errorf("error sending email: %w", err)
 	}
+	debugLog(DEBUG_INFO, "Email sent successfully")
+	publishEmailEvent(cleanupCtx, EventTypeEmailSent, emailSentPayload{
+		EmailID: email.EmailID,
+		UserID:  user.UserID,
+	})
 
-	return score
+	return true, nil
+}
+
+// Calculate the engagement score for a user with the configured scorer
+func calculateEngagementScore(user User) ScoreBreakdown {
+	return activeScorer.Score(user)
+}
+
+// Compare two scores at the precision they are stored with in DynamoDB
+func scoresEqual(a, b float64) bool {
+	return strconv.FormatFloat(a, 'f', 2, 64) == strconv.FormatFloat(b, 'f', 2, 64)
+}
+
+// Check whether the score stored on the user matches a freshly computed one,
+// including the scorer that produced it. The stored breakdown is only
+// refreshed together with the score, so its raw inputs can lag behind.
+func storedScoreCurrent(user User, breakdown ScoreBreakdown) bool {
+	return user.EngagementScore != nil &&
+		scoresEqual(*user.EngagementScore, breakdown.Score) &&
+		user.EngagementScorer == breakdown.Scorer &&
+		user.EngagementScorerVersion == breakdown.ScorerVersion
 }
 
 // Check if we should generate an email for a user
-func shouldGenerateEmail(user User, engagementScore float64) bool {
+func shouldGenerateEmail(user User, engagementScore float64, trend ScoreTrend) bool {
 	debugLog(DEBUG_INFO, "Evaluating if we should generate email for user %s", user.UserID)
 	debugLog(DEBUG_INFO, "Current engagement score: %.2f, threshold: %.2f", engagementScore, EngagementScoreThreshold)
 
-	// Check if the engagement score is below the threshold
+	// Check if the engagement score is below the threshold, or dropped sharply
 	if engagementScore > EngagementScoreThreshold {
-		debugLog(DEBUG_INFO, "Engagement score %.2f is ABOVE threshold %.2f - NOT generating email",
+		if !trend.SharpDrop() {
+			debugLog(DEBUG_INFO, "Engagement score %.2f is ABOVE threshold %.2f - NOT generating email",
+				engagementScore, EngagementScoreThreshold)
+			return false
+		}
+
+		debugLog(DEBUG_INFO, "Engagement score %.2f is ABOVE threshold %.2f but dropped %.2f points in %d days - continuing evaluation",
+			engagementScore, EngagementScoreThreshold, trend.RecentDrop, ScoreDropTriggerDays)
+	} else {
+		debugLog(DEBUG_INFO, "Engagement score %.2f is BELOW threshold %.2f - continuing evaluation",
 			engagementScore, EngagementScoreThreshold)
-		return false
 	}
 
-	debugLog(DEBUG_INFO, "Engagement score %.2f is BELOW threshold %.2f - continuing evaluation",
-		engagementScore, EngagementScoreThreshold)
-
 	// Check if we've sent an email recently
 	if user.LastEmailDate != nil {
 		lastEmailDate, err := time.Parse(time.RFC3339, *user.LastEmailDate)
@@ -551,10 +949,31 @@ func shouldGenerateEmail(user User, engagementScore float64) bool {
 	return true
 }
 
-// Generate an email for a user
-func generateEmail(ctx context.Context, user User, engagementScore float64) (Email, error) {
+// Generate the email selected by an assessment for its user
+func generateEmail(ctx context.Context, assessment userAssessment) (Email, error) {
+	user := assessment.User
+	breakdown := assessment.Breakdown
+	value := assessment.Value
+	offer := offerTierFor(value.ValueAtRisk)
+
+	emailType := assessment.EmailType
+	if emailType == "" {
+		emailType = EmailTypeEngagement
+	}
+
+	var prompt string
+	switch emailType {
+	case EmailTypeReturnFollowUp:
+		if assessment.ReturnedOrder == nil {
+			return Email{}, fmt.Errorf("return follow-up for user %s has no returned order", user.UserID)
+		}
+		prompt = returnFollowUpPrompt(user, *assessment.ReturnedOrder, offer)
+	default:
+		prompt = engagementPrompt(user, offer)
+	}
+
 	// Generate a subject and content using OpenRouter
-	subject, content, err := generateEmailContent(ctx, user)
+	subject, content, err := generateEmailContent(ctx, user, prompt)
 	if err != nil {
 		return Email{}, fmt.Errorf("error generating email content: %w", err)
 	}
@@ -566,7 +985,15 @@ func generateEmail(ctx context.Context, user User, engagementScore float64) (Ema
 		Subject:               subject,
 		Content:               content,
 		GeneratedAt:           time.Now().Format(time.RFC3339),
-		EngagementScoreAtTime: engagementScore,
+		EngagementScoreAtTime: breakdown.Score,
+		ScorerName:            breakdown.Scorer,
+		ScorerVersion:         breakdown.ScorerVersion,
+		ScoreBreakdown:        &breakdown,
+		RFMCode:               user.RFMCode,
+		RFMSegment:            user.RFMSegment,
+		ValueAtRisk:           value.ValueAtRisk,
+		OfferTier:             value.OfferTier,
+		EmailType:             emailType,
 		Status:                EmailStatusGenerated,
 		CreatedAt:             time.Now().Format(time.RFC3339),
 	}
@@ -574,30 +1001,26 @@ func generateEmail(ctx context.Context, user User, engagementScore float64) (Ema
 	return email, nil
 }
 
-// Generate email content using OpenRouter
-func generateEmailContent(ctx context.Context, user User) (string, string, error) {
-	// Add panic recovery to catch and log any crashes
-	defer recoverPanic()
-
-	debugLog(DEBUG_INFO, "Generating email content for user: %s", user.UserID)
-
-	// Create a prompt for OpenRouter
+// Build the prompt for the engagement email
+func engagementPrompt(user User, offer OfferTier) string {
 	debugLog(DEBUG_INFO, "Creating prompt with user data: Name=%s, LastOrderDate=%s, OrderCount=%d, AverageOrderValue=%.2f",
 		user.Name, user.LastOrderDate, user.OrderCount, user.AverageOrderValue)
 
-	prompt := fmt.Sprintf(`
+	return fmt.Sprintf(`
 Generate a personalized email for a Stitch Fix customer with the following information:
 - Name: %s
 - Last order date: %s
 - Number of orders: %d
 - Average order value: $%.2f
-- Preferred categories: %v
+- Preferred categories (strongest first): %s
+- Categories they used to buy but haven't recently: %s
 
 The email should:
 1. Be friendly and personalized
 2. Mention their previous order history
-3. Suggest new items based on their preferred categories
+3. Suggest new items based on their preferred categories, and invite them back to any lapsed categories
 4. Include a clear call to action to visit the Stitch Fix website
+5. Follow this offer guidance: %s
 
 YOU MUST RESPOND WITH VALID JSON in the following format:
 {
@@ -606,7 +1029,16 @@ YOU MUST RESPOND WITH VALID JSON in the following format:
 }
 
 The content should be valid HTML with paragraph tags.
-`, user.Name, user.LastOrderDate, user.OrderCount, user.AverageOrderValue, user.PreferredCategories)
+`, user.Name, user.LastOrderDate, user.OrderCount, user.AverageOrderValue,
+		promptList(user.PreferredCategories), promptList(user.LapsedCategories), offer.Guidance)
+}
+
+// Generate email content for a prompt using OpenRouter
+func generateEmailContent(ctx context.Context, user User, prompt string) (subject string, content string, err error) {
+	// Add panic recovery to catch and log any crashes
+	defer recoverPanicAsError(&err)
+
+	debugLog(DEBUG_INFO, "Generating email content for user: %s", user.UserID)
 
 	// Use a model that better supports structured output
 	model := "openai/gpt-4o"
@@ -686,7 +1118,7 @@ The content should be valid HTML with paragraph tags.
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		debugLog(DEBUG_ERROR, "Error sending HTTP request: %v", err)
-		return "", "", fmt.Errorf("error sending HTTP request: %w", err)
+		return "", "", retryableError(fmt.Errorf("error sending HTTP request: %w", err))
 	}
 	defer resp.Body.Close()
 
@@ -701,7 +1133,7 @@ The content should be valid HTML with paragraph tags.
 	// Check the status code
 	if resp.StatusCode != http.StatusOK {
 		debugLog(DEBUG_ERROR, "Error from OpenRouter API (status %d): %s", resp.StatusCode, string(responseBody))
-		return "", "", fmt.Errorf("error from OpenRouter API: %s", string(responseBody))
+		return "", "", &openRouterStatusError{StatusCode: resp.StatusCode, Body: string(responseBody)}
 	}
 
 	// Parse the response
@@ -770,6 +1202,21 @@ func saveEmailToDynamoDB(ctx context.Context, email Email) error {
 		"engagementScoreAtTime": &types.AttributeValueMemberN{
 			Value: strconv.FormatFloat(email.EngagementScoreAtTime, 'f', 2, 64),
 		},
+		"scorerName": &types.AttributeValueMemberS{
+			Value: email.ScorerName,
+		},
+		"scorerVersion": &types.AttributeValueMemberS{
+			Value: email.ScorerVersion,
+		},
+		"valueAtRisk": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(email.ValueAtRisk, 'f', 2, 64),
+		},
+		"offerTier": &types.AttributeValueMemberS{
+			Value: email.OfferTier,
+		},
+		"emailType": &types.AttributeValueMemberS{
+			Value: email.EmailType,
+		},
 		"status": &types.AttributeValueMemberS{
 			Value: email.Status,
 		},
@@ -778,6 +1225,18 @@ func saveEmailToDynamoDB(ctx context.Context, email Email) error {
 		},
 	}
 
+	if email.ScoreBreakdown != nil {
+		item["engagementScoreBreakdown"] = breakdownToAttributeValue(*email.ScoreBreakdown)
+	}
+	if email.RFMSegment != "" {
+		item["rfmCode"] = &types.AttributeValueMemberS{
+			Value: email.RFMCode,
+		}
+		item["rfmSegment"] = &types.AttributeValueMemberS{
+			Value: email.RFMSegment,
+		}
+	}
+
 	// Put the item in DynamoDB
 	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(EmailsTableName),
@@ -791,15 +1250,15 @@ func saveEmailToDynamoDB(ctx context.Context, email Email) error {
 }
 
 // Send an email (mock implementation - just updates status)
-func sendEmail(ctx context.Context, email Email, user User) error {
+func sendEmail(ctx context.Context, email Email, user User) (err error) {
 	// Add panic recovery to catch and log any crashes
-	defer recoverPanic()
+	defer recoverPanicAsError(&err)
 
 	debugLog(DEBUG_INFO, "Skipping actual email sending (SES) - this is a demo")
 
 	// Update the email status to sent
 	debugLog(DEBUG_INFO, "Updating email status to SENT in DynamoDB")
-	if err := updateEmailStatus(ctx, email.EmailID, EmailStatusSent); err != nil {
+	if _, err := updateEmailStatus(ctx, emailStatusUpdate{EmailID: email.EmailID, Status: EmailStatusSent}); err != nil {
 		debugLog(DEBUG_ERROR, "Error updating email status: %v", err)
 		return fmt.Errorf("error updating email status: %w", err)
 	}
@@ -808,54 +1267,73 @@ func sendEmail(ctx context.Context, email Email, user User) error {
 	return nil
 }
 
-// Update the status of an email in DynamoDB
-func updateEmailStatus(ctx context.Context, emailID, status string) error {
-	// Update the item in DynamoDB
-	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(EmailsTableName),
-		Key: map[string]types.AttributeValue{
-			"emailId": &types.AttributeValueMemberS{
-				Value: emailID,
-			},
+// Update a user's engagement score in DynamoDB, along with the scorer that produced it, its breakdown and trend,
+// and the user's RFM segment, value and category profile
+func updateUserEngagementScore(ctx context.Context, assessment userAssessment) error {
+	breakdown := assessment.Breakdown
+	rfm := assessment.RFM
+	value := assessment.Value
+
+	updateExpression := "SET engagementScore = :engagementScore, engagementScorer = :scorer, " +
+		"engagementScorerVersion = :scorerVersion, engagementScoreBreakdown = :breakdown, " +
+		"engagementScoreTrend = :trend, rfmCode = :rfmCode, rfmSegment = :rfmSegment, " +
+		"expectedValue = :expectedValue, valueAtRisk = :valueAtRisk, " +
+		"updatedAt = :updatedAt, lastProcessorWriteAt = :updatedAt"
+	values := map[string]types.AttributeValue{
+		":engagementScore": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(breakdown.Score, 'f', 2, 64),
 		},
-		UpdateExpression: aws.String("SET #status = :status"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
+		":scorer": &types.AttributeValueMemberS{
+			Value: breakdown.Scorer,
 		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status": &types.AttributeValueMemberS{
-				Value: status,
-			},
+		":scorerVersion": &types.AttributeValueMemberS{
+			Value: breakdown.ScorerVersion,
+		},
+		":breakdown": breakdownToAttributeValue(breakdown),
+		":trend":     trendToAttributeValue(assessment.Trend),
+		":rfmCode": &types.AttributeValueMemberS{
+			Value: rfm.Code(),
+		},
+		":rfmSegment": &types.AttributeValueMemberS{
+			Value: rfm.Segment,
+		},
+		":expectedValue": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(value.ExpectedValue, 'f', 2, 64),
+		},
+		":valueAtRisk": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(value.ValueAtRisk, 'f', 2, 64),
+		},
+		":updatedAt": &types.AttributeValueMemberS{
+			Value: time.Now().Format(time.RFC3339),
 		},
-	})
-	if err != nil {
-		return fmt.Errorf("error updating item in DynamoDB: %w", err)
 	}
 
-	return nil
-}
+	// Without order item categories, hand-maintained preferred categories are left alone
+	if categories := assessment.Categories; len(categories.Affinity) > 0 {
+		updateExpression += ", categoryAffinity = :categoryAffinity, preferredCategories = :preferredCategories, " +
+			"lapsedCategories = :lapsedCategories"
+		values[":categoryAffinity"] = numberMapAttributeValue(categories.Affinity)
+		values[":preferredCategories"] = stringListAttributeValue(categories.Preferred)
+		values[":lapsedCategories"] = stringListAttributeValue(categories.Lapsed)
+	}
 
-// Update a user's engagement score in DynamoDB
-func updateUserEngagementScore(ctx context.Context, userID string, engagementScore float64) error {
 	// Update the item in DynamoDB
 	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(UsersTableName),
 		Key: map[string]types.AttributeValue{
 			"userId": &types.AttributeValueMemberS{
-				Value: userID,
-			},
-		},
-		UpdateExpression: aws.String("SET engagementScore = :engagementScore, updatedAt = :updatedAt"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":engagementScore": &types.AttributeValueMemberN{
-				Value: strconv.FormatFloat(engagementScore, 'f', 2, 64),
-			},
-			":updatedAt": &types.AttributeValueMemberS{
-				Value: time.Now().Format(time.RFC3339),
+				Value: assessment.User.UserID,
 			},
 		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_exists(userId)"),
+		ExpressionAttributeValues: values,
 	})
 	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: %s", errUserNotFound, assessment.User.UserID)
+		}
 		return fmt.Errorf("error updating item in DynamoDB: %w", err)
 	}
 
@@ -872,7 +1350,8 @@ func updateUserLastEmailDate(ctx context.Context, userID string) error {
 				Value: userID,
 			},
 		},
-		UpdateExpression: aws.String("SET lastEmailDate = :lastEmailDate, updatedAt = :updatedAt"),
+		UpdateExpression:    aws.String("SET lastEmailDate = :lastEmailDate, updatedAt = :updatedAt, lastProcessorWriteAt = :updatedAt"),
+		ConditionExpression: aws.String("attribute_exists(userId)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":lastEmailDate": &types.AttributeValueMemberS{
 				Value: time.Now().Format(time.RFC3339),
@@ -883,6 +1362,10 @@ func updateUserLastEmailDate(ctx context.Context, userID string) error {
 		},
 	})
 	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: %s", errUserNotFound, userID)
+		}
 		return fmt.Errorf("error updating item in DynamoDB: %w", err)
 	}
 
@@ -906,41 +1389,48 @@ func getUserFromDynamoDB(ctx context.Context, userID string) (User, error) {
 
 	// Check if the item exists
 	if result.Item == nil {
-		return User{}, fmt.Errorf("user not found: %s", userID)
+		return User{}, fmt.Errorf("%w: %s", errUserNotFound, userID)
 	}
 
-	// Parse the item
-	user := User{
-		UserID: userID,
+	return userFromItem(result.Item), nil
+}
+
+// Convert a DynamoDB users table item to a User
+func userFromItem(item map[string]types.AttributeValue) User {
+	var user User
+
+	// Parse the user ID
+	if userID, ok := item["userId"].(*types.AttributeValueMemberS); ok {
+		user.UserID = userID.Value
 	}
 
 	// Parse the email
-	if email, ok := result.Item["email"].(*types.AttributeValueMemberS); ok {
+	if email, ok := item["email"].(*types.AttributeValueMemberS); ok {
 		user.Email = email.Value
 	}
 
 	// Parse the name
-	if name, ok := result.Item["name"].(*types.AttributeValueMemberS); ok {
+	if name, ok := item["name"].(*types.AttributeValueMemberS); ok {
 		user.Name = name.Value
 	}
 
 	// Parse the last order date
-	if lastOrderDate, ok := result.Item["lastOrderDate"].(*types.AttributeValueMemberS); ok {
+	if lastOrderDate, ok := item["lastOrderDate"].(*types.AttributeValueMemberS); ok {
 		user.LastOrderDate = lastOrderDate.Value
 	}
 
 	// Parse the order count
-	if orderCount, ok := result.Item["orderCount"].(*types.AttributeValueMemberN); ok {
+	if orderCount, ok := item["orderCount"].(*types.AttributeValueMemberN); ok {
 		user.OrderCount, _ = strconv.Atoi(orderCount.Value)
 	}
 
 	// Parse the average order value
-	if aov, ok := result.Item["averageOrderValue"].(*types.AttributeValueMemberN); ok {
+	if aov, ok := item["averageOrderValue"].(*types.AttributeValueMemberN); ok {
 		user.AverageOrderValue, _ = strconv.ParseFloat(aov.Value, 64)
 	}
 
 	// Parse the preferred categories
-	if categories, ok := result.Item["preferredCategories"].(*types.AttributeValueMemberL); ok {
+	if categories, ok := item["preferredCategories"].(*types.AttributeValueMemberL); ok {
 		for _, category := range categories.Value {
 			if categoryStr, ok := category.(*types.AttributeValueMemberS); ok {
 				user.PreferredCategories = append(user.PreferredCategories, categoryStr.Value)
@@ -949,27 +1439,94 @@ func getUserFromDynamoDB(ctx context.Context, userID string) (User, error) {
 	}
 
 	// Parse the engagement score
-	if engagementScore, ok := result.Item["engagementScore"].(*types.AttributeValueMemberN); ok {
+	if engagementScore, ok := item["engagementScore"].(*types.AttributeValueMemberN); ok {
 		score, _ := strconv.ParseFloat(engagementScore.Value, 64)
 		user.EngagementScore = &score
 	}
 
+	// Parse the scorer that produced the engagement score
+	if scorer, ok := item["engagementScorer"].(*types.AttributeValueMemberS); ok {
+		user.EngagementScorer = scorer.Value
+	}
+	if scorerVersion, ok := item["engagementScorerVersion"].(*types.AttributeValueMemberS); ok {
+		user.EngagementScorerVersion = scorerVersion.Value
+	}
+	if breakdown, ok := breakdownFromAttributeValue(item["engagementScoreBreakdown"]); ok {
+		user.EngagementScoreBreakdown = &breakdown
+	}
+	if trend, ok := item["engagementScoreTrend"].(*types.AttributeValueMemberM); ok {
+		user.EngagementScoreTrend = &ScoreTrend{
+			Delta30d:   numberAttribute(trend.Value, "delta30d"),
+			Velocity:   numberAttribute(trend.Value, "velocity"),
+			RecentDrop: numberAttribute(trend.Value, "recentDrop"),
+			Samples:    int(numberAttribute(trend.Value, "samples")),
+		}
+	}
+
 	// Parse the last email date
-	if lastEmailDate, ok := result.Item["lastEmailDate"].(*types.AttributeValueMemberS); ok {
+	if lastEmailDate, ok := item["lastEmailDate"].(*types.AttributeValueMemberS); ok {
 		user.LastEmailDate = &lastEmailDate.Value
 	}
 
 	// Parse the created at
-	if createdAt, ok := result.Item["createdAt"].(*types.AttributeValueMemberS); ok {
+	if createdAt, ok := item["createdAt"].(*types.AttributeValueMemberS); ok {
 		user.CreatedAt = createdAt.Value
 	}
 
 	// Parse the updated at
-	if updatedAt, ok := result.Item["updatedAt"].(*types.AttributeValueMemberS); ok {
+	if updatedAt, ok := item["updatedAt"].(*types.AttributeValueMemberS); ok {
 		user.UpdatedAt = updatedAt.Value
 	}
 
-	return user, nil
+	// Parse the order history
+	if history, ok := item["orderHistory"].(*types.AttributeValueMemberM); ok {
+		user.OrderHistory = orderHistoryFromAttributeValue(history)
+	}
+	user.OrderValueTotal = numberAttribute(item, "orderValueTotal")
+	user.OrderHistoryCompactedThrough = stringAttribute(item, "orderHistoryCompactedThrough")
+	user.OrderHistoryLegacyThrough = stringAttribute(item, "orderHistoryLegacyThrough")
+	if _, ok := item["orderValueTotal"]; !ok && user.OrderHistoryLegacyThrough == "" {
+		// The aggregates are still the backend's, covering orders through the last order date
+		user.OrderHistoryLegacyThrough = normalizeOrderDate(user.LastOrderDate)
+	}
+	if followUp, ok := item["returnFollowUpOrderId"].(*types.AttributeValueMemberS); ok {
+		user.ReturnFollowUpOrderID = followUp.Value
+	}
+
+	// Parse the RFM segment
+	if rfmCode, ok := item["rfmCode"].(*types.AttributeValueMemberS); ok {
+		user.RFMCode = rfmCode.Value
+	}
+	if rfmSegment, ok := item["rfmSegment"].(*types.AttributeValueMemberS); ok {
+		user.RFMSegment = rfmSegment.Value
+	}
+
+	// Parse the category profile
+	user.CategoryAffinity = numberMapFromAttributeValue(item["categoryAffinity"])
+	if categories, ok := item["lapsedCategories"].(*types.AttributeValueMemberL); ok {
+		for _, category := range categories.Value {
+			if categoryStr, ok := category.(*types.AttributeValueMemberS); ok {
+				user.LapsedCategories = append(user.LapsedCategories, categoryStr.Value)
+			}
+		}
+	}
+
+	// Parse the customer value
+	if expectedValue, ok := item["expectedValue"].(*types.AttributeValueMemberN); ok {
+		value, _ := strconv.ParseFloat(expectedValue.Value, 64)
+		user.ExpectedValue = &value
+	}
+	if valueAtRisk, ok := item["valueAtRisk"].(*types.AttributeValueMemberN); ok {
+		value, _ := strconv.ParseFloat(valueAtRisk.Value, 64)
+		user.ValueAtRisk = &value
+	}
+
+	// Parse the processor write marker
+	if lastProcessorWriteAt, ok := item["lastProcessorWriteAt"].(*types.AttributeValueMemberS); ok {
+		user.LastProcessorWriteAt = &lastProcessorWriteAt.Value
+	}
+
+	return user
 }
 
 // Generate a UUID
@@ -981,22 +1538,55 @@ func generateUUID() string {
 // Panic handler to catch and log crashes
 func recoverPanic() {
 	if r := recover(); r != nil {
-		// Get stack trace
-		buf := make([]byte, 4096)
-		n := runtime.Stack(buf, false)
-		stackTrace := string(buf[:n])
-
-		// Log the panic with stack trace
-		debugLog(DEBUG_FATAL, "PANIC RECOVERED: %v\n\nStack Trace:\n%s", r, stackTrace)
+		logPanic(r)
 
 		// Re-panic after logging if needed
 		// panic(r)
 	}
 }
 
+// Panic handler for functions that return an error. The panic is logged and
+// returned as a retryable error, so the message is redelivered (and ends up
+// in the DLQ) instead of being counted as processed.
+func recoverPanicAsError(err *error) {
+	if r := recover(); r != nil {
+		logPanic(r)
+		*err = retryableError(fmt.Errorf("panic: %v", r))
+	}
+}
+
+// Log a recovered panic with its stack trace
+func logPanic(r interface{}) {
+	// Get stack trace
+	buf := make([]byte, 4096)
+	n := runtime.Stack(buf, false)
+	stackTrace := string(buf[:n])
+
+	// Log the panic with stack trace
+	debugLog(DEBUG_FATAL, "PANIC RECOVERED: %v\n\nStack Trace:\n%s", r, stackTrace)
+}
+
 func main() {
 	// Add import for runtime package at the top of the file
 	defer recoverPanic()
-	debugLog(DEBUG_INFO, "Starting email processor Lambda")
-	lambda.Start(handler)
+
+	// Offline commands run outside Lambda
+	if len(os.Args) > 1 && os.Args[1] == churnTrainCommand {
+		if err := runChurnTrain(os.Args[2:]); err != nil {
+			log.Fatalf("churn-train failed: %v", err)
+		}
+		return
+	}
+
+	initLambda()
+	switch mode := os.Getenv("PROCESSOR_MODE"); mode {
+	case ProcessorModeSweep:
+		debugLog(DEBUG_INFO, "Starting email processor Lambda in sweep mode")
+		lambda.Start(sweepHandler)
+	case "", ProcessorModeQueue:
+		debugLog(DEBUG_INFO, "Starting email processor Lambda")
+		lambda.Start(queueHandler)
+	default:
+		log.Fatalf("Unknown PROCESSOR_MODE: %s", mode)
+	}
 }
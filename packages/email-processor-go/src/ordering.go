@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Event ordering settings
+const (
+	// How long a user's high-water mark is kept. Matches the queue's message
+	// retention, so no delivery can be older than an expired mark.
+	UserEventMarkRetention = 14 * 24 * time.Hour
+
+	// State table key prefix of the per-user high-water marks
+	userEventMarkStatePrefix = "user#mark#"
+
+	// SQS attribute holding the message group of a FIFO queue message
+	sqsMessageGroupIDAttribute = "MessageGroupId"
+)
+
+// userEventMark is the newest user snapshot seen for a user, ordered by the
+// snapshot's updatedAt and then by the event timestamp. Both are kept to the
+// second, the precision of the processor's own updatedAt, so writers with
+// finer timestamps don't look newer than a processor write in the same second.
+type userEventMark struct {
+	UpdatedAt time.Time
+	EventAt   time.Time
+}
+
+// Build the high-water mark a user snapshot event would move to. The second
+// result is false if the event carries no usable timestamps. A snapshot
+// without updatedAt is ordered by the event timestamp alone.
+func userEventMarkOf(user User, event Event) (userEventMark, bool) {
+	eventAt, eventErr := time.Parse(time.RFC3339Nano, event.Timestamp)
+	updatedAt, updatedErr := time.Parse(time.RFC3339Nano, user.UpdatedAt)
+	switch {
+	case eventErr != nil && updatedErr != nil:
+		return userEventMark{}, false
+	case updatedErr != nil:
+		updatedAt = eventAt
+	case eventErr != nil:
+		eventAt = updatedAt
+	}
+	return userEventMark{UpdatedAt: updatedAt.Truncate(time.Second), EventAt: eventAt.Truncate(time.Second)}, true
+}
+
+// Advance the user's high-water mark to a snapshot event, unless a newer
+// snapshot was already seen. Returns false if the event is stale and must not
+// be processed. A snapshot equal to the mark is not stale, so a redelivery
+// after a failed attempt is processed again. Always returns true when the
+// processor state table isn't configured.
+func advanceUserEventMark(ctx context.Context, user User, event Event) (bool, error) {
+	if ProcessorStateTableName == "" {
+		return true, nil
+	}
+	mark, ok := userEventMarkOf(user, event)
+	if !ok {
+		debugLog(DEBUG_WARNING, "%s event for user %s has no timestamps, can't check its order", event.Type, user.UserID)
+		return true, nil
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: userEventMarkStatePrefix + user.UserID,
+			},
+		},
+		UpdateExpression: aws.String("SET userId = :userId, markUpdatedAt = :updatedAt, markEventAt = :eventAt, expiresAt = :expiresAt"),
+		ConditionExpression: aws.String("attribute_not_exists(stateId) OR markUpdatedAt < :updatedAt OR " +
+			"(markUpdatedAt = :updatedAt AND markEventAt <= :eventAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{
+				Value: user.UserID,
+			},
+			":updatedAt": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(mark.UpdatedAt.Unix(), 10),
+			},
+			":eventAt": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(mark.EventAt.Unix(), 10),
+			},
+			":expiresAt": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(UserEventMarkRetention).Unix(), 10),
+			},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			current := userEventMark{
+				UpdatedAt: time.Unix(int64(numberAttribute(conditionErr.Item, "markUpdatedAt")), 0).UTC(),
+				EventAt:   time.Unix(int64(numberAttribute(conditionErr.Item, "markEventAt")), 0).UTC(),
+			}
+			debugLog(DEBUG_INFO, "Stale %s for user %s (updatedAt %s, event %s), already saw updatedAt %s, event %s",
+				event.Type, user.UserID, mark.UpdatedAt.Format(time.RFC3339), mark.EventAt.Format(time.RFC3339),
+				current.UpdatedAt.Format(time.RFC3339), current.EventAt.Format(time.RFC3339))
+			return false, nil
+		}
+		return false, fmt.Errorf("error advancing event mark for user %s: %w", user.UserID, err)
+	}
+
+	return true, nil
+}
+
+// Remove a user's high-water mark
+func deleteUserEventMark(ctx context.Context, userID string) error {
+	_, err := dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: userEventMarkStatePrefix + userID,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting event mark for user %s: %w", userID, err)
+	}
+
+	return nil
+}
+
+// Message group of an SQS message, or "" if it didn't come from a FIFO queue
+func messageGroupID(message events.SQSMessage) string {
+	return message.Attributes[sqsMessageGroupIDAttribute]
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserEventMarkOf(t *testing.T) {
+	second := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		updatedAt string
+		timestamp string
+		want      userEventMark
+		wantOK    bool
+	}{
+		{
+			name:      "both timestamps",
+			updatedAt: "2026-03-31T12:00:00Z",
+			timestamp: "2026-03-31T12:00:05Z",
+			want:      userEventMark{UpdatedAt: second, EventAt: second.Add(5 * time.Second)},
+			wantOK:    true,
+		},
+		{
+			name:      "milliseconds are dropped",
+			updatedAt: "2026-03-31T12:00:00.750Z",
+			timestamp: "2026-03-31T12:00:01.250Z",
+			want:      userEventMark{UpdatedAt: second, EventAt: second.Add(time.Second)},
+			wantOK:    true,
+		},
+		{
+			name:      "no updatedAt orders by the event timestamp",
+			timestamp: "2026-03-31T12:00:00.100Z",
+			want:      userEventMark{UpdatedAt: second, EventAt: second},
+			wantOK:    true,
+		},
+		{
+			name:      "no event timestamp",
+			updatedAt: "2026-03-31T12:00:00Z",
+			want:      userEventMark{UpdatedAt: second, EventAt: second},
+			wantOK:    true,
+		},
+		{
+			name: "no timestamps",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := userEventMarkOf(User{UpdatedAt: tt.updatedAt}, Event{Timestamp: tt.timestamp})
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !got.UpdatedAt.Equal(tt.want.UpdatedAt) || !got.EventAt.Equal(tt.want.EventAt) {
+				t.Errorf("mark = %v/%v, want %v/%v", got.UpdatedAt, got.EventAt, tt.want.UpdatedAt, tt.want.EventAt)
+			}
+		})
+	}
+}
+
+func TestIsSelfInducedUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		updatedAt   string
+		processorAt *string
+		want        bool
+	}{
+		{"processor write", "2026-03-31T12:00:00Z", stringPtr("2026-03-31T12:00:00Z"), true},
+		{"other writer since", "2026-03-31T12:00:00.500Z", stringPtr("2026-03-31T12:00:00Z"), false},
+		{"never written by the processor", "2026-03-31T12:00:00Z", nil, false},
+		{"no updatedAt", "", stringPtr(""), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{UpdatedAt: tt.updatedAt, LastProcessorWriteAt: tt.processorAt}
+			if got := isSelfInducedUpdate(user); got != tt.want {
+				t.Errorf("isSelfInducedUpdate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Order status values (see OrderStatus in the shared models)
+const (
+	OrderStatusCreated    = "CREATED"
+	OrderStatusProcessing = "PROCESSING"
+	OrderStatusShipped    = "SHIPPED"
+	OrderStatusDelivered  = "DELIVERED"
+	OrderStatusCancelled  = "CANCELLED"
+	OrderStatusReturned   = "RETURNED"
+)
+
+// Statuses in the order an order moves through them. An event never moves a
+// stored order back to an earlier status, so a replayed or late ORDER_CREATED
+// or ORDER_UPDATED can't undo a cancellation or return. Unknown statuses rank
+// with CREATED.
+var orderStatusRank = map[string]int{
+	OrderStatusCreated:    0,
+	OrderStatusProcessing: 1,
+	OrderStatusShipped:    2,
+	OrderStatusDelivered:  3,
+	OrderStatusCancelled:  4,
+	OrderStatusReturned:   5,
+}
+
+// Most orders kept in a user's order history. Older orders are compacted away
+// so the user row stays well below DynamoDB's 400KB item limit.
+const MaxOrderHistoryEntries = 100
+
+// Number of times an order is re-applied after losing a race with another
+// write to the same order entry
+const orderApplyAttempts = 3
+
+// OrderHistoryEntry is what the processor keeps about each order on the user row
+type OrderHistoryEntry struct {
+	OrderDate string `json:"orderDate"`
+	// Spend per item category in the order
+	Categories map[string]float64 `json:"categories,omitempty"`
+	TotalValue float64            `json:"totalValue"`
+	Status     string             `json:"status"`
+	// Incremented on every change, so concurrent writers can't both apply a
+	// change on top of the same entry
+	Revision int `json:"revision"`
+}
+
+// Check whether an order counts towards the user's aggregates
+func (e OrderHistoryEntry) counted() bool {
+	return e.Status != OrderStatusCancelled && e.Status != OrderStatusReturned
+}
+
+// Check whether an entry may replace the stored one, i.e. its status is not
+// earlier than the stored status
+func (e OrderHistoryEntry) supersedes(stored OrderHistoryEntry) bool {
+	return orderStatusRank[e.Status] >= orderStatusRank[stored.Status]
+}
+
+// Check whether two entries hold the same order data, ignoring the revision
+func (e OrderHistoryEntry) equal(other OrderHistoryEntry) bool {
+	if e.OrderDate != other.OrderDate || e.Status != other.Status || !scoresEqual(e.TotalValue, other.TotalValue) ||
+		len(e.Categories) != len(other.Categories) {
+		return false
+	}
+	for category, spend := range e.Categories {
+		if otherSpend, ok := other.Categories[category]; !ok || !scoresEqual(spend, otherSpend) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply an order event to the user's order history and aggregates. The order
+// count and value total are adjusted atomically by the difference between the
+// stored entry and the new one, conditional on the entry not having changed
+// since it was read, so replays and concurrent deliveries can't double count.
+// The user is updated in place.
+func applyOrder(ctx context.Context, user *User, order Order) error {
+	orderDate := order.OrderDate
+	if orderDate == "" {
+		orderDate = order.CreatedAt
+	}
+	if order.OrderID == "" || orderDate == "" {
+		debugLog(DEBUG_WARNING, "Order for user %s has no orderId or date, not applying it", user.UserID)
+		return nil
+	}
+	parsedDate, err := time.Parse(time.RFC3339, orderDate)
+	if err != nil {
+		debugLog(DEBUG_WARNING, "Order %s has an invalid date %q, not applying it", order.OrderID, orderDate)
+		return nil
+	}
+
+	entry := OrderHistoryEntry{
+		OrderDate:  parsedDate.UTC().Format(time.RFC3339),
+		Categories: orderCategorySpend(order),
+		TotalValue: order.TotalValue,
+		Status:     order.Status,
+	}
+	if entry.Status == "" {
+		entry.Status = OrderStatusCreated
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := applyOrderEntry(ctx, user, order.OrderID, entry)
+		var conditionErr *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionErr) {
+			return err
+		}
+		if attempt == orderApplyAttempts {
+			return retryableError(fmt.Errorf("order %s kept changing while being applied: %w", order.OrderID, err))
+		}
+
+		// Another write changed the entry, re-read and apply on top of it
+		debugLog(DEBUG_INFO, "Order %s changed concurrently, retrying (attempt %d)", order.OrderID, attempt)
+		fresh, err := getUserFromDynamoDB(ctx, user.UserID)
+		if err != nil {
+			return err
+		}
+		*user = fresh
+	}
+}
+
+// Apply one attempt of an order entry change on top of the user as read
+func applyOrderEntry(ctx context.Context, user *User, orderID string, entry OrderHistoryEntry) error {
+	existing, exists := user.OrderHistory[orderID]
+	if exists && existing.equal(entry) {
+		// A replay, possibly of an event whose derived aggregates weren't written
+		debugLog(DEBUG_INFO, "Order %s is already applied with status %s", orderID, entry.Status)
+		return syncDerivedOrderAggregates(ctx, user)
+	}
+	if exists && !entry.supersedes(existing) {
+		debugLog(DEBUG_INFO, "Ignoring %s for order %s, which is already %s", entry.Status, orderID, existing.Status)
+		return syncDerivedOrderAggregates(ctx, user)
+	}
+
+	// Orders the backend counted before the order history have no entry, so
+	// they are applied on top of the entry the backend's count implies
+	legacyThrough := user.OrderHistoryLegacyThrough
+	countedByBackend := !exists && legacyThrough != "" && entry.OrderDate <= legacyThrough
+	if countedByBackend {
+		debugLog(DEBUG_INFO, "Order %s from %s was counted before the order history", orderID, entry.OrderDate)
+		existing = OrderHistoryEntry{
+			OrderDate:  entry.OrderDate,
+			TotalValue: entry.TotalValue,
+			Status:     OrderStatusCreated,
+		}
+	}
+
+	// Orders older than the compacted part of the history may already be
+	// counted, so they are not applied again
+	var removed []string
+	compactedThrough := user.OrderHistoryCompactedThrough
+	if !exists {
+		// Dates are all normalized to UTC RFC3339, so they compare as strings
+		if compactedThrough != "" && entry.OrderDate <= compactedThrough {
+			debugLog(DEBUG_INFO, "Order %s from %s is older than the compacted order history, not applying it", orderID, entry.OrderDate)
+			return nil
+		}
+
+		var keep bool
+		var through string
+		removed, keep, through = compactOrderHistory(user.OrderHistory, orderID, entry)
+		if !keep {
+			debugLog(DEBUG_INFO, "Order %s from %s is older than the %d orders in the history, not applying it",
+				orderID, entry.OrderDate, MaxOrderHistoryEntries)
+			return nil
+		}
+		if through > compactedThrough {
+			compactedThrough = through
+		}
+	}
+
+	// Work out what the stored entry contributed to the aggregates
+	countDelta, valueDelta := 0, 0.0
+	if (exists || countedByBackend) && existing.counted() {
+		countDelta--
+		valueDelta -= existing.TotalValue
+	}
+	if entry.counted() {
+		countDelta++
+		valueDelta += entry.TotalValue
+	}
+	entry.Revision = existing.Revision + 1
+
+	if user.OrderHistory == nil {
+		if err := ensureOrderHistory(ctx, user.UserID); err != nil {
+			return err
+		}
+	}
+
+	// Users from before the processor kept a value total start from the
+	// total implied by their average
+	legacyTotal := user.AverageOrderValue * float64(user.OrderCount)
+
+	condition := "attribute_exists(userId) AND attribute_not_exists(orderHistory.#orderId)"
+	values := map[string]types.AttributeValue{
+		":entry": orderHistoryEntryToAttributeValue(entry),
+		":countDelta": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(countDelta),
+		},
+		":valueDelta": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(valueDelta, 'f', 2, 64),
+		},
+		":legacyTotal": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(legacyTotal, 'f', 2, 64),
+		},
+		":updatedAt": &types.AttributeValueMemberS{
+			Value: time.Now().Format(time.RFC3339),
+		},
+	}
+	if exists {
+		condition = "orderHistory.#orderId.revision = :revision"
+		values[":revision"] = &types.AttributeValueMemberN{
+			Value: strconv.Itoa(existing.Revision),
+		}
+	}
+
+	updateExpression := "SET orderHistory.#orderId = :entry, " +
+		"orderValueTotal = if_not_exists(orderValueTotal, :legacyTotal) + :valueDelta, " +
+		"updatedAt = :updatedAt, lastProcessorWriteAt = :updatedAt"
+	names := map[string]string{
+		"#orderId": orderID,
+	}
+	if legacyThrough != "" {
+		updateExpression += ", orderHistoryLegacyThrough = if_not_exists(orderHistoryLegacyThrough, :legacyThrough)"
+		values[":legacyThrough"] = &types.AttributeValueMemberS{
+			Value: legacyThrough,
+		}
+	}
+	if len(removed) > 0 {
+		updateExpression += ", orderHistoryCompactedThrough = :compactedThrough"
+		values[":compactedThrough"] = &types.AttributeValueMemberS{
+			Value: compactedThrough,
+		}
+	}
+	updateExpression += " ADD orderCount :countDelta"
+	for i, removedID := range removed {
+		if i == 0 {
+			updateExpression += " REMOVE "
+		} else {
+			updateExpression += ", "
+		}
+		name := fmt.Sprintf("#removed%d", i)
+		updateExpression += "orderHistory." + name
+		names[name] = removedID
+	}
+
+	result, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: user.UserID,
+			},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return err
+		}
+		return fmt.Errorf("error applying order %s: %w", orderID, err)
+	}
+
+	updated := userFromItem(result.Attributes)
+	debugLog(DEBUG_INFO, "Applied order %s (%s): order count %+d -> %d, value total %+.2f -> %.2f",
+		orderID, entry.Status, countDelta, updated.OrderCount, valueDelta, updated.OrderValueTotal)
+	if len(removed) > 0 {
+		debugLog(DEBUG_INFO, "Compacted %d orders through %s out of the order history of user %s",
+			len(removed), compactedThrough, user.UserID)
+	}
+
+	// Average order value and last order date can't be derived inside the
+	// update expression, so write them from the aggregates it returned
+	*user = updated
+	return syncDerivedOrderAggregates(ctx, user)
+}
+
+// Derive the average order value and last order date from the user's
+// aggregates and write them if they differ from the stored ones. The user is
+// updated in place.
+func syncDerivedOrderAggregates(ctx context.Context, user *User) error {
+	derived := *user
+	derived.AverageOrderValue = 0
+	if derived.OrderCount > 0 {
+		derived.AverageOrderValue = derived.OrderValueTotal / float64(derived.OrderCount)
+	}
+	derived.LastOrderDate = latestOrderDate(derived)
+	if scoresEqual(derived.AverageOrderValue, user.AverageOrderValue) && derived.LastOrderDate == user.LastOrderDate {
+		return nil
+	}
+
+	if err := updateDerivedOrderAggregates(ctx, derived); err != nil {
+		return err
+	}
+	*user = derived
+	return nil
+}
+
+// Pick the oldest orders to drop from a full order history to make room for a
+// new order, and the date the history is then compacted through. The new
+// order is not kept if it is older than every order that stays.
+func compactOrderHistory(history map[string]OrderHistoryEntry, orderID string, entry OrderHistoryEntry) ([]string, bool, string) {
+	overflow := len(history) + 1 - MaxOrderHistoryEntries
+	if overflow <= 0 {
+		return nil, true, ""
+	}
+
+	orderIDs := make([]string, 0, len(history)+1)
+	for id := range history {
+		orderIDs = append(orderIDs, id)
+	}
+	orderIDs = append(orderIDs, orderID)
+	dateOf := func(id string) string {
+		if id == orderID {
+			return entry.OrderDate
+		}
+		return history[id].OrderDate
+	}
+	sort.Slice(orderIDs, func(a, b int) bool {
+		if dateOf(orderIDs[a]) != dateOf(orderIDs[b]) {
+			return dateOf(orderIDs[a]) < dateOf(orderIDs[b])
+		}
+		return orderIDs[a] < orderIDs[b]
+	})
+
+	var removed []string
+	keep := true
+	for _, id := range orderIDs[:overflow] {
+		if id == orderID {
+			keep = false
+			continue
+		}
+		removed = append(removed, id)
+	}
+	return removed, keep, dateOf(orderIDs[overflow-1])
+}
+
+// Create an empty order history map if the user doesn't have one yet
+func ensureOrderHistory(ctx context.Context, userID string) error {
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:    aws.String("SET orderHistory = if_not_exists(orderHistory, :empty)"),
+		ConditionExpression: aws.String("attribute_exists(userId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":empty": &types.AttributeValueMemberM{
+				Value: map[string]types.AttributeValue{},
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: %s", errUserNotFound, userID)
+		}
+		return fmt.Errorf("error creating order history: %w", err)
+	}
+
+	return nil
+}
+
+// Write the average order value and last order date derived from the
+// aggregates. Skipped if another order changed the aggregates in the
+// meantime, since that writer derives them from newer values.
+func updateDerivedOrderAggregates(ctx context.Context, user User) error {
+	updateExpression := "SET averageOrderValue = :aov"
+	values := map[string]types.AttributeValue{
+		":aov": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(user.AverageOrderValue, 'f', 2, 64),
+		},
+		":orderCount": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(user.OrderCount),
+		},
+		":orderValueTotal": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(user.OrderValueTotal, 'f', 2, 64),
+		},
+	}
+	if user.LastOrderDate != "" {
+		updateExpression += ", lastOrderDate = :lastOrderDate"
+		values[":lastOrderDate"] = &types.AttributeValueMemberS{
+			Value: user.LastOrderDate,
+		}
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: user.UserID,
+			},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("orderCount = :orderCount AND orderValueTotal = :orderValueTotal"),
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			debugLog(DEBUG_INFO, "Order aggregates for user %s changed concurrently, leaving derived values to the newer write", user.UserID)
+			return nil
+		}
+		return fmt.Errorf("error updating derived order aggregates: %w", err)
+	}
+
+	return nil
+}
+
+// Normalize a date to UTC RFC3339, so dates compare as strings. Returns an
+// empty string for an unparsable date.
+func normalizeOrderDate(date string) string {
+	parsed, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return ""
+	}
+	return parsed.UTC().Format(time.RFC3339)
+}
+
+// The most recent date of a counted order. The stored last order date is
+// kept unless it belongs to an order that no longer counts, since it may
+// come from orders older than the order history.
+func latestOrderDate(user User) string {
+	var latest time.Time
+	if stored, err := time.Parse(time.RFC3339, user.LastOrderDate); err == nil {
+		latest = stored
+		for _, entry := range user.OrderHistory {
+			if date, err := time.Parse(time.RFC3339, entry.OrderDate); err == nil && !entry.counted() && date.Equal(stored) {
+				latest = time.Time{}
+				break
+			}
+		}
+	}
+
+	for _, entry := range user.OrderHistory {
+		if !entry.counted() {
+			continue
+		}
+		if date, err := time.Parse(time.RFC3339, entry.OrderDate); err == nil && date.After(latest) {
+			latest = date
+		}
+	}
+
+	if latest.IsZero() {
+		return user.LastOrderDate
+	}
+	return latest.UTC().Format(time.RFC3339)
+}
+
+// Convert an order history entry to a DynamoDB map attribute
+func orderHistoryEntryToAttributeValue(entry OrderHistoryEntry) types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"orderDate": &types.AttributeValueMemberS{
+			Value: entry.OrderDate,
+		},
+		"totalValue": &types.AttributeValueMemberN{
+			Value: strconv.FormatFloat(entry.TotalValue, 'f', 2, 64),
+		},
+		"status": &types.AttributeValueMemberS{
+			Value: entry.Status,
+		},
+		"revision": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(entry.Revision),
+		},
+	}
+	if len(entry.Categories) > 0 {
+		item["categories"] = numberMapAttributeValue(entry.Categories)
+	}
+	return &types.AttributeValueMemberM{Value: item}
+}
+
+// Convert the orderHistory attribute of a user item
+func orderHistoryFromAttributeValue(history *types.AttributeValueMemberM) map[string]OrderHistoryEntry {
+	entries := make(map[string]OrderHistoryEntry, len(history.Value))
+	for orderID, value := range history.Value {
+		entry, ok := value.(*types.AttributeValueMemberM)
+		if !ok {
+			continue
+		}
+		entries[orderID] = OrderHistoryEntry{
+			OrderDate:  stringAttribute(entry.Value, "orderDate"),
+			Categories: numberMapFromAttributeValue(entry.Value["categories"]),
+			TotalValue: numberAttribute(entry.Value, "totalValue"),
+			Status:     stringAttribute(entry.Value, "status"),
+			Revision:   int(numberAttribute(entry.Value, "revision")),
+		}
+	}
+	return entries
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestOrderHistoryEntrySupersedes(t *testing.T) {
+	tests := []struct {
+		stored, incoming string
+		want             bool
+	}{
+		{OrderStatusCreated, OrderStatusCreated, true},
+		{OrderStatusCreated, OrderStatusShipped, true},
+		{OrderStatusCreated, OrderStatusCancelled, true},
+		{OrderStatusDelivered, OrderStatusReturned, true},
+		{OrderStatusShipped, OrderStatusCreated, false},
+		{OrderStatusCancelled, OrderStatusCreated, false},
+		{OrderStatusCancelled, OrderStatusProcessing, false},
+		{OrderStatusReturned, OrderStatusDelivered, false},
+		{OrderStatusReturned, OrderStatusCancelled, false},
+		{"ON_HOLD", OrderStatusCreated, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stored+" to "+tt.incoming, func(t *testing.T) {
+			stored := OrderHistoryEntry{Status: tt.stored}
+			incoming := OrderHistoryEntry{Status: tt.incoming}
+			if got := incoming.supersedes(stored); got != tt.want {
+				t.Errorf("supersedes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompactOrderHistory(t *testing.T) {
+	// A full history with one order a day, order-00 being the oldest
+	full := make(map[string]OrderHistoryEntry, MaxOrderHistoryEntries)
+	for i := 0; i < MaxOrderHistoryEntries; i++ {
+		full[fmt.Sprintf("order-%02d", i)] = OrderHistoryEntry{
+			OrderDate: fmt.Sprintf("2025-%02d-%02dT00:00:00Z", i/28+1, i%28+1),
+			Status:    OrderStatusCreated,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		history     map[string]OrderHistoryEntry
+		date        string
+		wantRemoved []string
+		wantKeep    bool
+		wantThrough string
+	}{
+		{
+			name:     "room left",
+			history:  testOrderHistory(0, 30, 60),
+			date:     "2026-01-01T00:00:00Z",
+			wantKeep: true,
+		},
+		{
+			name:        "full history drops its oldest order",
+			history:     full,
+			date:        "2026-01-01T00:00:00Z",
+			wantRemoved: []string{"order-00"},
+			wantKeep:    true,
+			wantThrough: "2025-01-01T00:00:00Z",
+		},
+		{
+			name:        "new order older than the whole history is not kept",
+			history:     full,
+			date:        "2024-06-01T00:00:00Z",
+			wantKeep:    false,
+			wantThrough: "2024-06-01T00:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed, keep, through := compactOrderHistory(tt.history, "new-order", OrderHistoryEntry{OrderDate: tt.date})
+			if !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+			if keep != tt.wantKeep {
+				t.Errorf("keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if through != tt.wantThrough {
+				t.Errorf("compacted through = %q, want %q", through, tt.wantThrough)
+			}
+		})
+	}
+}
+
+func TestLatestOrderDate(t *testing.T) {
+	history := testOrderHistory(0, 30, 60)
+	entry := history["order-02"]
+	entry.Status = OrderStatusCancelled
+	history["order-02"] = entry
+
+	tests := []struct {
+		name   string
+		stored string
+		want   string
+	}{
+		{
+			name: "newest counted order",
+			want: history["order-01"].OrderDate,
+		},
+		{
+			name:   "stored date of a cancelled order is replaced",
+			stored: history["order-02"].OrderDate,
+			want:   history["order-01"].OrderDate,
+		},
+		{
+			name:   "newer stored date from before the history is kept",
+			stored: "2026-01-01T00:00:00Z",
+			want:   "2026-01-01T00:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := latestOrderDate(User{LastOrderDate: tt.stored, OrderHistory: history})
+			if got != tt.want {
+				t.Errorf("latestOrderDate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderHistoryLegacyThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]types.AttributeValue
+		want string
+	}{
+		{
+			name: "backend aggregates cover the last order date",
+			item: map[string]types.AttributeValue{
+				"lastOrderDate": &types.AttributeValueMemberS{Value: "2026-01-01T09:00:00+01:00"},
+			},
+			want: "2026-01-01T08:00:00Z",
+		},
+		{
+			name: "processor aggregates have no legacy orders",
+			item: map[string]types.AttributeValue{
+				"lastOrderDate":   &types.AttributeValueMemberS{Value: "2026-01-01T08:00:00Z"},
+				"orderValueTotal": &types.AttributeValueMemberN{Value: "120.00"},
+			},
+			want: "",
+		},
+		{
+			name: "recorded date is kept",
+			item: map[string]types.AttributeValue{
+				"lastOrderDate":             &types.AttributeValueMemberS{Value: "2026-03-01T08:00:00Z"},
+				"orderValueTotal":           &types.AttributeValueMemberN{Value: "120.00"},
+				"orderHistoryLegacyThrough": &types.AttributeValueMemberS{Value: "2026-01-01T08:00:00Z"},
+			},
+			want: "2026-01-01T08:00:00Z",
+		},
+		{
+			name: "user without orders",
+			item: map[string]types.AttributeValue{},
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := userFromItem(tt.item).OrderHistoryLegacyThrough
+			if got != tt.want {
+				t.Errorf("OrderHistoryLegacyThrough = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
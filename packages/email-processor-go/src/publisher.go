@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Stages of emailUser an EMAIL_FAILED event can come from
+const (
+	EmailStageGenerate = "generate"
+	EmailStageSave     = "save"
+	EmailStageSend     = "send"
+)
+
+// SNS topic email lifecycle events are published to (set from
+// EMAIL_EVENTS_TOPIC_ARN, events are not published when empty)
+var EmailEventsTopicArn = ""
+
+var snsClient *sns.Client
+
+// emailGeneratedPayload is the payload of a published EMAIL_GENERATED event.
+// It carries no subject or content; consumers read those from the emails table.
+type emailGeneratedPayload struct {
+	EmailID     string `json:"emailId"`
+	UserID      string `json:"userId"`
+	EmailType   string `json:"emailType"`
+	Status      string `json:"status"`
+	GeneratedAt string `json:"generatedAt"`
+}
+
+// emailSentPayload is the payload of a published EMAIL_SENT event
+type emailSentPayload struct {
+	EmailID string `json:"emailId"`
+	UserID  string `json:"userId"`
+}
+
+// emailFailedPayload is the payload of a published EMAIL_FAILED event
+type emailFailedPayload struct {
+	// Empty when generation failed, since no email exists yet
+	EmailID string `json:"emailId,omitempty"`
+	UserID  string `json:"userId"`
+	Error   string `json:"error"`
+	Stage   string `json:"stage"`
+}
+
+// Publish an event to the email events topic in the shared {type, payload,
+// timestamp} envelope. Publishing is best effort: by the time an event is
+// published the email has been saved or sent, and failing the message would
+// redeliver it and generate another email.
+func publishEmailEvent(ctx context.Context, eventType string, payload interface{}) {
+	if EmailEventsTopicArn == "" {
+		return
+	}
+
+	if err := publishEvent(ctx, EmailEventsTopicArn, eventType, payload); err != nil {
+		debugLog(DEBUG_ERROR, "Error publishing %s event: %v", eventType, err)
+		return
+	}
+	debugLog(DEBUG_INFO, "Published %s event", eventType)
+}
+
+// Publish an event to an SNS topic
+func publishEvent(ctx context.Context, topicArn, eventType string, payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshaling event payload: %w", err)
+	}
+
+	message, err := json.Marshal(Event{
+		Type:          eventType,
+		Payload:       payloadBytes,
+		SchemaVersion: DefaultEventSchemaVersion,
+		Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling event: %w", err)
+	}
+
+	_, err = snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"event-type": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(eventType),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing to SNS: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ReturnsConfig controls the return rate factor of the step and decay scorers
+type ReturnsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Orders in the history needed before the return rate is trusted
+	MinOrders int `json:"minOrders" yaml:"minOrders"`
+	// Only this many of the most recent orders make up the rate
+	WindowOrders int `json:"windowOrders" yaml:"windowOrders"`
+	// A cancelled order counts as this fraction of a returned one
+	CancelledWeight float64 `json:"cancelledWeight" yaml:"cancelledWeight"`
+	// Penalty at a return rate of 1, scaled linearly below that
+	MaxPenalty float64 `json:"maxPenalty" yaml:"maxPenalty"`
+}
+
+// Check the return rate settings when the factor is enabled
+func validateReturnsConfig(cfg ReturnsConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.MinOrders < 1 || cfg.WindowOrders < cfg.MinOrders {
+		return fmt.Errorf("returns config needs minOrders >= 1 and windowOrders >= minOrders")
+	}
+	if cfg.CancelledWeight < 0 || cfg.CancelledWeight > 1 {
+		return fmt.Errorf("returns config needs cancelledWeight between 0 and 1")
+	}
+	return nil
+}
+
+// Build the factor that penalizes users who return or cancel a large share of
+// their recent orders. The second result is false when the factor is disabled.
+func returnRateFactor(user User, cfg ReturnsConfig) (ScoreFactor, bool) {
+	if !cfg.Enabled {
+		return ScoreFactor{}, false
+	}
+
+	factor := ScoreFactor{Name: "returnRate"}
+	orders := recentOrders(user, cfg.WindowOrders)
+	if len(orders) < cfg.MinOrders {
+		factor.Detail = fmt.Sprintf("fewer than %d orders in history, no reduction", cfg.MinOrders)
+		return factor, true
+	}
+
+	returned, cancelled := 0, 0
+	for _, order := range orders {
+		switch order.Status {
+		case OrderStatusReturned:
+			returned++
+		case OrderStatusCancelled:
+			cancelled++
+		}
+	}
+
+	factor.RawInput = (float64(returned) + cfg.CancelledWeight*float64(cancelled)) / float64(len(orders))
+	factor.Contribution = -cfg.MaxPenalty * factor.RawInput
+	factor.Detail = fmt.Sprintf("%d returned and %d cancelled of the last %d orders", returned, cancelled, len(orders))
+	return factor, true
+}
+
+// orderRef is an order history entry with its order ID
+type orderRef struct {
+	OrderID string
+	OrderHistoryEntry
+}
+
+// The user's most recent orders of any status, newest first
+func recentOrders(user User, limit int) []orderRef {
+	orders := make([]orderRef, 0, len(user.OrderHistory))
+	dates := make(map[string]time.Time, len(user.OrderHistory))
+	for orderID, entry := range user.OrderHistory {
+		date, err := time.Parse(time.RFC3339, entry.OrderDate)
+		if err != nil {
+			continue
+		}
+		orders = append(orders, orderRef{OrderID: orderID, OrderHistoryEntry: entry})
+		dates[orderID] = date
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		di, dj := dates[orders[i].OrderID], dates[orders[j].OrderID]
+		if !di.Equal(dj) {
+			return di.After(dj)
+		}
+		return orders[i].OrderID < orders[j].OrderID
+	})
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders
+}
+
+// Find the user's last order if it was returned and hasn't had a follow-up email yet
+func returnFollowUpDue(user User) (orderRef, bool) {
+	orders := recentOrders(user, 1)
+	if len(orders) == 0 || orders[0].Status != OrderStatusReturned {
+		return orderRef{}, false
+	}
+	if user.ReturnFollowUpOrderID == orders[0].OrderID {
+		debugLog(DEBUG_INFO, "Return follow-up for order %s was already sent", orders[0].OrderID)
+		return orderRef{}, false
+	}
+	return orders[0], true
+}
+
+// Re-score a user whose last order was returned and send them the return
+// follow-up email instead of the engagement email. The follow-up is claimed on
+// the user first so it goes out at most once per order, and the claim is
+// released if the email could not be sent.
+func followUpReturn(ctx context.Context, user User, order orderRef) (bool, error) {
+	assessment, err := assessUser(ctx, user)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := claimReturnFollowUp(ctx, user.UserID, order.OrderID)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		debugLog(DEBUG_INFO, "Return follow-up for order %s was claimed by another delivery", order.OrderID)
+		return false, nil
+	}
+
+	debugLog(DEBUG_INFO, "Sending return follow-up to user %s for order %s", user.UserID, order.OrderID)
+	assessment.EmailType = EmailTypeReturnFollowUp
+	assessment.ReturnedOrder = &order
+
+	emailed, err := emailUser(ctx, assessment)
+	if err != nil && !emailed {
+		if releaseErr := releaseReturnFollowUp(context.WithoutCancel(ctx), user.UserID, order.OrderID, user.ReturnFollowUpOrderID); releaseErr != nil {
+			debugLog(DEBUG_ERROR, "Error releasing return follow-up claim for order %s: %v", order.OrderID, releaseErr)
+		}
+		if errors.Is(err, errEmailNotClaimed) {
+			// Another email to the user is in flight, try again once it's done
+			return false, retryableError(err)
+		}
+	}
+	return emailed, err
+}
+
+// Record on the user that the return follow-up for an order is being sent.
+// Returns false if it was already recorded for that order.
+func claimReturnFollowUp(ctx context.Context, userID, orderID string) (bool, error) {
+	now := time.Now().Format(time.RFC3339)
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:    aws.String("SET returnFollowUpOrderId = :orderId, updatedAt = :updatedAt, lastProcessorWriteAt = :updatedAt"),
+		ConditionExpression: aws.String("attribute_exists(userId) AND (attribute_not_exists(returnFollowUpOrderId) OR returnFollowUpOrderId <> :orderId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":orderId": &types.AttributeValueMemberS{
+				Value: orderID,
+			},
+			":updatedAt": &types.AttributeValueMemberS{
+				Value: now,
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error claiming return follow-up: %w", err)
+	}
+
+	return true, nil
+}
+
+// Restore the previous follow-up order on the user if the claim is still ours
+func releaseReturnFollowUp(ctx context.Context, userID, orderID, previousOrderID string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:    aws.String("REMOVE returnFollowUpOrderId"),
+		ConditionExpression: aws.String("returnFollowUpOrderId = :orderId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":orderId": &types.AttributeValueMemberS{
+				Value: orderID,
+			},
+		},
+	}
+	if previousOrderID != "" {
+		input.UpdateExpression = aws.String("SET returnFollowUpOrderId = :previousOrderId")
+		input.ExpressionAttributeValues[":previousOrderId"] = &types.AttributeValueMemberS{
+			Value: previousOrderID,
+		}
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, input)
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Build the prompt for the follow-up to a returned order
+func returnFollowUpPrompt(user User, order orderRef, offer OfferTier) string {
+	returnedCategories := topCategories(order.Categories, len(order.Categories))
+	return fmt.Sprintf(`
+Generate a personalized follow-up email for a Stitch Fix customer who just returned everything in their last Fix:
+- Name: %s
+- Returned order date: %s
+- Returned order value: $%.2f
+- Categories in the returned order: %s
+- Number of previous orders: %d
+- Preferred categories (strongest first): %s
+
+The email should:
+1. Be warm and sincere, and say we're sorry this Fix didn't work out
+2. Not ask them to explain or justify the return
+3. Invite them to tell their stylist what missed (fit, style, price) so the next Fix is better
+4. Offer to adjust their style profile, and only suggest categories they prefer
+5. Follow this offer guidance: %s
+
+YOU MUST RESPOND WITH VALID JSON in the following format:
+{
+	 "subject": "Engaging subject line here",
+	 "content": "HTML formatted email content here with <p> tags"
+}
+
+The content should be valid HTML with paragraph tags.
+`, user.Name, order.OrderDate, order.TotalValue, promptList(returnedCategories), user.OrderCount,
+		promptList(user.PreferredCategories), offer.Guidance)
+}
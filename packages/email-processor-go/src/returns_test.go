@@ -0,0 +1,155 @@
+package main
+
+import "testing"
+
+// Build an order history with orders on the given days, then set the status
+// of some of them by order ID
+func testOrderHistoryWithStatus(days []int, statuses map[string]string) map[string]OrderHistoryEntry {
+	history := testOrderHistory(days...)
+	for orderID, status := range statuses {
+		entry := history[orderID]
+		entry.Status = status
+		history[orderID] = entry
+	}
+	return history
+}
+
+func TestReturnRateFactor(t *testing.T) {
+	cfg := ReturnsConfig{Enabled: true, MinOrders: 3, WindowOrders: 10, CancelledWeight: 0.5, MaxPenalty: 20}
+	ignoreCancelled := cfg
+	ignoreCancelled.CancelledWeight = 0
+	disabled := cfg
+	disabled.Enabled = false
+
+	tests := []struct {
+		name      string
+		cfg       ReturnsConfig
+		history   map[string]OrderHistoryEntry
+		wantOK    bool
+		wantRate  float64
+		wantScore float64
+	}{
+		{
+			name:    "disabled",
+			cfg:     disabled,
+			history: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{"order-00": OrderStatusReturned}),
+		},
+		{
+			name:    "fewer than minOrders",
+			cfg:     cfg,
+			history: testOrderHistoryWithStatus([]int{0, 30}, map[string]string{"order-00": OrderStatusReturned}),
+			wantOK:  true,
+		},
+		{
+			name:    "no returns",
+			cfg:     cfg,
+			history: testOrderHistory(0, 30, 60),
+			wantOK:  true,
+		},
+		{
+			name: "cancelled orders count at cancelledWeight",
+			cfg:  cfg,
+			history: testOrderHistoryWithStatus([]int{0, 30, 60, 90}, map[string]string{
+				"order-01": OrderStatusReturned,
+				"order-02": OrderStatusCancelled,
+				"order-03": OrderStatusCancelled,
+			}),
+			wantOK: true, wantRate: 0.5, wantScore: -10,
+		},
+		{
+			name: "cancelledWeight of zero ignores cancellations",
+			cfg:  ignoreCancelled,
+			history: testOrderHistoryWithStatus([]int{0, 30, 60, 90}, map[string]string{
+				"order-01": OrderStatusReturned,
+				"order-02": OrderStatusCancelled,
+				"order-03": OrderStatusCancelled,
+			}),
+			wantOK: true, wantRate: 0.25, wantScore: -5,
+		},
+		{
+			name: "only the last windowOrders orders count",
+			cfg:  cfg,
+			history: testOrderHistoryWithStatus([]int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110}, map[string]string{
+				"order-00": OrderStatusReturned,
+				"order-01": OrderStatusReturned,
+				"order-11": OrderStatusReturned,
+			}),
+			wantOK: true, wantRate: 0.1, wantScore: -2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factor, ok := returnRateFactor(User{OrderHistory: tt.history}, tt.cfg)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			assertScore(t, factor.RawInput, tt.wantRate)
+			assertScore(t, factor.Contribution, tt.wantScore)
+		})
+	}
+}
+
+func TestReturnFollowUpDue(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        User
+		wantOrderID string
+		wantDue     bool
+	}{
+		{
+			name: "no orders",
+			user: User{},
+		},
+		{
+			name: "latest order returned",
+			user: User{OrderHistory: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{
+				"order-02": OrderStatusReturned,
+			})},
+			wantOrderID: "order-02",
+			wantDue:     true,
+		},
+		{
+			name: "returned order is not the latest",
+			user: User{OrderHistory: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{
+				"order-01": OrderStatusReturned,
+			})},
+		},
+		{
+			name: "latest order cancelled",
+			user: User{OrderHistory: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{
+				"order-02": OrderStatusCancelled,
+			})},
+		},
+		{
+			name: "follow-up already sent for the order",
+			user: User{
+				OrderHistory: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{
+					"order-02": OrderStatusReturned,
+				}),
+				ReturnFollowUpOrderID: "order-02",
+			},
+		},
+		{
+			name: "follow-up sent for an earlier return",
+			user: User{
+				OrderHistory: testOrderHistoryWithStatus([]int{0, 30, 60}, map[string]string{
+					"order-00": OrderStatusReturned,
+					"order-02": OrderStatusReturned,
+				}),
+				ReturnFollowUpOrderID: "order-00",
+			},
+			wantOrderID: "order-02",
+			wantDue:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, due := returnFollowUpDue(tt.user)
+			if due != tt.wantDue || order.OrderID != tt.wantOrderID {
+				t.Errorf("returnFollowUpDue = %q, %v, want %q, %v", order.OrderID, due, tt.wantOrderID, tt.wantDue)
+			}
+		})
+	}
+}
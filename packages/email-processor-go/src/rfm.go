@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// RFM segment names
+const (
+	RFMSegmentChampions   = "champions"
+	RFMSegmentLoyal       = "loyal"
+	RFMSegmentAtRisk      = "at-risk"
+	RFMSegmentHibernating = "hibernating"
+	RFMSegmentLost        = "lost"
+)
+
+// RFM settings
+const (
+	// How long the queue processor uses boundaries before reloading them
+	RFMBoundariesCacheTTL = time.Hour
+
+	// Users sampled per sweep segment to compute the boundaries from
+	RFMSamplesPerSegment = 1000
+
+	// State table key of the current boundaries
+	rfmBoundariesStateID = "rfm#boundaries"
+)
+
+// RFMBoundaries are the quintile cut points of each RFM dimension, at the
+// 20th, 40th, 60th and 80th percentiles of the user population
+type RFMBoundaries struct {
+	// Days since last order
+	Recency []float64 `json:"recency"`
+	// Order count
+	Frequency []float64 `json:"frequency"`
+	// Average order value
+	Monetary []float64 `json:"monetary"`
+
+	Population int    `json:"population"`
+	ComputedAt string `json:"computedAt"`
+}
+
+// RFMScore is a user's quintile (1-5, 5 best) in each dimension and the segment they map to
+type RFMScore struct {
+	Recency   int
+	Frequency int
+	Monetary  int
+	Segment   string
+}
+
+// rfmSampler is a uniform random sample of the users a sweep segment has
+// scanned, kept in the segment's checkpoint. The three lists hold one entry
+// per sampled user; a negative recency means the user has no order date.
+type rfmSampler struct {
+	Seen      int
+	Recency   []float64
+	Frequency []float64
+	Monetary  []float64
+}
+
+// weightedValue is a sampled value standing in for Weight users
+type weightedValue struct {
+	Value  float64
+	Weight float64
+}
+
+// Boundaries used until the first sweep has computed them from the population
+var DefaultRFMBoundaries = RFMBoundaries{
+	Recency:   []float64{30, 60, 90, 180},
+	Frequency: []float64{1, 2, 4, 8},
+	Monetary:  []float64{50, 100, 150, 250},
+}
+
+// Cached boundaries for the queue processor
+var (
+	rfmBoundariesMu       sync.Mutex
+	rfmBoundariesCache    *RFMBoundaries
+	rfmBoundariesLoadedAt time.Time
+)
+
+// Code returns the quintiles as a three digit code, e.g. "543"
+func (s RFMScore) Code() string {
+	return fmt.Sprintf("%d%d%d", s.Recency, s.Frequency, s.Monetary)
+}
+
+// Assign a user's RFM quintiles and segment
+func classifyRFM(user User, boundaries RFMBoundaries) RFMScore {
+	score := RFMScore{
+		Frequency: quintile(float64(user.OrderCount), boundaries.Frequency),
+		Monetary:  quintile(user.AverageOrderValue, boundaries.Monetary),
+		Recency:   1,
+	}
+	// Fewer days since the last order is better
+	if days, ok := rfmRecencyDays(user, time.Now()); ok {
+		score.Recency = 6 - quintile(days, boundaries.Recency)
+	}
+	score.Segment = rfmSegment(score)
+	return score
+}
+
+// Position of a value among quintile cut points, from 1 (at or below the
+// first) to 5 (above the last)
+func quintile(value float64, cuts []float64) int {
+	q := 1
+	for _, cut := range cuts {
+		if value > cut {
+			q++
+		}
+	}
+	return q
+}
+
+// Map quintiles to a named segment. Recency decides how active the user is;
+// frequency and monetary value separate the best and most valuable users
+// within each recency band.
+func rfmSegment(score RFMScore) string {
+	switch {
+	case score.Recency >= 4 && score.Frequency+score.Monetary >= 8:
+		return RFMSegmentChampions
+	case score.Recency >= 3:
+		return RFMSegmentLoyal
+	case score.Recency == 2 && score.Frequency >= 3:
+		return RFMSegmentAtRisk
+	case score.Recency == 2:
+		return RFMSegmentHibernating
+	case score.Frequency >= 4:
+		return RFMSegmentAtRisk
+	default:
+		return RFMSegmentLost
+	}
+}
+
+// Days since the user's last order, or false if they have no valid order date
+func rfmRecencyDays(user User, now time.Time) (float64, bool) {
+	lastOrderDate, err := time.Parse(time.RFC3339, user.LastOrderDate)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(lastOrderDate).Hours() / 24, true
+}
+
+// Check whether the segment stored on the user matches a freshly computed one
+func storedRFMCurrent(user User, score RFMScore) bool {
+	return user.RFMCode == score.Code() && user.RFMSegment == score.Segment
+}
+
+// Get the boundaries to classify users with, reloading them from the state
+// table once the cached copy is older than RFMBoundariesCacheTTL
+func currentRFMBoundaries(ctx context.Context) RFMBoundaries {
+	rfmBoundariesMu.Lock()
+	defer rfmBoundariesMu.Unlock()
+
+	if rfmBoundariesCache != nil && time.Since(rfmBoundariesLoadedAt) < RFMBoundariesCacheTTL {
+		return *rfmBoundariesCache
+	}
+
+	boundaries := DefaultRFMBoundaries
+	if ProcessorStateTableName != "" {
+		stored, err := loadRFMBoundaries(ctx)
+		if err != nil {
+			// Keep using what we had rather than failing the user
+			debugLog(DEBUG_WARNING, "Error loading RFM boundaries, keeping previous ones: %v", err)
+			if rfmBoundariesCache != nil {
+				return *rfmBoundariesCache
+			}
+		} else if stored != nil {
+			boundaries = *stored
+		}
+	}
+
+	rfmBoundariesCache = &boundaries
+	rfmBoundariesLoadedAt = time.Now()
+	return boundaries
+}
+
+// Replace the cached boundaries, e.g. right after the sweep recomputed them
+func setRFMBoundaries(boundaries RFMBoundaries) {
+	rfmBoundariesMu.Lock()
+	defer rfmBoundariesMu.Unlock()
+
+	rfmBoundariesCache = &boundaries
+	rfmBoundariesLoadedAt = time.Now()
+}
+
+// Load the stored boundaries, or nil if none have been computed yet
+func loadRFMBoundaries(ctx context.Context) (*RFMBoundaries, error) {
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: rfmBoundariesStateID,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading RFM boundaries: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	boundaries := &RFMBoundaries{
+		Recency:    numberListAttribute(result.Item, "recency"),
+		Frequency:  numberListAttribute(result.Item, "frequency"),
+		Monetary:   numberListAttribute(result.Item, "monetary"),
+		Population: int(numberAttribute(result.Item, "population")),
+		ComputedAt: stringAttribute(result.Item, "computedAt"),
+	}
+	if len(boundaries.Recency) != 4 || len(boundaries.Frequency) != 4 || len(boundaries.Monetary) != 4 {
+		return nil, fmt.Errorf("stored RFM boundaries are incomplete")
+	}
+
+	return boundaries, nil
+}
+
+// Add a scanned user to the sample, replacing a random earlier one once the
+// sample is full (reservoir sampling)
+func (s *rfmSampler) add(user User, now time.Time) {
+	recency := -1.0
+	if days, ok := rfmRecencyDays(user, now); ok {
+		recency = math.Max(days, 0)
+	}
+
+	s.Seen++
+	i := len(s.Frequency)
+	if i >= RFMSamplesPerSegment {
+		i = rand.Intn(s.Seen)
+		if i >= RFMSamplesPerSegment {
+			return
+		}
+		s.Recency[i] = recency
+		s.Frequency[i] = float64(user.OrderCount)
+		s.Monetary[i] = user.AverageOrderValue
+		return
+	}
+	s.Recency = append(s.Recency, recency)
+	s.Frequency = append(s.Frequency, float64(user.OrderCount))
+	s.Monetary = append(s.Monetary, user.AverageOrderValue)
+}
+
+// Compute the boundaries from the samples of every segment of a sweep. Each
+// sampled user stands in for an equal share of the users their segment saw,
+// so segments of different sizes are weighted correctly.
+func rfmBoundariesFromSamples(samplers []rfmSampler, computedAt time.Time) RFMBoundaries {
+	var recency, frequency, monetary []weightedValue
+	population := 0
+	for _, sampler := range samplers {
+		if len(sampler.Frequency) == 0 {
+			continue
+		}
+		population += sampler.Seen
+		weight := float64(sampler.Seen) / float64(len(sampler.Frequency))
+		for i := range sampler.Frequency {
+			if i < len(sampler.Recency) && sampler.Recency[i] >= 0 {
+				recency = append(recency, weightedValue{sampler.Recency[i], weight})
+			}
+			frequency = append(frequency, weightedValue{sampler.Frequency[i], weight})
+			if i < len(sampler.Monetary) {
+				monetary = append(monetary, weightedValue{sampler.Monetary[i], weight})
+			}
+		}
+	}
+
+	if population == 0 {
+		return DefaultRFMBoundaries
+	}
+	return RFMBoundaries{
+		Recency:    quintileCuts(recency, DefaultRFMBoundaries.Recency),
+		Frequency:  quintileCuts(frequency, DefaultRFMBoundaries.Frequency),
+		Monetary:   quintileCuts(monetary, DefaultRFMBoundaries.Monetary),
+		Population: population,
+		ComputedAt: computedAt.Format(time.RFC3339),
+	}
+}
+
+// Store boundaries for the queue processor and the next sweep
+func saveRFMBoundaries(ctx context.Context, boundaries RFMBoundaries) error {
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Item: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: rfmBoundariesStateID,
+			},
+			"recency":   numberListAttributeValue(boundaries.Recency),
+			"frequency": numberListAttributeValue(boundaries.Frequency),
+			"monetary":  numberListAttributeValue(boundaries.Monetary),
+			"population": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(boundaries.Population),
+			},
+			"computedAt": &types.AttributeValueMemberS{
+				Value: boundaries.ComputedAt,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error saving RFM boundaries: %w", err)
+	}
+
+	return nil
+}
+
+// The 20th, 40th, 60th and 80th weighted percentiles of a set of values, or
+// the fallback cuts if there are no values
+func quintileCuts(values []weightedValue, fallback []float64) []float64 {
+	total := 0.0
+	for _, value := range values {
+		total += value.Weight
+	}
+	if total <= 0 {
+		return fallback
+	}
+
+	sorted := append([]weightedValue(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Value < sorted[j].Value })
+
+	cuts := make([]float64, 0, 4)
+	cumulative := 0.0
+	next := 0
+	for i := 1; i <= 4; i++ {
+		// Tolerate rounding in the running sum of fractional weights
+		target := total*float64(i)/5 - total*1e-9
+		for cumulative < target && next < len(sorted) {
+			cumulative += sorted[next].Weight
+			next++
+		}
+		cuts = append(cuts, sorted[next-1].Value)
+	}
+	return cuts
+}
+
+// Convert a list of numbers to a DynamoDB list attribute
+func numberListAttributeValue(values []float64) types.AttributeValue {
+	list := make([]types.AttributeValue, 0, len(values))
+	for _, value := range values {
+		list = append(list, &types.AttributeValueMemberN{
+			Value: formatScoreNumber(value),
+		})
+	}
+	return &types.AttributeValueMemberL{Value: list}
+}
+
+// Read a list of numbers from a DynamoDB map, or nil if missing
+func numberListAttribute(m map[string]types.AttributeValue, key string) []float64 {
+	list, ok := m[key].(*types.AttributeValueMemberL)
+	if !ok {
+		return nil
+	}
+	values := make([]float64, 0, len(list.Value))
+	for _, item := range list.Value {
+		if number, ok := item.(*types.AttributeValueMemberN); ok {
+			value, _ := strconv.ParseFloat(number.Value, 64)
+			values = append(values, value)
+		}
+	}
+	return values
+}
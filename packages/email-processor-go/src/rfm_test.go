@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Values that each stand in for one user
+func unweighted(values ...float64) []weightedValue {
+	weighted := make([]weightedValue, 0, len(values))
+	for _, value := range values {
+		weighted = append(weighted, weightedValue{Value: value, Weight: 1})
+	}
+	return weighted
+}
+
+func TestQuintileCuts(t *testing.T) {
+	fallback := []float64{-1, -2, -3, -4}
+
+	tests := []struct {
+		name   string
+		values []weightedValue
+		want   []float64
+	}{
+		{
+			name: "no values uses the fallback",
+			want: fallback,
+		},
+		{
+			name:   "one value per quintile",
+			values: unweighted(5, 3, 1, 4, 2),
+			want:   []float64{1, 2, 3, 4},
+		},
+		{
+			name:   "ten values",
+			values: unweighted(10, 9, 8, 7, 6, 5, 4, 3, 2, 1),
+			want:   []float64{2, 4, 6, 8},
+		},
+		{
+			name:   "ties share a cut",
+			values: unweighted(1, 1, 1, 1, 1, 1, 1, 2, 3, 4),
+			want:   []float64{1, 1, 1, 2},
+		},
+		{
+			name: "heavier values take up more of the distribution",
+			values: []weightedValue{
+				{Value: 1, Weight: 3},
+				{Value: 2, Weight: 1},
+				{Value: 3, Weight: 1},
+			},
+			want: []float64{1, 1, 1, 2},
+		},
+		{
+			name: "fractional weights",
+			values: []weightedValue{
+				{Value: 10, Weight: 0.4},
+				{Value: 20, Weight: 0.4},
+				{Value: 30, Weight: 0.4},
+				{Value: 40, Weight: 0.4},
+				{Value: 50, Weight: 0.4},
+			},
+			want: []float64{10, 20, 30, 40},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quintileCuts(tt.values, fallback)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("quintileCuts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuintile(t *testing.T) {
+	cuts := []float64{10, 20, 30, 40}
+	tests := []struct {
+		value float64
+		want  int
+	}{
+		{0, 1}, {10, 1}, {10.5, 2}, {20, 2}, {25, 3}, {35, 4}, {40, 4}, {1000, 5},
+	}
+	for _, tt := range tests {
+		if got := quintile(tt.value, cuts); got != tt.want {
+			t.Errorf("quintile(%v) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRFMSegment(t *testing.T) {
+	tests := []struct {
+		score RFMScore
+		want  string
+	}{
+		{RFMScore{Recency: 5, Frequency: 5, Monetary: 5}, RFMSegmentChampions},
+		{RFMScore{Recency: 4, Frequency: 4, Monetary: 4}, RFMSegmentChampions},
+		{RFMScore{Recency: 4, Frequency: 4, Monetary: 3}, RFMSegmentLoyal},
+		{RFMScore{Recency: 3, Frequency: 5, Monetary: 5}, RFMSegmentLoyal},
+		{RFMScore{Recency: 2, Frequency: 3, Monetary: 1}, RFMSegmentAtRisk},
+		{RFMScore{Recency: 2, Frequency: 2, Monetary: 5}, RFMSegmentHibernating},
+		{RFMScore{Recency: 1, Frequency: 4, Monetary: 1}, RFMSegmentAtRisk},
+		{RFMScore{Recency: 1, Frequency: 3, Monetary: 5}, RFMSegmentLost},
+		{RFMScore{Recency: 1, Frequency: 1, Monetary: 1}, RFMSegmentLost},
+	}
+	for _, tt := range tests {
+		if got := rfmSegment(tt.score); got != tt.want {
+			t.Errorf("rfmSegment(%s) = %s, want %s", tt.score.Code(), got, tt.want)
+		}
+	}
+}
+
+func TestClassifyRFM(t *testing.T) {
+	boundaries := DefaultRFMBoundaries
+
+	recent := classifyRFM(User{LastOrderDate: daysAgo(10.5), OrderCount: 12, AverageOrderValue: 300}, boundaries)
+	if recent.Code() != "555" || recent.Segment != RFMSegmentChampions {
+		t.Errorf("recent big spender = %s (%s), want 555 (champions)", recent.Code(), recent.Segment)
+	}
+
+	// Users without an order date get the worst recency
+	never := classifyRFM(User{OrderCount: 3, AverageOrderValue: 200}, boundaries)
+	if never.Code() != "134" || never.Segment != RFMSegmentLost {
+		t.Errorf("user without orders = %s (%s), want 134 (lost)", never.Code(), never.Segment)
+	}
+}
+
+func TestRFMSamplerKeepsABoundedSample(t *testing.T) {
+	var sampler rfmSampler
+	now := time.Now()
+	for i := 0; i < 3*RFMSamplesPerSegment; i++ {
+		sampler.add(User{OrderCount: i}, now)
+	}
+
+	if sampler.Seen != 3*RFMSamplesPerSegment {
+		t.Errorf("seen = %d, want %d", sampler.Seen, 3*RFMSamplesPerSegment)
+	}
+	if len(sampler.Frequency) != RFMSamplesPerSegment || len(sampler.Recency) != RFMSamplesPerSegment ||
+		len(sampler.Monetary) != RFMSamplesPerSegment {
+		t.Errorf("sample sizes = %d/%d/%d, want %d each", len(sampler.Recency), len(sampler.Frequency),
+			len(sampler.Monetary), RFMSamplesPerSegment)
+	}
+	// Users without an order date are sampled without a recency
+	for _, recency := range sampler.Recency {
+		if recency != -1 {
+			t.Fatalf("recency = %v, want -1 for users without an order date", recency)
+		}
+	}
+}
+
+func TestRFMBoundariesFromSamples(t *testing.T) {
+	now := time.Now()
+
+	if got := rfmBoundariesFromSamples(nil, now); !reflect.DeepEqual(got, DefaultRFMBoundaries) {
+		t.Errorf("no samples = %+v, want the defaults", got)
+	}
+
+	// A segment that saw 4 users per sample outweighs one that saw 1 per sample
+	samplers := []rfmSampler{
+		{Seen: 20, Recency: []float64{-1, 10, 10, 10, 10}, Frequency: []float64{1, 1, 1, 1, 1}, Monetary: []float64{50, 50, 50, 50, 50}},
+		{Seen: 5, Recency: []float64{90, 90, 90, 90, 90}, Frequency: []float64{9, 9, 9, 9, 9}, Monetary: []float64{500, 500, 500, 500, 500}},
+	}
+	got := rfmBoundariesFromSamples(samplers, now)
+
+	if got.Population != 25 {
+		t.Errorf("population = %d, want 25", got.Population)
+	}
+	if want := []float64{1, 1, 1, 1}; !reflect.DeepEqual(got.Frequency, want) {
+		t.Errorf("frequency cuts = %v, want %v", got.Frequency, want)
+	}
+	if want := []float64{50, 50, 50, 50}; !reflect.DeepEqual(got.Monetary, want) {
+		t.Errorf("monetary cuts = %v, want %v", got.Monetary, want)
+	}
+	// The sampled user without an order date is left out of recency
+	if want := []float64{10, 10, 10, 90}; !reflect.DeepEqual(got.Recency, want) {
+		t.Errorf("recency cuts = %v, want %v", got.Recency, want)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scorer computes an engagement score between 0 and 100 for a user.
+// Lower score = higher risk of disengagement.
+type Scorer interface {
+	// Name identifies the scoring algorithm (e.g. "step")
+	Name() string
+	// Version identifies the configuration the scorer was built from
+	Version() string
+	// Score calculates the engagement score for a user and explains it
+	Score(user User) ScoreBreakdown
+}
+
+// ScoringConfig is the versioned configuration that selects and tunes a scorer
+type ScoringConfig struct {
+	Scorer  string             `json:"scorer" yaml:"scorer"`
+	Version string             `json:"version" yaml:"version"`
+	Step    StepScoringConfig  `json:"step" yaml:"step"`
+	Decay   DecayScoringConfig `json:"decay" yaml:"decay"`
+	// Applies to the recency factor of the step and decay scorers
+	Cadence CadenceConfig `json:"cadence" yaml:"cadence"`
+	// Return rate factor of the step and decay scorers
+	Returns ReturnsConfig      `json:"returns" yaml:"returns"`
+	Churn   ChurnScoringConfig `json:"churn" yaml:"churn"`
+	// Customer lifetime value and offer tiers, independent of the scorer
+	Value ValueConfig `json:"value" yaml:"value"`
+	// Category affinity derived from order items
+	Categories CategoryConfig `json:"categories" yaml:"categories"`
+}
+
+// StepScoringConfig holds the weights and breakpoints of the step scorer
+type StepScoringConfig struct {
+	BaseScore float64 `json:"baseScore" yaml:"baseScore"`
+	MinScore  float64 `json:"minScore" yaml:"minScore"`
+	MaxScore  float64 `json:"maxScore" yaml:"maxScore"`
+
+	// Penalties applied when days since last order exceeds MinDays. Only the
+	// bucket with the largest matching MinDays applies.
+	RecencyBuckets []RecencyBucket `json:"recencyBuckets" yaml:"recencyBuckets"`
+
+	// Order count factor = min(orderCount / OrderCountCap, 1) * OrderCountWeight
+	OrderCountCap    float64 `json:"orderCountCap" yaml:"orderCountCap"`
+	OrderCountWeight float64 `json:"orderCountWeight" yaml:"orderCountWeight"`
+
+	// AOV factor = min(averageOrderValue / AOVDivisor, 1) * AOVWeight
+	AOVDivisor float64 `json:"aovDivisor" yaml:"aovDivisor"`
+	AOVWeight  float64 `json:"aovWeight" yaml:"aovWeight"`
+
+	// Penalty applied when the last email is more recent than RecentEmailDays
+	RecentEmailDays    int     `json:"recentEmailDays" yaml:"recentEmailDays"`
+	RecentEmailPenalty float64 `json:"recentEmailPenalty" yaml:"recentEmailPenalty"`
+}
+
+// DecayScoringConfig holds the parameters of the continuous decay scorer
+type DecayScoringConfig struct {
+	BaseScore float64 `json:"baseScore" yaml:"baseScore"`
+	MinScore  float64 `json:"minScore" yaml:"minScore"`
+	MaxScore  float64 `json:"maxScore" yaml:"maxScore"`
+
+	// Recency penalty grows smoothly from 0 towards MaxRecencyPenalty.
+	// "exponential": max * (1 - 2^(-days / RecencyHalfLifeDays))
+	// "logistic":    max / (1 + e^(-(days - RecencyMidpointDays) / RecencySteepnessDays))
+	RecencyCurve         string  `json:"recencyCurve" yaml:"recencyCurve"`
+	MaxRecencyPenalty    float64 `json:"maxRecencyPenalty" yaml:"maxRecencyPenalty"`
+	RecencyHalfLifeDays  float64 `json:"recencyHalfLifeDays" yaml:"recencyHalfLifeDays"`
+	RecencyMidpointDays  float64 `json:"recencyMidpointDays" yaml:"recencyMidpointDays"`
+	RecencySteepnessDays float64 `json:"recencySteepnessDays" yaml:"recencySteepnessDays"`
+
+	// Frequency bonus = OrderCountWeight * (1 - e^(-orderCount / OrderCountScale))
+	OrderCountWeight float64 `json:"orderCountWeight" yaml:"orderCountWeight"`
+	OrderCountScale  float64 `json:"orderCountScale" yaml:"orderCountScale"`
+
+	// Monetary bonus = AOVWeight * (1 - e^(-averageOrderValue / AOVScale))
+	AOVWeight float64 `json:"aovWeight" yaml:"aovWeight"`
+	AOVScale  float64 `json:"aovScale" yaml:"aovScale"`
+
+	// Penalty applied when the last email is more recent than RecentEmailDays
+	RecentEmailDays    int     `json:"recentEmailDays" yaml:"recentEmailDays"`
+	RecentEmailPenalty float64 `json:"recentEmailPenalty" yaml:"recentEmailPenalty"`
+}
+
+// ChurnScoringConfig locates the trained model used by the churn scorer
+type ChurnScoringConfig struct {
+	// Path of a coefficients file written by churn-train (CHURN_MODEL_PATH overrides it)
+	ModelPath string `json:"modelPath" yaml:"modelPath"`
+}
+
+// Recency curves supported by the decay scorer
+const (
+	RecencyCurveExponential = "exponential"
+	RecencyCurveLogistic    = "logistic"
+)
+
+// RecencyBucket is a single step of the recency penalty
+type RecencyBucket struct {
+	MinDays int     `json:"minDays" yaml:"minDays"`
+	Penalty float64 `json:"penalty" yaml:"penalty"`
+}
+
+// Default scoring configuration, used when no SCORING_CONFIG_PATH is set
+//
+//go:embed scoring-config.json
+var defaultScoringConfig []byte
+
+// Scorer implementations by name
+var scorerFactories = map[string]func(ScoringConfig) (Scorer, error){
+	"step":  newStepScorer,
+	"decay": newDecayScorer,
+	"churn": newChurnScorer,
+}
+
+// Active scorer and the configuration it was built from (set at init)
+var (
+	activeScorer        Scorer
+	activeScoringConfig ScoringConfig
+)
+
+// Load the scoring configuration from SCORING_CONFIG_PATH (JSON or YAML by
+// file extension), falling back to the embedded default. SCORER overrides the
+// configured scorer so a deployment can switch models without a new file.
+func loadScoringConfig() (ScoringConfig, error) {
+	config, err := readScoringConfig()
+	if err != nil {
+		return config, err
+	}
+
+	if scorer := os.Getenv("SCORER"); scorer != "" {
+		debugLog(DEBUG_INFO, "Using scorer %s from SCORER environment variable", scorer)
+		config.Scorer = scorer
+	}
+
+	return config, nil
+}
+
+// Read the scoring configuration file, or the embedded default
+func readScoringConfig() (ScoringConfig, error) {
+	var config ScoringConfig
+
+	path := os.Getenv("SCORING_CONFIG_PATH")
+	if path == "" {
+		debugLog(DEBUG_INFO, "SCORING_CONFIG_PATH not set, using embedded default scoring config")
+		if err := json.Unmarshal(defaultScoringConfig, &config); err != nil {
+			return config, fmt.Errorf("error parsing default scoring config: %w", err)
+		}
+		return config, nil
+	}
+
+	debugLog(DEBUG_INFO, "Loading scoring config from %s", path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("error reading scoring config %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	default:
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return config, fmt.Errorf("error parsing scoring config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// Build the scorer selected by a scoring configuration
+func newScorer(config ScoringConfig) (Scorer, error) {
+	if config.Version == "" {
+		return nil, fmt.Errorf("scoring config must have a version")
+	}
+
+	factory, ok := scorerFactories[config.Scorer]
+	if !ok {
+		return nil, fmt.Errorf("unknown scorer: %q", config.Scorer)
+	}
+
+	return factory(config)
+}
+
+// stepScorer is the original bucketed engagement scoring algorithm
+type stepScorer struct {
+	version string
+	config  StepScoringConfig
+	cadence CadenceConfig
+	returns ReturnsConfig
+}
+
+func newStepScorer(config ScoringConfig) (Scorer, error) {
+	step := config.Step
+	if step.OrderCountCap <= 0 || step.AOVDivisor <= 0 {
+		return nil, fmt.Errorf("step scorer requires positive orderCountCap and aovDivisor")
+	}
+	if step.MaxScore <= step.MinScore {
+		return nil, fmt.Errorf("step scorer requires maxScore > minScore")
+	}
+
+	// Largest breakpoint first so the first match is the one that applies
+	step.RecencyBuckets = append([]RecencyBucket(nil), step.RecencyBuckets...)
+	sort.Slice(step.RecencyBuckets, func(i, j int) bool {
+		return step.RecencyBuckets[i].MinDays > step.RecencyBuckets[j].MinDays
+	})
+
+	if err := validateReturnsConfig(config.Returns); err != nil {
+		return nil, err
+	}
+
+	return &stepScorer{version: config.Version, config: step, cadence: config.Cadence, returns: config.Returns}, nil
+}
+
+func (s *stepScorer) Name() string {
+	return "step"
+}
+
+func (s *stepScorer) Version() string {
+	return s.version
+}
+
+func (s *stepScorer) Score(user User) ScoreBreakdown {
+	// Add panic recovery to catch and log any crashes
+	defer recoverPanic()
+
+	cfg := s.config
+	debugLog(DEBUG_INFO, "Calculating engagement score for user: %s (scorer %s/%s)", user.UserID, s.Name(), s.version)
+
+	breakdown := newScoreBreakdown(s, cfg.BaseScore)
+
+	// Reduce score based on days since last order (higher impact), relative
+	// to the user's personal cadence when known
+	days := float64(daysSinceLastOrder(user))
+	recencyDays := cadenceAdjustedRecencyDays(user, days, s.cadence, &breakdown)
+	recency := ScoreFactor{
+		Name:     "orderRecency",
+		RawInput: days,
+		Detail:   "recent order, no reduction",
+	}
+	for _, bucket := range cfg.RecencyBuckets {
+		if recencyDays > float64(bucket.MinDays) {
+			recency.Contribution = -bucket.Penalty
+			recency.Detail = fmt.Sprintf("more than %d days since last order", bucket.MinDays)
+			break
+		}
+	}
+	if breakdown.CadenceDays > 0 {
+		recency.Detail += fmt.Sprintf(" (cadence-adjusted: %.0f days)", recencyDays)
+	}
+	breakdown.addFactor(recency)
+
+	// Increase score based on order history (factor max 1.0)
+	orderCountFactor := float64(user.OrderCount) / cfg.OrderCountCap
+	breakdown.addFactor(ScoreFactor{
+		Name:         "orderCount",
+		RawInput:     float64(user.OrderCount),
+		Contribution: math.Min(orderCountFactor, 1.0) * cfg.OrderCountWeight,
+		Capped:       orderCountFactor > 1.0,
+	})
+
+	aovFactor := user.AverageOrderValue / cfg.AOVDivisor
+	breakdown.addFactor(ScoreFactor{
+		Name:         "averageOrderValue",
+		RawInput:     user.AverageOrderValue,
+		Contribution: math.Min(aovFactor, 1.0) * cfg.AOVWeight,
+		Capped:       aovFactor > 1.0,
+	})
+
+	// Reduce score for users who send back a large share of their orders
+	if factor, ok := returnRateFactor(user, s.returns); ok {
+		breakdown.addFactor(factor)
+	}
+
+	// Adjust based on email recency - don't email too frequently
+	breakdown.addFactor(emailRecencyFactor(user, cfg.RecentEmailDays, cfg.RecentEmailPenalty))
+
+	// Ensure score is within the configured range
+	breakdown.clamp(cfg.MinScore, cfg.MaxScore)
+	logScoreBreakdown(user, breakdown)
+
+	return breakdown
+}
+
+// Start a breakdown for a scorer
+func newScoreBreakdown(scorer Scorer, baseScore float64) ScoreBreakdown {
+	return ScoreBreakdown{
+		Scorer:         scorer.Name(),
+		ScorerVersion:  scorer.Version(),
+		BaseScore:      baseScore,
+		UnclampedScore: baseScore,
+		CalculatedAt:   time.Now().Format(time.RFC3339),
+	}
+}
+
+// Calculate days since the user's last order. An unparseable date counts as today.
+func daysSinceLastOrder(user User) int {
+	lastOrderDate, err := time.Parse(time.RFC3339, user.LastOrderDate)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Error parsing last order date: %v, using current time", err)
+		lastOrderDate = time.Now()
+	}
+	return int(time.Since(lastOrderDate).Hours() / 24)
+}
+
+// Calculate days since the user's last email, defaulting to a year if none was sent
+func daysSinceLastEmail(user User) int {
+	if user.LastEmailDate == nil {
+		return 365
+	}
+	lastEmailDate, err := time.Parse(time.RFC3339, *user.LastEmailDate)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Error parsing last email date: %v, using default (365 days)", err)
+		return 365
+	}
+	return int(time.Since(lastEmailDate).Hours() / 24)
+}
+
+// Build the factor that penalizes users who were emailed recently
+func emailRecencyFactor(user User, recentEmailDays int, penalty float64) ScoreFactor {
+	days := daysSinceLastEmail(user)
+	factor := ScoreFactor{
+		Name:     "emailRecency",
+		RawInput: float64(days),
+	}
+	if days < recentEmailDays {
+		factor.Contribution = -penalty
+		factor.Detail = fmt.Sprintf("emailed within the last %d days", recentEmailDays)
+	}
+	return factor
+}
+
+// Log each factor of a breakdown
+func logScoreBreakdown(user User, breakdown ScoreBreakdown) {
+	for _, factor := range breakdown.Factors {
+		debugLog(DEBUG_INFO, "Score factor %s for user %s: input=%.2f contribution=%+.2f capped=%v %s",
+			factor.Name, user.UserID, factor.RawInput, factor.Contribution, factor.Capped, factor.Detail)
+	}
+	if breakdown.Clamped {
+		debugLog(DEBUG_INFO, "Final score (after clamping from %.2f): %.2f", breakdown.UnclampedScore, breakdown.Score)
+	} else {
+		debugLog(DEBUG_INFO, "Final score: %.2f", breakdown.Score)
+	}
+}
+
+// decayScorer replaces the step buckets with smooth recency decay and
+// saturating frequency and monetary terms, so scores change gradually
+// instead of jumping at bucket boundaries
+type decayScorer struct {
+	version string
+	config  DecayScoringConfig
+	cadence CadenceConfig
+	returns ReturnsConfig
+}
+
+func newDecayScorer(config ScoringConfig) (Scorer, error) {
+	decay := config.Decay
+	if decay.MaxScore <= decay.MinScore {
+		return nil, fmt.Errorf("decay scorer requires maxScore > minScore")
+	}
+	if decay.OrderCountScale <= 0 || decay.AOVScale <= 0 {
+		return nil, fmt.Errorf("decay scorer requires positive orderCountScale and aovScale")
+	}
+
+	switch decay.RecencyCurve {
+	case RecencyCurveExponential:
+		if decay.RecencyHalfLifeDays <= 0 {
+			return nil, fmt.Errorf("exponential recency curve requires a positive recencyHalfLifeDays")
+		}
+	case RecencyCurveLogistic:
+		if decay.RecencySteepnessDays <= 0 {
+			return nil, fmt.Errorf("logistic recency curve requires a positive recencySteepnessDays")
+		}
+	default:
+		return nil, fmt.Errorf("unknown recency curve: %q", decay.RecencyCurve)
+	}
+
+	if err := validateReturnsConfig(config.Returns); err != nil {
+		return nil, err
+	}
+
+	return &decayScorer{version: config.Version, config: decay, cadence: config.Cadence, returns: config.Returns}, nil
+}
+
+func (s *decayScorer) Name() string {
+	return "decay"
+}
+
+func (s *decayScorer) Version() string {
+	return s.version
+}
+
+func (s *decayScorer) Score(user User) ScoreBreakdown {
+	// Add panic recovery to catch and log any crashes
+	defer recoverPanic()
+
+	cfg := s.config
+	debugLog(DEBUG_INFO, "Calculating engagement score for user: %s (scorer %s/%s)", user.UserID, s.Name(), s.version)
+
+	breakdown := newScoreBreakdown(s, cfg.BaseScore)
+
+	// Smooth recency penalty, relative to the user's personal cadence when known
+	days := float64(daysSinceLastOrder(user))
+	recencyDays := cadenceAdjustedRecencyDays(user, days, s.cadence, &breakdown)
+	recency := ScoreFactor{
+		Name:         "orderRecency",
+		RawInput:     days,
+		Contribution: -s.recencyPenalty(recencyDays),
+		Detail:       cfg.RecencyCurve + " decay",
+	}
+	if breakdown.CadenceDays > 0 {
+		recency.Detail += fmt.Sprintf(" (cadence-adjusted: %.0f days)", recencyDays)
+	}
+	breakdown.addFactor(recency)
+
+	// Saturating frequency and monetary bonuses
+	breakdown.addFactor(ScoreFactor{
+		Name:         "orderCount",
+		RawInput:     float64(user.OrderCount),
+		Contribution: cfg.OrderCountWeight * (1 - math.Exp(-float64(user.OrderCount)/cfg.OrderCountScale)),
+	})
+	breakdown.addFactor(ScoreFactor{
+		Name:         "averageOrderValue",
+		RawInput:     user.AverageOrderValue,
+		Contribution: cfg.AOVWeight * (1 - math.Exp(-math.Max(user.AverageOrderValue, 0)/cfg.AOVScale)),
+	})
+
+	// Reduce score for users who send back a large share of their orders
+	if factor, ok := returnRateFactor(user, s.returns); ok {
+		breakdown.addFactor(factor)
+	}
+
+	// Adjust based on email recency - don't email too frequently
+	breakdown.addFactor(emailRecencyFactor(user, cfg.RecentEmailDays, cfg.RecentEmailPenalty))
+
+	// Same range and clamping semantics as the step scorer
+	breakdown.clamp(cfg.MinScore, cfg.MaxScore)
+	logScoreBreakdown(user, breakdown)
+
+	return breakdown
+}
+
+// Calculate the recency penalty for a number of days since the last order
+func (s *decayScorer) recencyPenalty(days float64) float64 {
+	cfg := s.config
+	if days < 0 {
+		days = 0
+	}
+
+	switch cfg.RecencyCurve {
+	case RecencyCurveLogistic:
+		return cfg.MaxRecencyPenalty / (1 + math.Exp(-(days-cfg.RecencyMidpointDays)/cfg.RecencySteepnessDays))
+	default:
+		return cfg.MaxRecencyPenalty * (1 - math.Pow(2, -days/cfg.RecencyHalfLifeDays))
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// Build a scorer from the embedded default config
+func testScorer(t *testing.T, name string, configure func(*ScoringConfig)) Scorer {
+	t.Helper()
+
+	var config ScoringConfig
+	if err := json.Unmarshal(defaultScoringConfig, &config); err != nil {
+		t.Fatalf("parsing default scoring config: %v", err)
+	}
+	config.Scorer = name
+	if configure != nil {
+		configure(&config)
+	}
+
+	scorer, err := newScorer(config)
+	if err != nil {
+		t.Fatalf("creating %s scorer: %v", name, err)
+	}
+	return scorer
+}
+
+// Timestamp a number of days before now. Half days keep whole-day counts
+// away from the boundary.
+func daysAgo(days float64) string {
+	return time.Now().Add(-time.Duration(days * float64(24*time.Hour))).UTC().Format(time.RFC3339)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func assertScore(t *testing.T, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf("score = %.4f, want %.4f", got, want)
+	}
+}
+
+func TestStepScorer(t *testing.T) {
+	scorer := testScorer(t, "step", nil)
+
+	tests := []struct {
+		name        string
+		user        User
+		want        float64
+		wantClamped bool
+	}{
+		{
+			name: "new user with a recent order",
+			user: User{LastOrderDate: daysAgo(10.5)},
+			want: 100,
+		},
+		{
+			name: "loyal recent user is clamped to the maximum",
+			user: User{LastOrderDate: daysAgo(10.5), OrderCount: 10, AverageOrderValue: 200},
+			want: 100, wantClamped: true,
+		},
+		{
+			name: "more than 30 days",
+			user: User{LastOrderDate: daysAgo(45.5), OrderCount: 5, AverageOrderValue: 100},
+			want: 100 - 15 + 7.5 + 5,
+		},
+		{
+			name: "more than 60 days",
+			user: User{LastOrderDate: daysAgo(75.5), OrderCount: 2, AverageOrderValue: 50},
+			want: 100 - 30 + 3 + 2.5,
+		},
+		{
+			name: "order count and AOV above their caps",
+			user: User{LastOrderDate: daysAgo(120.5), OrderCount: 20, AverageOrderValue: 400},
+			want: 100 - 40 + 15 + 10,
+		},
+		{
+			name: "recent email lands the user on the threshold",
+			user: User{LastOrderDate: daysAgo(120.5), LastEmailDate: stringPtr(daysAgo(2.5))},
+			want: EngagementScoreThreshold,
+		},
+		{
+			name: "old email is not penalized",
+			user: User{LastOrderDate: daysAgo(120.5), LastEmailDate: stringPtr(daysAgo(30.5))},
+			want: 60,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breakdown := scorer.Score(tt.user)
+			assertScore(t, breakdown.Score, tt.want)
+			if breakdown.Clamped != tt.wantClamped {
+				t.Errorf("clamped = %v, want %v", breakdown.Clamped, tt.wantClamped)
+			}
+			if breakdown.Scorer != "step" || breakdown.ScorerVersion == "" {
+				t.Errorf("breakdown scorer = %q/%q", breakdown.Scorer, breakdown.ScorerVersion)
+			}
+		})
+	}
+}
+
+func TestStepScorerFactorsAddUp(t *testing.T) {
+	scorer := testScorer(t, "step", nil)
+	breakdown := scorer.Score(User{LastOrderDate: daysAgo(75.5), OrderCount: 3, AverageOrderValue: 80})
+
+	sum := breakdown.BaseScore
+	for _, factor := range breakdown.Factors {
+		sum += factor.Contribution
+	}
+	assertScore(t, sum, breakdown.UnclampedScore)
+}
+
+func TestStepScorerUnsortedBuckets(t *testing.T) {
+	scorer := testScorer(t, "step", func(config *ScoringConfig) {
+		config.Step.RecencyBuckets = []RecencyBucket{
+			{MinDays: 30, Penalty: 15},
+			{MinDays: 90, Penalty: 40},
+			{MinDays: 60, Penalty: 30},
+		}
+	})
+
+	// Only the largest matching bucket applies
+	breakdown := scorer.Score(User{LastOrderDate: daysAgo(100.5)})
+	assertScore(t, breakdown.Score, 60)
+}
+
+func TestDecayScorer(t *testing.T) {
+	exponential := testScorer(t, "decay", nil)
+	logistic := testScorer(t, "decay", func(config *ScoringConfig) {
+		config.Decay.RecencyCurve = RecencyCurveLogistic
+	})
+	// Share of the full frequency and monetary bonus at one scale unit
+	oneScale := 1 - math.Exp(-1)
+
+	tests := []struct {
+		name   string
+		scorer Scorer
+		user   User
+		want   float64
+	}{
+		{
+			name:   "exponential: ordered today",
+			scorer: exponential,
+			user:   User{LastOrderDate: daysAgo(0.5)},
+			want:   100,
+		},
+		{
+			name:   "exponential: one half-life loses half the recency penalty",
+			scorer: exponential,
+			user:   User{LastOrderDate: daysAgo(45.5), OrderCount: 4, AverageOrderValue: 100},
+			want:   100 - 20 + 15*oneScale + 10*oneScale,
+		},
+		{
+			name:   "exponential: two half-lives",
+			scorer: exponential,
+			user:   User{LastOrderDate: daysAgo(90.5)},
+			want:   100 - 30,
+		},
+		{
+			name:   "exponential: recent email",
+			scorer: exponential,
+			user:   User{LastOrderDate: daysAgo(90.5), LastEmailDate: stringPtr(daysAgo(1.5))},
+			want:   100 - 30 - 10,
+		},
+		{
+			name:   "logistic: midpoint loses half the recency penalty",
+			scorer: logistic,
+			user:   User{LastOrderDate: daysAgo(60.5)},
+			want:   100 - 20,
+		},
+		{
+			name:   "logistic: long lapsed users approach the full penalty",
+			scorer: logistic,
+			user:   User{LastOrderDate: daysAgo(365.5)},
+			want:   100 - 40,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breakdown := tt.scorer.Score(tt.user)
+			assertScore(t, breakdown.Score, tt.want)
+			if breakdown.Scorer != "decay" {
+				t.Errorf("breakdown scorer = %q, want decay", breakdown.Scorer)
+			}
+		})
+	}
+}
+
+func TestDecayScorerIsSmooth(t *testing.T) {
+	for _, curve := range []string{RecencyCurveExponential, RecencyCurveLogistic} {
+		t.Run(curve, func(t *testing.T) {
+			scorer := testScorer(t, "decay", func(config *ScoringConfig) {
+				config.Decay.RecencyCurve = curve
+			}).(*decayScorer)
+
+			// The penalty never decreases and never jumps by more than a
+			// point a day, unlike the step scorer's buckets
+			previous := scorer.recencyPenalty(0)
+			for days := 1; days <= 365; days++ {
+				penalty := scorer.recencyPenalty(float64(days))
+				if penalty < previous {
+					t.Fatalf("penalty decreased from %.4f to %.4f at day %d", previous, penalty, days)
+				}
+				if penalty-previous > 1 {
+					t.Fatalf("penalty jumped from %.4f to %.4f at day %d", previous, penalty, days)
+				}
+				previous = penalty
+			}
+			if previous > scorer.config.MaxRecencyPenalty {
+				t.Errorf("penalty %.4f exceeds the maximum %.4f", previous, scorer.config.MaxRecencyPenalty)
+			}
+		})
+	}
+}
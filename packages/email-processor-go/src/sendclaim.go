@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// How long a send claim blocks other sends before it is treated as abandoned
+// (e.g. the Lambda that held it timed out). Longer than the sweep Lambda's timeout.
+const EmailClaimLeaseDuration = 20 * time.Minute
+
+// errEmailNotClaimed is returned when another invocation holds the user's
+// send claim, or the user was emailed within the minimum interval
+var errEmailNotClaimed = errors.New("email send not claimed")
+
+// Atomically reserve the right to email a user. The claim succeeds only if
+// the user wasn't emailed within the window and no other invocation holds an
+// unexpired claim. Returns the claim ID, or errEmailNotClaimed.
+func claimEmailSend(ctx context.Context, userID string, window time.Duration) (string, error) {
+	now := time.Now()
+	claimID := generateUUID()
+
+	condition := "attribute_exists(userId) AND (attribute_not_exists(emailClaimLeaseUntil) OR emailClaimLeaseUntil < :now)"
+	values := map[string]types.AttributeValue{
+		":claimId": &types.AttributeValueMemberS{
+			Value: claimID,
+		},
+		":leaseUntil": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Add(EmailClaimLeaseDuration).Unix(), 10),
+		},
+		":now": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(now.Unix(), 10),
+		},
+		":updatedAt": &types.AttributeValueMemberS{
+			Value: now.Format(time.RFC3339),
+		},
+	}
+	if window > 0 {
+		condition += " AND (attribute_not_exists(lastEmailDate) OR lastEmailDate < :windowStart)"
+		values[":windowStart"] = &types.AttributeValueMemberS{
+			Value: now.Add(-window).UTC().Format(time.RFC3339),
+		}
+	}
+
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:                    aws.String("SET emailClaimId = :claimId, emailClaimLeaseUntil = :leaseUntil, updatedAt = :updatedAt, lastProcessorWriteAt = :updatedAt"),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			if len(conditionErr.Item) == 0 {
+				return "", fmt.Errorf("%w: %s", errUserNotFound, userID)
+			}
+			return "", fmt.Errorf("%w: user %s last emailed %q, claim lease until %d", errEmailNotClaimed, userID,
+				stringAttribute(conditionErr.Item, "lastEmailDate"), int64(numberAttribute(conditionErr.Item, "emailClaimLeaseUntil")))
+		}
+		return "", fmt.Errorf("error claiming email send: %w", err)
+	}
+
+	debugLog(DEBUG_INFO, "Claimed email send for user %s (claim %s)", userID, claimID)
+	return claimID, nil
+}
+
+// Record a sent email on the user and clear the send claim. If the claim
+// expired and was taken over meanwhile, the last email date is still recorded
+// but the other claim is left alone.
+func finalizeEmailSend(ctx context.Context, userID, claimID string) error {
+	now := time.Now().Format(time.RFC3339)
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:    aws.String("SET lastEmailDate = :lastEmailDate, updatedAt = :lastEmailDate, lastProcessorWriteAt = :lastEmailDate REMOVE emailClaimId, emailClaimLeaseUntil"),
+		ConditionExpression: aws.String("emailClaimId = :claimId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lastEmailDate": &types.AttributeValueMemberS{
+				Value: now,
+			},
+			":claimId": &types.AttributeValueMemberS{
+				Value: claimID,
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			debugLog(DEBUG_WARNING, "Send claim %s for user %s was lost before the email was recorded", claimID, userID)
+			return updateUserLastEmailDate(ctx, userID)
+		}
+		return fmt.Errorf("error finalizing email send: %w", err)
+	}
+
+	return nil
+}
+
+// Give up a send claim after the email could not be sent, so a retry can claim again
+func releaseEmailSend(ctx context.Context, userID, claimID string) {
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(UsersTableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{
+				Value: userID,
+			},
+		},
+		UpdateExpression:    aws.String("REMOVE emailClaimId, emailClaimLeaseUntil"),
+		ConditionExpression: aws.String("emailClaimId = :claimId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":claimId": &types.AttributeValueMemberS{
+				Value: claimID,
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionErr) {
+			// The lease expires on its own
+			debugLog(DEBUG_ERROR, "Error releasing send claim %s for user %s: %v", claimID, userID, err)
+		}
+		return
+	}
+
+	debugLog(DEBUG_INFO, "Released send claim %s for user %s", claimID, userID)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Event sources of the Records of a Lambda invocation
+const (
+	EventSourceSQS      = "aws:sqs"
+	EventSourceDynamoDB = "aws:dynamodb"
+)
+
+// DynamoDB stream event names
+const (
+	StreamEventInsert = "INSERT"
+	StreamEventModify = "MODIFY"
+)
+
+// invocationProbe reads just enough of an invocation payload to tell its source apart
+type invocationProbe struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	DetailType string `json:"detail-type"`
+}
+
+// Lambda handler for the queue mode. Accepts SQS batches, DynamoDB stream
+// batches from the users table and events delivered by an EventBridge rule.
+func queueHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe invocationProbe
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, fmt.Errorf("error parsing invocation payload: %w", err)
+	}
+
+	switch {
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == EventSourceSQS:
+		var sqsEvent events.SQSEvent
+		if err := json.Unmarshal(payload, &sqsEvent); err != nil {
+			return nil, fmt.Errorf("error parsing SQS event: %w", err)
+		}
+		return handler(ctx, sqsEvent)
+
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == EventSourceDynamoDB:
+		var streamEvent events.DynamoDBEvent
+		if err := json.Unmarshal(payload, &streamEvent); err != nil {
+			return nil, fmt.Errorf("error parsing DynamoDB stream event: %w", err)
+		}
+		return streamHandler(ctx, streamEvent)
+
+	case probe.DetailType != "":
+		var bridgeEvent events.EventBridgeEvent
+		if err := json.Unmarshal(payload, &bridgeEvent); err != nil {
+			return nil, fmt.Errorf("error parsing EventBridge event: %w", err)
+		}
+		return nil, eventBridgeHandler(ctx, bridgeEvent)
+
+	case len(probe.Records) > 0:
+		return nil, fmt.Errorf("unsupported event source: %s", probe.Records[0].EventSource)
+
+	default:
+		return nil, fmt.Errorf("unrecognized invocation payload")
+	}
+}
+
+// Decode the event in an SQS message body. The body can be an SNS
+// notification, a raw event (SNS raw message delivery) or an EventBridge
+// event. Returns the event and the format it was found in.
+func decodeMessageBody(body string) (Event, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		return Event{}, "", fmt.Errorf("error parsing message body: %w", err)
+	}
+
+	switch {
+	case fields["detail-type"] != nil && fields["detail"] != nil:
+		var bridgeEvent events.EventBridgeEvent
+		if err := json.Unmarshal([]byte(body), &bridgeEvent); err != nil {
+			return Event{}, "", fmt.Errorf("error parsing EventBridge event: %w", err)
+		}
+		event, err := eventFromEventBridge(bridgeEvent)
+		return event, "EventBridge", err
+
+	case fields["Message"] != nil:
+		var envelope snsEnvelope
+		if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+			return Event{}, "", fmt.Errorf("error parsing SNS message: %w", err)
+		}
+		if envelope.Message == "" {
+			return Event{}, "", fmt.Errorf("SNS message %s does not contain a Message field", envelope.MessageID)
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(envelope.Message), &event); err != nil {
+			return Event{}, "", fmt.Errorf("error parsing event: %w", err)
+		}
+		return event, "SNS", nil
+
+	case fields["type"] != nil && fields["payload"] != nil:
+		var event Event
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			return Event{}, "", fmt.Errorf("error parsing event: %w", err)
+		}
+		return event, "raw", nil
+
+	default:
+		return Event{}, "", fmt.Errorf("unrecognized message body, keys found: %v", mapKeys(fields))
+	}
+}
+
+// Keys of a decoded JSON object, for error messages
+func mapKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Convert an EventBridge event to an event. The detail is either a complete
+// event envelope, or the payload itself with the event type as detail-type.
+func eventFromEventBridge(bridgeEvent events.EventBridgeEvent) (Event, error) {
+	var envelope Event
+	if err := json.Unmarshal(bridgeEvent.Detail, &envelope); err == nil && envelope.Type != "" && envelope.Payload != nil {
+		return envelope, nil
+	}
+
+	if bridgeEvent.DetailType == "" {
+		return Event{}, fmt.Errorf("EventBridge event %s has no detail-type", bridgeEvent.ID)
+	}
+	event := Event{
+		Type:    bridgeEvent.DetailType,
+		Payload: bridgeEvent.Detail,
+	}
+	if !bridgeEvent.Time.IsZero() {
+		event.Timestamp = bridgeEvent.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return event, nil
+}
+
+// Lambda handler for events delivered directly by an EventBridge rule.
+// Returning an error lets EventBridge retry the invocation.
+func eventBridgeHandler(ctx context.Context, bridgeEvent events.EventBridgeEvent) error {
+	defer recoverPanic()
+
+	debugLog(DEBUG_INFO, "EventBridge event received - ID: %s, Source: %s, DetailType: %s",
+		bridgeEvent.ID, bridgeEvent.Source, bridgeEvent.DetailType)
+
+	event, err := eventFromEventBridge(bridgeEvent)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Permanent error decoding EventBridge event %s, dropping: %v", bridgeEvent.ID, err)
+		return nil
+	}
+
+	if err := processDelivery(ctx, event, bridgeEvent.ID); err != nil {
+		if isRetryable(err) {
+			return err
+		}
+		debugLog(DEBUG_ERROR, "Permanent error processing EventBridge event %s, dropping: %v", bridgeEvent.ID, err)
+	}
+	return nil
+}
+
+// Lambda handler for DynamoDB stream records of the users table, replacing
+// the stream processor hop. Records are processed in stream order. At the
+// first record that should be retried, or once too little time is left, the
+// rest of the batch is handed back by reporting that record's sequence number.
+func streamHandler(ctx context.Context, streamEvent events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	defer recoverPanic()
+
+	debugLog(DEBUG_INFO, "Stream handler invoked with %d records", len(streamEvent.Records))
+
+	ctx, cancel := withCleanupMargin(ctx)
+	defer cancel()
+
+	var response events.DynamoDBEventResponse
+	for i, record := range streamEvent.Records {
+		if !hasTimeForMoreWork(ctx, BatchRecordTimeMargin) {
+			debugLog(DEBUG_WARNING, "Too little time left before the deadline, handing back %d stream records",
+				len(streamEvent.Records)-i)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+
+		if !processStreamRecord(ctx, record) {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
+
+	debugLog(DEBUG_INFO, "Stream handler completed - %d records handed back", len(response.BatchItemFailures))
+	return response, nil
+}
+
+// Process one stream record. Returns false if it should be retried.
+func processStreamRecord(ctx context.Context, record events.DynamoDBEventRecord) bool {
+	event, ok, err := eventFromStreamRecord(record)
+	if err != nil {
+		debugLog(DEBUG_ERROR, "Permanent error decoding stream record %s, dropping: %v", record.EventID, err)
+		return true
+	}
+	if !ok {
+		return true
+	}
+
+	if err := processDelivery(ctx, event, record.EventID); err != nil {
+		if isRetryable(err) {
+			debugLog(DEBUG_WARNING, "Retryable error processing stream record %s: %v", record.EventID, err)
+			return false
+		}
+		debugLog(DEBUG_ERROR, "Permanent error processing stream record %s, dropping: %v", record.EventID, err)
+	}
+	return true
+}
+
+// Convert a users table stream record to a USER_CREATED or USER_UPDATED
+// event. The second result is false for records that produce no event:
+// removals (USER_DELETED is published by the backend) and other tables.
+func eventFromStreamRecord(record events.DynamoDBEventRecord) (Event, bool, error) {
+	if tableName := streamTableName(record.EventSourceArn); tableName != UsersTableName {
+		debugLog(DEBUG_WARNING, "Ignoring stream record %s from table %s", record.EventID, tableName)
+		return Event{}, false, nil
+	}
+
+	var eventType string
+	switch record.EventName {
+	case StreamEventInsert:
+		eventType = EventTypeUserCreated
+	case StreamEventModify:
+		eventType = EventTypeUserUpdated
+	default:
+		debugLog(DEBUG_INFO, "Skipping %s stream record %s", record.EventName, record.EventID)
+		return Event{}, false, nil
+	}
+	if record.Change.NewImage == nil {
+		return Event{}, false, fmt.Errorf("stream record %s has no new image", record.EventID)
+	}
+
+	item := make(map[string]types.AttributeValue, len(record.Change.NewImage))
+	for name, value := range record.Change.NewImage {
+		item[name] = streamAttributeValue(value)
+	}
+	payload, err := json.Marshal(userFromItem(item))
+	if err != nil {
+		return Event{}, false, fmt.Errorf("error encoding user from stream record %s: %w", record.EventID, err)
+	}
+
+	event := Event{
+		Type:    eventType,
+		Payload: payload,
+	}
+	if createdAt := record.Change.ApproximateCreationDateTime.Time; !createdAt.IsZero() {
+		event.Timestamp = createdAt.UTC().Format(time.RFC3339Nano)
+	}
+	return event, true, nil
+}
+
+// Table name of a stream ARN (arn:aws:dynamodb:region:account:table/name/stream/label)
+func streamTableName(arn string) string {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Convert a stream record attribute to the SDK's AttributeValue
+func streamAttributeValue(value events.DynamoDBAttributeValue) types.AttributeValue {
+	switch value.DataType() {
+	case events.DataTypeString:
+		return &types.AttributeValueMemberS{Value: value.String()}
+	case events.DataTypeNumber:
+		return &types.AttributeValueMemberN{Value: value.Number()}
+	case events.DataTypeBoolean:
+		return &types.AttributeValueMemberBOOL{Value: value.Boolean()}
+	case events.DataTypeBinary:
+		return &types.AttributeValueMemberB{Value: value.Binary()}
+	case events.DataTypeStringSet:
+		return &types.AttributeValueMemberSS{Value: value.StringSet()}
+	case events.DataTypeNumberSet:
+		return &types.AttributeValueMemberNS{Value: value.NumberSet()}
+	case events.DataTypeBinarySet:
+		return &types.AttributeValueMemberBS{Value: value.BinarySet()}
+	case events.DataTypeList:
+		list := make([]types.AttributeValue, 0, len(value.List()))
+		for _, element := range value.List() {
+			list = append(list, streamAttributeValue(element))
+		}
+		return &types.AttributeValueMemberL{Value: list}
+	case events.DataTypeMap:
+		m := make(map[string]types.AttributeValue, len(value.Map()))
+		for name, element := range value.Map() {
+			m[name] = streamAttributeValue(element)
+		}
+		return &types.AttributeValueMemberM{Value: m}
+	default:
+		return &types.AttributeValueMemberNULL{Value: true}
+	}
+}
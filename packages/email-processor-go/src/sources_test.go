@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestDecodeMessageBody(t *testing.T) {
+	raw := `{"type":"USER_UPDATED","payload":{"userId":"alice"},"timestamp":"2026-03-31T12:00:00Z"}`
+	snsBody, _ := json.Marshal(map[string]string{"Type": "Notification", "MessageId": "sns-1", "Message": raw})
+
+	tests := []struct {
+		name       string
+		body       string
+		wantFormat string
+		wantType   string
+		wantTime   string
+		wantErr    bool
+	}{
+		{
+			name:       "SNS notification",
+			body:       string(snsBody),
+			wantFormat: "SNS",
+			wantType:   EventTypeUserUpdated,
+			wantTime:   "2026-03-31T12:00:00Z",
+		},
+		{
+			name:       "raw event",
+			body:       raw,
+			wantFormat: "raw",
+			wantType:   EventTypeUserUpdated,
+			wantTime:   "2026-03-31T12:00:00Z",
+		},
+		{
+			name:       "EventBridge event with an event envelope as detail",
+			body:       `{"id":"eb-1","detail-type":"Engagement Event","source":"stitchfix","time":"2026-03-31T13:00:00Z","detail":` + raw + `}`,
+			wantFormat: "EventBridge",
+			wantType:   EventTypeUserUpdated,
+			wantTime:   "2026-03-31T12:00:00Z",
+		},
+		{
+			name:       "EventBridge event with the payload as detail",
+			body:       `{"id":"eb-2","detail-type":"ORDER_CREATED","source":"stitchfix","time":"2026-03-31T13:00:00Z","detail":{"orderId":"o1","userId":"alice"}}`,
+			wantFormat: "EventBridge",
+			wantType:   EventTypeOrderCreated,
+			wantTime:   "2026-03-31T13:00:00Z",
+		},
+		{
+			name:    "SNS notification without a message",
+			body:    `{"Type":"Notification","MessageId":"sns-2","Message":""}`,
+			wantErr: true,
+		},
+		{
+			name:    "SNS notification with an invalid event",
+			body:    `{"Type":"Notification","MessageId":"sns-3","Message":"not json"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unrecognized object",
+			body:    `{"userId":"alice"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			body:    "hello",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, format, err := decodeMessageBody(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if format != tt.wantFormat || event.Type != tt.wantType || event.Timestamp != tt.wantTime {
+				t.Errorf("decoded %s %s at %s, want %s %s at %s",
+					format, event.Type, event.Timestamp, tt.wantFormat, tt.wantType, tt.wantTime)
+			}
+			if userID := eventUserID(event); userID != "alice" {
+				t.Errorf("userId = %q, want alice", userID)
+			}
+		})
+	}
+}
+
+func TestEventFromStreamRecord(t *testing.T) {
+	previous := UsersTableName
+	UsersTableName = "UsersTable"
+	t.Cleanup(func() { UsersTableName = previous })
+
+	createdAt := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	record := func(table, eventName string, image map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+		return events.DynamoDBEventRecord{
+			EventID:        "record-1",
+			EventName:      eventName,
+			EventSourceArn: "arn:aws:dynamodb:us-east-1:123456789012:table/" + table + "/stream/2026-01-01T00:00:00.000",
+			Change: events.DynamoDBStreamRecord{
+				ApproximateCreationDateTime: events.SecondsEpochTime{Time: createdAt},
+				NewImage:                    image,
+			},
+		}
+	}
+	image := map[string]events.DynamoDBAttributeValue{
+		"userId":     events.NewStringAttribute("alice"),
+		"orderCount": events.NewNumberAttribute("3"),
+		"preferredCategories": events.NewListAttribute([]events.DynamoDBAttributeValue{
+			events.NewStringAttribute("dresses"),
+		}),
+	}
+
+	tests := []struct {
+		name     string
+		record   events.DynamoDBEventRecord
+		wantType string
+		wantOK   bool
+		wantErr  bool
+	}{
+		{
+			name:     "insert",
+			record:   record("UsersTable", StreamEventInsert, image),
+			wantType: EventTypeUserCreated,
+			wantOK:   true,
+		},
+		{
+			name:     "modify",
+			record:   record("UsersTable", StreamEventModify, image),
+			wantType: EventTypeUserUpdated,
+			wantOK:   true,
+		},
+		{
+			name:   "removals produce no event",
+			record: record("UsersTable", "REMOVE", nil),
+		},
+		{
+			name:   "other tables produce no event",
+			record: record("EmailsTable", StreamEventModify, image),
+		},
+		{
+			name:    "missing new image",
+			record:  record("UsersTable", StreamEventModify, nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok, err := eventFromStreamRecord(tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			if event.Type != tt.wantType || event.Timestamp != "2026-03-31T12:00:00Z" {
+				t.Errorf("event = %s at %s, want %s at 2026-03-31T12:00:00Z", event.Type, event.Timestamp, tt.wantType)
+			}
+			var user User
+			if err := json.Unmarshal(event.Payload, &user); err != nil {
+				t.Fatalf("decoding payload: %v", err)
+			}
+			if user.UserID != "alice" || user.OrderCount != 3 || len(user.PreferredCategories) != 1 {
+				t.Errorf("user = %+v", user)
+			}
+		})
+	}
+}
+
+func TestStreamTableName(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:dynamodb:us-east-1:123456789012:table/UsersTable/stream/2026-01-01T00:00:00.000": "UsersTable",
+		"arn:aws:dynamodb:us-east-1:123456789012:table/UsersTable":                                "UsersTable",
+		"": "",
+	}
+	for arn, want := range tests {
+		if got := streamTableName(arn); got != want {
+			t.Errorf("streamTableName(%q) = %q, want %q", arn, got, want)
+		}
+	}
+}
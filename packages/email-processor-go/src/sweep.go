@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Re-scoring sweep settings
+const (
+	// Default number of parallel Scan segments
+	DefaultSweepSegments = 4
+
+	// Minimum time between the start of two sweeps. Scheduled invocations
+	// inside this window only resume an unfinished sweep.
+	SweepInterval = 24 * time.Hour
+
+	// Stop scanning when less than this much time is left before the Lambda
+	// deadline, leaving room for an in-flight processUser call to finish
+	SweepTimeMargin = 45 * time.Second
+
+	// Number of users read per Scan page (checkpoints are saved per page, or
+	// partway through one at the deadline)
+	SweepPageSize = 100
+
+	// State table keys
+	sweepStateID              = "sweep#current"
+	sweepSegmentStatePrefix   = "sweep#segment#"
+	sweepCandidateStatePrefix = "sweep#candidate#"
+)
+
+// Processor state table name (set from PROCESSOR_STATE_TABLE_NAME)
+var ProcessorStateTableName = ""
+
+// Number of parallel Scan segments (set from SWEEP_SEGMENTS)
+var SweepSegments = DefaultSweepSegments
+
+// Maximum emails sent per sweep (set from SWEEP_EMAIL_BUDGET, 0 means no limit).
+// With a budget, users are emailed in order of value at risk once the scan finishes.
+var SweepEmailBudget = 0
+
+// sweepState tracks the sweep currently in progress
+type sweepState struct {
+	SweepID       string
+	TotalSegments int
+	StartedAt     string
+	CompletedAt   string
+	EmailsSent    int
+}
+
+// sweepCandidate is a user a sweep decided to email, waiting for the budget.
+// Candidates the budget didn't reach carry over to the next sweep.
+type sweepCandidate struct {
+	UserID      string
+	ValueAtRisk float64
+}
+
+// segmentCheckpoint records how far a single Scan segment got
+type segmentCheckpoint struct {
+	Segment          int
+	LastEvaluatedKey string
+	Completed        bool
+	// Users scanned so far, sampled for the RFM boundaries
+	RFMSamples rfmSampler
+}
+
+// Lambda handler for the scheduled re-scoring sweep
+func sweepHandler(ctx context.Context, event events.EventBridgeEvent) error {
+	// Add panic recovery to catch and log any crashes
+	defer recoverPanic()
+
+	debugLog(DEBUG_INFO, "Sweep handler invoked - Source: %s, DetailType: %s, Time: %s",
+		event.Source, event.DetailType, event.Time)
+
+	if ProcessorStateTableName == "" {
+		return fmt.Errorf("PROCESSOR_STATE_TABLE_NAME is not set, cannot checkpoint sweep")
+	}
+
+	state, err := loadSweepState(ctx)
+	if err != nil {
+		return err
+	}
+
+	if state == nil || state.CompletedAt != "" {
+		if state != nil && !sweepDue(*state) {
+			debugLog(DEBUG_INFO, "Last sweep %s completed at %s, next sweep not due yet", state.SweepID, state.CompletedAt)
+			return nil
+		}
+
+		state, err = startSweep(ctx)
+		if err != nil {
+			return err
+		}
+		debugLog(DEBUG_INFO, "Started new sweep %s with %d segments", state.SweepID, state.TotalSegments)
+	} else {
+		debugLog(DEBUG_INFO, "Resuming sweep %s started at %s", state.SweepID, state.StartedAt)
+	}
+
+	checkpoints, err := loadSegmentCheckpoints(ctx, *state)
+	if err != nil {
+		return err
+	}
+
+	// Scan every unfinished segment in parallel
+	var wg sync.WaitGroup
+	errs := make([]error, len(checkpoints))
+	for i, checkpoint := range checkpoints {
+		if checkpoint.Completed {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, checkpoint segmentCheckpoint) {
+			defer wg.Done()
+			errs[i] = scanSegment(ctx, *state, checkpoint)
+		}(i, checkpoint)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("sweep %s did not finish cleanly: %w", state.SweepID, err)
+		}
+	}
+
+	// Reload so segments finished in this invocation are included
+	checkpoints, err = loadSegmentCheckpoints(ctx, *state)
+	if err != nil {
+		return err
+	}
+	for _, checkpoint := range checkpoints {
+		if !checkpoint.Completed {
+			debugLog(DEBUG_INFO, "Sweep %s paused, segment %d will resume from %q on the next run",
+				state.SweepID, checkpoint.Segment, checkpoint.LastEvaluatedKey)
+			return nil
+		}
+	}
+
+	// Every user has been sampled, so the boundaries can be brought up to date
+	// for the queue processor and the next sweep
+	boundaries := rfmBoundariesFromSamples(segmentSamples(checkpoints), time.Now())
+	if err := saveRFMBoundaries(ctx, boundaries); err != nil {
+		return err
+	}
+	setRFMBoundaries(boundaries)
+	debugLog(DEBUG_INFO, "RFM boundaries recomputed from %d users: recency %v, frequency %v, monetary %v",
+		boundaries.Population, boundaries.Recency, boundaries.Frequency, boundaries.Monetary)
+
+	if SweepEmailBudget > 0 {
+		done, err := emailSweepCandidates(ctx, *state)
+		if err != nil {
+			return fmt.Errorf("sweep %s did not finish cleanly: %w", state.SweepID, err)
+		}
+		if !done {
+			debugLog(DEBUG_INFO, "Sweep %s paused while emailing candidates, resuming on the next run", state.SweepID)
+			return nil
+		}
+	}
+
+	if err := completeSweep(ctx, *state); err != nil {
+		return err
+	}
+	debugLog(DEBUG_INFO, "Sweep %s completed", state.SweepID)
+	return nil
+}
+
+// Check whether a new sweep should start after a completed one
+func sweepDue(state sweepState) bool {
+	startedAt, err := time.Parse(time.RFC3339, state.StartedAt)
+	if err != nil {
+		return true
+	}
+	return time.Since(startedAt) >= SweepInterval
+}
+
+// Check whether there is enough time left in the invocation to start more work
+func hasTimeForMoreWork(ctx context.Context, margin time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	return time.Until(deadline) > margin
+}
+
+// Scan one segment of the users table from its checkpoint, re-scoring each user
+func scanSegment(ctx context.Context, state sweepState, checkpoint segmentCheckpoint) error {
+	debugLog(DEBUG_INFO, "Scanning segment %d/%d from %q", checkpoint.Segment, state.TotalSegments, checkpoint.LastEvaluatedKey)
+
+	for hasTimeForMoreWork(ctx, SweepTimeMargin) {
+		input := &dynamodb.ScanInput{
+			TableName:     aws.String(UsersTableName),
+			Segment:       aws.Int32(int32(checkpoint.Segment)),
+			TotalSegments: aws.Int32(int32(state.TotalSegments)),
+			Limit:         aws.Int32(SweepPageSize),
+		}
+		if checkpoint.LastEvaluatedKey != "" {
+			input.ExclusiveStartKey = map[string]types.AttributeValue{
+				"userId": &types.AttributeValueMemberS{
+					Value: checkpoint.LastEvaluatedKey,
+				},
+			}
+		}
+
+		result, err := dynamoClient.Scan(ctx, input)
+		if err != nil {
+			return fmt.Errorf("error scanning segment %d: %w", checkpoint.Segment, err)
+		}
+
+		now := time.Now()
+		for _, item := range result.Items {
+			// Stop partway through the page if need be, resuming after the
+			// last user processed
+			if !hasTimeForMoreWork(ctx, SweepTimeMargin) {
+				debugLog(DEBUG_INFO, "Segment %d/%d stopping mid-page to respect the Lambda deadline", checkpoint.Segment, state.TotalSegments)
+				return saveSegmentCheckpoint(ctx, state, checkpoint)
+			}
+
+			user := userFromItem(item)
+			checkpoint.RFMSamples.add(user, now)
+			if err := rescoreUser(ctx, state, user); err != nil {
+				// One bad user should not stall the whole sweep
+				debugLog(DEBUG_ERROR, "Error re-scoring user %s: %v", user.UserID, err)
+			}
+			checkpoint.LastEvaluatedKey = user.UserID
+		}
+
+		if lastKey, ok := result.LastEvaluatedKey["userId"].(*types.AttributeValueMemberS); ok {
+			checkpoint.LastEvaluatedKey = lastKey.Value
+		} else {
+			checkpoint.Completed = true
+		}
+
+		if err := saveSegmentCheckpoint(ctx, state, checkpoint); err != nil {
+			return err
+		}
+
+		if checkpoint.Completed {
+			debugLog(DEBUG_INFO, "Segment %d/%d completed", checkpoint.Segment, state.TotalSegments)
+			return nil
+		}
+	}
+
+	debugLog(DEBUG_INFO, "Segment %d/%d stopping early to respect the Lambda deadline", checkpoint.Segment, state.TotalSegments)
+	return nil
+}
+
+// Recompute a user's score and write back anything that changed. Only users
+// who newly crossed into email territory go through the email decision, so
+// users who stay below the threshold aren't emailed again every sweep.
+// Without an email budget they are emailed straight away; with one, they are
+// recorded as candidates and emailed by value at risk once the scan finishes.
+// The new score is only written once that succeeded, so a failure leaves the
+// crossing for the next sweep to find again.
+func rescoreUser(ctx context.Context, state sweepState, user User) (err error) {
+	// One bad user should not take down the whole segment
+	defer recoverPanicAsError(&err)
+
+	scores := scoreUser(ctx, user)
+	if !scores.Changed {
+		return nil
+	}
+
+	assessment, err := assessScores(ctx, user, scores)
+	if err != nil {
+		return err
+	}
+	if !crossedEmailTrigger(user, assessment) {
+		return saveAssessment(ctx, assessment)
+	}
+
+	debugLog(DEBUG_INFO, "Sweep: user %s scored %.2f (stored: %v, threshold %.2f), running email decision",
+		user.UserID, scores.Breakdown.Score, formatOptionalScore(user.EngagementScore), EngagementScoreThreshold)
+	if !assessment.ShouldEmail {
+		return saveAssessment(ctx, assessment)
+	}
+	if SweepEmailBudget <= 0 {
+		// errEmailNotClaimed means another invocation is emailing the user, or just did
+		if _, err := emailUser(ctx, assessment); err != nil && !errors.Is(err, errEmailNotClaimed) {
+			return err
+		}
+		return saveAssessment(ctx, assessment)
+	}
+
+	if err := saveSweepCandidate(ctx, state, sweepCandidate{
+		UserID:      user.UserID,
+		ValueAtRisk: assessment.Value.ValueAtRisk,
+	}); err != nil {
+		return err
+	}
+	return saveAssessment(ctx, assessment)
+}
+
+// Check whether a re-score moved a user into email territory: their score
+// went from above the threshold to at or below it, or it started dropping
+// sharply. previous is the user as stored before the re-score. A user who was
+// never scored hasn't crossed anything; the sweep leaves them to the regular
+// email decision of the queue path rather than emailing every unscored user
+// below the threshold on the first sweep.
+func crossedEmailTrigger(previous User, assessment userAssessment) bool {
+	wasAbove := previous.EngagementScore != nil && *previous.EngagementScore > EngagementScoreThreshold
+	if wasAbove && assessment.Breakdown.Score <= EngagementScoreThreshold {
+		return true
+	}
+
+	wasDropping := previous.EngagementScoreTrend != nil && previous.EngagementScoreTrend.SharpDrop()
+	return !wasDropping && assessment.Trend.SharpDrop()
+}
+
+// Email the candidates of this and earlier sweeps in order of value at risk
+// until the budget is spent. Returns false if the Lambda deadline interrupted it.
+func emailSweepCandidates(ctx context.Context, state sweepState) (bool, error) {
+	candidates, err := loadSweepCandidates(ctx)
+	if err != nil {
+		return false, err
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ValueAtRisk > candidates[j].ValueAtRisk
+	})
+	debugLog(DEBUG_INFO, "Sweep %s has %d email candidates, %d of %d emails already sent",
+		state.SweepID, len(candidates), state.EmailsSent, SweepEmailBudget)
+
+	sent := state.EmailsSent
+	for i, candidate := range candidates {
+		if sent >= SweepEmailBudget {
+			// Remaining candidates wait for the next sweep's budget
+			debugLog(DEBUG_INFO, "Sweep %s email budget of %d spent, carrying %d candidates over",
+				state.SweepID, SweepEmailBudget, len(candidates)-i)
+			return true, nil
+		}
+		if !hasTimeForMoreWork(ctx, SweepTimeMargin) {
+			return false, nil
+		}
+
+		// Re-read the user, who may have ordered or been emailed since the scan
+		emailed := false
+		user, err := getUserFromDynamoDB(ctx, candidate.UserID)
+		switch {
+		case errors.Is(err, errUserNotFound):
+			debugLog(DEBUG_WARNING, "Sweep candidate %s no longer exists", candidate.UserID)
+		case err != nil:
+			return false, err
+		default:
+			debugLog(DEBUG_INFO, "Sweep: emailing user %s with value at risk %.2f", candidate.UserID, candidate.ValueAtRisk)
+			emailed, err = processUser(ctx, user)
+			if err != nil {
+				// One bad user should not stall the whole sweep
+				debugLog(DEBUG_ERROR, "Error emailing sweep candidate %s: %v", candidate.UserID, err)
+				if isRetryable(err) {
+					// Keep the candidate for the next sweep
+					continue
+				}
+			}
+		}
+
+		if emailed {
+			sent++
+			if err := recordSweepEmailSent(ctx, state); err != nil {
+				return false, err
+			}
+		}
+		if err := deleteSweepCandidate(ctx, candidate.UserID); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Format an optional score for logging
+func formatOptionalScore(score *float64) string {
+	if score == nil {
+		return "none"
+	}
+	return strconv.FormatFloat(*score, 'f', 2, 64)
+}
+
+// Load the current sweep state, or nil if no sweep has ever run
+func loadSweepState(ctx context.Context) (*sweepState, error) {
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepStateID,
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading sweep state: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	state := &sweepState{}
+	if sweepID, ok := result.Item["sweepId"].(*types.AttributeValueMemberS); ok {
+		state.SweepID = sweepID.Value
+	}
+	if totalSegments, ok := result.Item["totalSegments"].(*types.AttributeValueMemberN); ok {
+		state.TotalSegments, _ = strconv.Atoi(totalSegments.Value)
+	}
+	if startedAt, ok := result.Item["startedAt"].(*types.AttributeValueMemberS); ok {
+		state.StartedAt = startedAt.Value
+	}
+	if completedAt, ok := result.Item["completedAt"].(*types.AttributeValueMemberS); ok {
+		state.CompletedAt = completedAt.Value
+	}
+	if emailsSent, ok := result.Item["emailsSent"].(*types.AttributeValueMemberN); ok {
+		state.EmailsSent, _ = strconv.Atoi(emailsSent.Value)
+	}
+
+	return state, nil
+}
+
+// Start a new sweep, resetting every segment checkpoint
+func startSweep(ctx context.Context) (*sweepState, error) {
+	now := time.Now().Format(time.RFC3339)
+	state := &sweepState{
+		SweepID:       now,
+		TotalSegments: SweepSegments,
+		StartedAt:     now,
+	}
+
+	for segment := 0; segment < state.TotalSegments; segment++ {
+		if err := saveSegmentCheckpoint(ctx, *state, segmentCheckpoint{Segment: segment}); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Item: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepStateID,
+			},
+			"sweepId": &types.AttributeValueMemberS{
+				Value: state.SweepID,
+			},
+			"totalSegments": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(state.TotalSegments),
+			},
+			"startedAt": &types.AttributeValueMemberS{
+				Value: state.StartedAt,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error saving sweep state: %w", err)
+	}
+
+	return state, nil
+}
+
+// Mark the current sweep as completed
+func completeSweep(ctx context.Context, state sweepState) error {
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepStateID,
+			},
+		},
+		UpdateExpression:    aws.String("SET completedAt = :completedAt"),
+		ConditionExpression: aws.String("sweepId = :sweepId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completedAt": &types.AttributeValueMemberS{
+				Value: time.Now().Format(time.RFC3339),
+			},
+			":sweepId": &types.AttributeValueMemberS{
+				Value: state.SweepID,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error completing sweep: %w", err)
+	}
+
+	return nil
+}
+
+// Load the checkpoint of every segment in a sweep
+func loadSegmentCheckpoints(ctx context.Context, state sweepState) ([]segmentCheckpoint, error) {
+	checkpoints := make([]segmentCheckpoint, state.TotalSegments)
+
+	for segment := 0; segment < state.TotalSegments; segment++ {
+		checkpoints[segment] = segmentCheckpoint{Segment: segment}
+
+		result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(ProcessorStateTableName),
+			Key: map[string]types.AttributeValue{
+				"stateId": &types.AttributeValueMemberS{
+					Value: sweepSegmentStatePrefix + strconv.Itoa(segment),
+				},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error loading checkpoint for segment %d: %w", segment, err)
+		}
+
+		// Checkpoints from an older sweep are treated as not started
+		sweepID, _ := result.Item["sweepId"].(*types.AttributeValueMemberS)
+		if sweepID == nil || sweepID.Value != state.SweepID {
+			continue
+		}
+		if lastKey, ok := result.Item["lastEvaluatedKey"].(*types.AttributeValueMemberS); ok {
+			checkpoints[segment].LastEvaluatedKey = lastKey.Value
+		}
+		if completed, ok := result.Item["completed"].(*types.AttributeValueMemberBOOL); ok {
+			checkpoints[segment].Completed = completed.Value
+		}
+		checkpoints[segment].RFMSamples = rfmSampler{
+			Seen:      int(numberAttribute(result.Item, "rfmSeen")),
+			Recency:   numberListAttribute(result.Item, "rfmRecency"),
+			Frequency: numberListAttribute(result.Item, "rfmFrequency"),
+			Monetary:  numberListAttribute(result.Item, "rfmMonetary"),
+		}
+	}
+
+	return checkpoints, nil
+}
+
+// The RFM samples of every segment
+func segmentSamples(checkpoints []segmentCheckpoint) []rfmSampler {
+	samplers := make([]rfmSampler, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		samplers = append(samplers, checkpoint.RFMSamples)
+	}
+	return samplers
+}
+
+// Save the checkpoint of a single segment
+func saveSegmentCheckpoint(ctx context.Context, state sweepState, checkpoint segmentCheckpoint) error {
+	item := map[string]types.AttributeValue{
+		"stateId": &types.AttributeValueMemberS{
+			Value: sweepSegmentStatePrefix + strconv.Itoa(checkpoint.Segment),
+		},
+		"sweepId": &types.AttributeValueMemberS{
+			Value: state.SweepID,
+		},
+		"completed": &types.AttributeValueMemberBOOL{
+			Value: checkpoint.Completed,
+		},
+		"updatedAt": &types.AttributeValueMemberS{
+			Value: time.Now().Format(time.RFC3339),
+		},
+		"rfmSeen": &types.AttributeValueMemberN{
+			Value: strconv.Itoa(checkpoint.RFMSamples.Seen),
+		},
+		"rfmRecency":   numberListAttributeValue(checkpoint.RFMSamples.Recency),
+		"rfmFrequency": numberListAttributeValue(checkpoint.RFMSamples.Frequency),
+		"rfmMonetary":  numberListAttributeValue(checkpoint.RFMSamples.Monetary),
+	}
+	if checkpoint.LastEvaluatedKey != "" {
+		item["lastEvaluatedKey"] = &types.AttributeValueMemberS{
+			Value: checkpoint.LastEvaluatedKey,
+		}
+	}
+
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint for segment %d: %w", checkpoint.Segment, err)
+	}
+
+	return nil
+}
+
+// Record a user the sweep wants to email
+func saveSweepCandidate(ctx context.Context, state sweepState, candidate sweepCandidate) error {
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Item: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepCandidateStatePrefix + candidate.UserID,
+			},
+			"sweepId": &types.AttributeValueMemberS{
+				Value: state.SweepID,
+			},
+			"userId": &types.AttributeValueMemberS{
+				Value: candidate.UserID,
+			},
+			"valueAtRisk": &types.AttributeValueMemberN{
+				Value: strconv.FormatFloat(candidate.ValueAtRisk, 'f', 2, 64),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error saving sweep candidate %s: %w", candidate.UserID, err)
+	}
+
+	return nil
+}
+
+// Load the email candidates recorded by this and earlier sweeps
+func loadSweepCandidates(ctx context.Context) ([]sweepCandidate, error) {
+	var candidates []sweepCandidate
+
+	paginator := dynamodb.NewScanPaginator(dynamoClient, &dynamodb.ScanInput{
+		TableName:        aws.String(ProcessorStateTableName),
+		FilterExpression: aws.String("begins_with(stateId, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{
+				Value: sweepCandidateStatePrefix,
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error loading sweep candidates: %w", err)
+		}
+		for _, item := range page.Items {
+			candidates = append(candidates, sweepCandidate{
+				UserID:      stringAttribute(item, "userId"),
+				ValueAtRisk: numberAttribute(item, "valueAtRisk"),
+			})
+		}
+	}
+
+	return candidates, nil
+}
+
+// Remove a candidate once it has been handled
+func deleteSweepCandidate(ctx context.Context, userID string) error {
+	_, err := dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepCandidateStatePrefix + userID,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting sweep candidate %s: %w", userID, err)
+	}
+
+	return nil
+}
+
+// Count an email against the sweep's budget
+func recordSweepEmailSent(ctx context.Context, state sweepState) error {
+	_, err := dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ProcessorStateTableName),
+		Key: map[string]types.AttributeValue{
+			"stateId": &types.AttributeValueMemberS{
+				Value: sweepStateID,
+			},
+		},
+		UpdateExpression:    aws.String("ADD emailsSent :one"),
+		ConditionExpression: aws.String("sweepId = :sweepId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{
+				Value: "1",
+			},
+			":sweepId": &types.AttributeValueMemberS{
+				Value: state.SweepID,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error recording sweep email: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestCrossedEmailTrigger(t *testing.T) {
+	score := func(s float64) *float64 {
+		return &s
+	}
+	sharpDrop := ScoreTrend{RecentDrop: ScoreDropTriggerPoints}
+
+	tests := []struct {
+		name     string
+		previous User
+		newScore float64
+		trend    ScoreTrend
+		want     bool
+	}{
+		{
+			name:     "drops below the threshold",
+			previous: User{EngagementScore: score(70)},
+			newScore: 40,
+			want:     true,
+		},
+		{
+			name:     "stays below the threshold",
+			previous: User{EngagementScore: score(45)},
+			newScore: 40,
+			want:     false,
+		},
+		{
+			name:     "never scored is not a crossing",
+			previous: User{},
+			newScore: 40,
+			want:     false,
+		},
+		{
+			name:     "starts dropping sharply above the threshold",
+			previous: User{EngagementScore: score(95)},
+			newScore: 70,
+			trend:    sharpDrop,
+			want:     true,
+		},
+		{
+			name:     "already dropping sharply",
+			previous: User{EngagementScore: score(80), EngagementScoreTrend: &sharpDrop},
+			newScore: 70,
+			trend:    sharpDrop,
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assessment := userAssessment{
+				userScores: userScores{Breakdown: ScoreBreakdown{Score: tt.newScore}},
+				Trend:      tt.trend,
+			}
+			if got := crossedEmailTrigger(tt.previous, assessment); got != tt.want {
+				t.Errorf("crossedEmailTrigger() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ValueConfig controls the customer lifetime value heuristic and the offer
+// tiers derived from value at risk
+type ValueConfig struct {
+	// Period the expected future value covers
+	HorizonDays float64 `json:"horizonDays" yaml:"horizonDays"`
+	// Days between orders assumed for users without a cadence or enough tenure
+	DefaultCadenceDays float64 `json:"defaultCadenceDays" yaml:"defaultCadenceDays"`
+	// Tenure needed before orderCount / tenure is trusted as an order rate
+	MinTenureDays float64 `json:"minTenureDays" yaml:"minTenureDays"`
+	// Offer tiers, the first tier whose MinValueAtRisk is met applies
+	OfferTiers []OfferTier `json:"offerTiers" yaml:"offerTiers"`
+}
+
+// OfferTier is how generous an offer the email may mention
+type OfferTier struct {
+	Name           string  `json:"name" yaml:"name"`
+	MinValueAtRisk float64 `json:"minValueAtRisk" yaml:"minValueAtRisk"`
+	// Instruction given to the email generator
+	Guidance string `json:"guidance" yaml:"guidance"`
+}
+
+// Stored values within this fraction of a fresh estimate are not rewritten,
+// since the estimate drifts a little every day as tenure grows
+const ValueChangeTolerance = 0.05
+
+// Offer tier used when value at risk is below every configured tier
+const OfferTierNone = "none"
+
+// CustomerValue is a user's expected future value and how much of it is at risk
+type CustomerValue struct {
+	// Expected spend over the horizon if the user stays active
+	ExpectedValue float64
+	// Probability the user churns: the churn scorer's probability if
+	// available, otherwise 1 - engagement score / 100
+	ChurnRisk float64
+	// ExpectedValue * ChurnRisk
+	ValueAtRisk float64
+	OfferTier   string
+}
+
+// Validate the value settings and order offer tiers from most to least generous
+func prepareValueConfig(config *ValueConfig) error {
+	if config.HorizonDays <= 0 || config.DefaultCadenceDays <= 0 {
+		return fmt.Errorf("value config needs positive horizonDays and defaultCadenceDays")
+	}
+	sort.SliceStable(config.OfferTiers, func(i, j int) bool {
+		return config.OfferTiers[i].MinValueAtRisk > config.OfferTiers[j].MinValueAtRisk
+	})
+	return nil
+}
+
+// Estimate a user's future value with a frequency x monetary heuristic and
+// weight it by their churn risk
+func estimateCustomerValue(user User, breakdown ScoreBreakdown) CustomerValue {
+	expectedOrders := activeScoringConfig.Value.HorizonDays / orderIntervalDays(user)
+	value := CustomerValue{
+		ExpectedValue: expectedOrders * math.Max(user.AverageOrderValue, 0),
+		ChurnRisk:     breakdown.ChurnProbability,
+	}
+	if value.ChurnRisk == 0 {
+		value.ChurnRisk = math.Min(math.Max(1-breakdown.Score/100, 0), 1)
+	}
+	value.ValueAtRisk = value.ExpectedValue * value.ChurnRisk
+	value.OfferTier = offerTierFor(value.ValueAtRisk).Name
+	return value
+}
+
+// Typical days between a user's orders: their personal cadence when known,
+// otherwise their historical order rate, otherwise the configured default
+func orderIntervalDays(user User) float64 {
+	if cadence, ok := personalCadenceDays(user, activeScoringConfig.Cadence); ok {
+		return cadence
+	}
+
+	if createdAt, err := time.Parse(time.RFC3339, user.CreatedAt); err == nil && user.OrderCount > 0 {
+		tenure := time.Since(createdAt).Hours() / 24
+		if tenure >= activeScoringConfig.Value.MinTenureDays {
+			return math.Max(tenure/float64(user.OrderCount), 1)
+		}
+	}
+
+	return activeScoringConfig.Value.DefaultCadenceDays
+}
+
+// Find the most generous offer tier a value at risk qualifies for
+func offerTierFor(valueAtRisk float64) OfferTier {
+	for _, tier := range activeScoringConfig.Value.OfferTiers {
+		if valueAtRisk >= tier.MinValueAtRisk {
+			return tier
+		}
+	}
+	return OfferTier{Name: OfferTierNone, Guidance: "Do not mention any discount or special offer."}
+}
+
+// Check whether the value stored on the user is close enough to a freshly computed one
+func storedValueCurrent(user User, value CustomerValue) bool {
+	return user.ExpectedValue != nil && user.ValueAtRisk != nil &&
+		withinTolerance(*user.ExpectedValue, value.ExpectedValue) &&
+		withinTolerance(*user.ValueAtRisk, value.ValueAtRisk)
+}
+
+// Compare a stored value to a fresh one with ValueChangeTolerance
+func withinTolerance(stored, fresh float64) bool {
+	if scoresEqual(stored, fresh) {
+		return true
+	}
+	return math.Abs(stored-fresh) <= ValueChangeTolerance*math.Abs(fresh)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Use the embedded default scoring config as the active one for a test
+func useDefaultScoringConfig(t *testing.T) {
+	t.Helper()
+
+	var config ScoringConfig
+	if err := json.Unmarshal(defaultScoringConfig, &config); err != nil {
+		t.Fatalf("parsing default scoring config: %v", err)
+	}
+	if err := prepareValueConfig(&config.Value); err != nil {
+		t.Fatalf("preparing value config: %v", err)
+	}
+
+	previous := activeScoringConfig
+	activeScoringConfig = config
+	t.Cleanup(func() { activeScoringConfig = previous })
+}
+
+func TestEstimateCustomerValue(t *testing.T) {
+	useDefaultScoringConfig(t)
+
+	tests := []struct {
+		name      string
+		user      User
+		breakdown ScoreBreakdown
+		want      CustomerValue
+	}{
+		{
+			name:      "tenure under minTenureDays uses the default cadence",
+			user:      User{CreatedAt: daysAgo(30.5), OrderCount: 5, AverageOrderValue: 100},
+			breakdown: ScoreBreakdown{Score: 50},
+			want:      CustomerValue{ExpectedValue: 405.56, ChurnRisk: 0.5, ValueAtRisk: 202.78, OfferTier: "standard"},
+		},
+		{
+			name:      "order rate once tenure is long enough",
+			user:      User{CreatedAt: daysAgo(365), OrderCount: 4, AverageOrderValue: 110},
+			breakdown: ScoreBreakdown{Score: 0},
+			want:      CustomerValue{ExpectedValue: 440, ChurnRisk: 1, ValueAtRisk: 440, OfferTier: "premium"},
+		},
+		{
+			name:      "personal cadence and churn probability win",
+			user:      User{CreatedAt: daysAgo(30.5), OrderHistory: testOrderHistory(0, 30, 60, 90), AverageOrderValue: 50},
+			breakdown: ScoreBreakdown{Score: 90, ChurnProbability: 0.1},
+			want:      CustomerValue{ExpectedValue: 608.33, ChurnRisk: 0.1, ValueAtRisk: 60.83, OfferTier: "light"},
+		},
+		{
+			name:      "order interval is at least a day",
+			user:      User{CreatedAt: daysAgo(60.5), OrderCount: 1000, AverageOrderValue: 10},
+			breakdown: ScoreBreakdown{Score: 100},
+			want:      CustomerValue{ExpectedValue: 3650, ChurnRisk: 0, ValueAtRisk: 0, OfferTier: OfferTierNone},
+		},
+		{
+			name:      "negative average order value counts as zero",
+			user:      User{AverageOrderValue: -20},
+			breakdown: ScoreBreakdown{Score: 10},
+			want:      CustomerValue{ExpectedValue: 0, ChurnRisk: 0.9, ValueAtRisk: 0, OfferTier: OfferTierNone},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := estimateCustomerValue(tt.user, tt.breakdown)
+			assertScore(t, got.ExpectedValue, tt.want.ExpectedValue)
+			assertScore(t, got.ChurnRisk, tt.want.ChurnRisk)
+			assertScore(t, got.ValueAtRisk, tt.want.ValueAtRisk)
+			if got.OfferTier != tt.want.OfferTier {
+				t.Errorf("offer tier = %s, want %s", got.OfferTier, tt.want.OfferTier)
+			}
+		})
+	}
+}
@@ -10,9 +10,16 @@ import { User, Order, Email } from './models';
 export interface Event<T = unknown> {
   type: EventType;
   payload: T;
+  /** Layout of the payload, 1 when not set. Bump it when the payload changes incompatibly. */
+  schemaVersion?: number;
   timestamp: string;
 }
 
+/**
+ * Schema version of the events created by createEvent
+ */
+export const EVENT_SCHEMA_VERSION = 1;
+
 /**
  * Event types enum
  */
@@ -106,9 +113,15 @@ export interface EmailClickedEvent extends Event<{ emailId: string; userId: stri
 }
 
 /**
- * Email failed event
+ * Email failed event. The email processor also says which stage failed; its
+ * events have no emailId when the email could not be generated.
  */
-export interface EmailFailedEvent extends Event<{ emailId: string; userId: string; error: string }> {
+export interface EmailFailedEvent extends Event<{
+  emailId?: string;
+  userId: string;
+  error: string;
+  stage?: 'generate' | 'save' | 'send';
+}> {
   type: EventType.EMAIL_FAILED;
 }
 
@@ -135,6 +148,7 @@ export function createEvent<T extends EventType, P>(type: T, payload: P): Event<
   return {
     type,
     payload,
+    schemaVersion: EVENT_SCHEMA_VERSION,
     timestamp: new Date().toISOString()
   };
 }
\ No newline at end of file
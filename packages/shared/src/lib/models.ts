@@ -12,11 +12,85 @@ export interface User {
   lastOrderDate: string;
   orderCount: number;
   averageOrderValue: number;
+  /** Derived from order items by the email processor once orders carry categories */
   preferredCategories: string[];
+  /** Recency-weighted share of spend per category */
+  categoryAffinity?: Record<string, number>;
+  /** Categories the user used to buy but has not bought recently */
+  lapsedCategories?: string[];
   engagementScore?: number;
+  engagementScorer?: string;
+  engagementScorerVersion?: string;
+  engagementScoreBreakdown?: ScoreBreakdown;
+  engagementScoreTrend?: ScoreTrend;
+  /** RFM quintiles, e.g. "543" */
+  rfmCode?: string;
+  rfmSegment?: RFMSegment;
+  /** Expected spend over the value horizon if the user stays active */
+  expectedValue?: number;
+  /** expectedValue weighted by churn risk */
+  valueAtRisk?: number;
   lastEmailDate?: string;
   createdAt: string;
   updatedAt: string;
+  /** Equal to updatedAt when the last write came from the email processor */
+  lastProcessorWriteAt?: string;
+  /** Orders seen by the email processor, keyed by orderId */
+  orderHistory?: Record<string, OrderHistoryEntry>;
+  /** Sum of the values of the orders counted in orderCount */
+  orderValueTotal?: number;
+  /** Last returned order the client was sent a return follow-up for */
+  returnFollowUpOrderId?: string;
+  /** Set while an email processor invocation is sending the user an email */
+  emailClaimId?: string;
+  /** Unix seconds after which an unfinished send claim is abandoned */
+  emailClaimLeaseUntil?: number;
+}
+
+/**
+ * What the email processor keeps about each order on the user
+ */
+export interface OrderHistoryEntry {
+  orderDate: string;
+  /** Spend per item category in the order */
+  categories?: Record<string, number>;
+  totalValue?: number;
+  status?: OrderStatus;
+  /** Incremented by the email processor on every change to the entry */
+  revision?: number;
+}
+
+/**
+ * Record of the data the email processor erased for a deleted user
+ */
+export interface ErasureReceipt {
+  userId: string;
+  /** Timestamp of the USER_DELETED event */
+  requestedAt: string;
+  completedAt: string;
+  userRowDeleted: boolean;
+  sweepCandidateCancelled: boolean;
+  emailsDeleted: number;
+  scoreHistoryDeleted: number;
+  ledgerEntriesDeleted: number;
+  quarantinedEventsDeleted: number;
+}
+
+/**
+ * An event the email processor could not decode, kept for its producer to inspect
+ */
+export interface QuarantinedEvent {
+  /** Hash of the event type, payload and timestamp */
+  dedupKey: string;
+  eventType: string;
+  schemaVersion: number;
+  reason: string;
+  /** The event as received, JSON encoded */
+  event: string;
+  userId?: string;
+  quarantinedAt: string;
+  /** Unix seconds, removed by DynamoDB TTL */
+  expiresAt: number;
 }
 
 /**
@@ -29,8 +103,74 @@ export interface Email {
   content: string;
   generatedAt: string;
   engagementScoreAtTime: number;
+  scorerName?: string;
+  scorerVersion?: string;
+  engagementScoreBreakdown?: ScoreBreakdown;
+  rfmCode?: string;
+  rfmSegment?: RFMSegment;
+  valueAtRisk?: number;
+  /** How generous an offer the email was allowed to mention */
+  offerTier?: string;
+  emailType?: EmailType;
   status: EmailStatus;
   createdAt: string;
+  /** When the email reached each status */
+  sentAt?: string;
+  openedAt?: string;
+  clickedAt?: string;
+  failedAt?: string;
+  failureReason?: string;
+}
+
+/**
+ * Per-factor explanation of an engagement score
+ */
+export interface ScoreBreakdown {
+  scorer: string;
+  scorerVersion: string;
+  baseScore: number;
+  factors: ScoreFactor[];
+  unclampedScore: number;
+  score: number;
+  clamped: boolean;
+  calculatedAt: string;
+  /** Personal order cadence in days, when the user has enough orders for one */
+  cadenceDays?: number;
+  /** Days since last order divided by cadenceDays */
+  relativeRecency?: number;
+  /** Probability of not ordering again, when scored by the churn model */
+  churnProbability?: number;
+}
+
+/**
+ * A single factor's contribution to an engagement score
+ */
+export interface ScoreFactor {
+  name: string;
+  rawInput: number;
+  contribution: number;
+  capped?: boolean;
+  detail?: string;
+}
+
+/**
+ * Metrics derived from a user's engagement score history
+ */
+export interface ScoreTrend {
+  delta30d: number;
+  velocity: number;
+  recentDrop: number;
+  samples: number;
+}
+
+/**
+ * Kind of email the processor generated
+ */
+export enum EmailType {
+  /** Re-engagement email for an at-risk client */
+  ENGAGEMENT = 'ENGAGEMENT',
+  /** Follow-up after a client returned their whole last order */
+  RETURN_FOLLOW_UP = 'RETURN_FOLLOW_UP'
 }
 
 /**
@@ -44,6 +184,17 @@ export enum EmailStatus {
   FAILED = 'FAILED'
 }
 
+/**
+ * RFM segment assigned by the email processor
+ */
+export enum RFMSegment {
+  CHAMPIONS = 'champions',
+  LOYAL = 'loyal',
+  AT_RISK = 'at-risk',
+  HIBERNATING = 'hibernating',
+  LOST = 'lost'
+}
+
 /**
  * Order model representing a customer order
  */
@@ -149,7 +149,9 @@ async function publishToSNS(event: any): Promise<void> {
         DataType: 'String',
         StringValue: event.type
       }
-    }
+    },
+    // A FIFO topic keeps each user's events in order
+    MessageGroupId: SNS_TOPIC_ARN.endsWith('.fifo') ? event.payload.userId : undefined
   };
 
   try {
@@ -181,7 +183,8 @@ function unmarshallUser(record: any): User {
     engagementScore: record.engagementScore?.N ? parseFloat(record.engagementScore.N) : undefined,
     lastEmailDate: record.lastEmailDate?.S,
     createdAt: record.createdAt.S,
-    updatedAt: record.updatedAt.S
+    updatedAt: record.updatedAt.S,
+    lastProcessorWriteAt: record.lastProcessorWriteAt?.S
   };
 }
 